@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bootloader-usb/cyacdParse"
+	"bootloader-usb/cybootloader_protocol"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Input formats of the convert subcommand.
+const (
+	convertFormatHex = "hex"
+	convertFormatBin = "bin"
+)
+
+// runConvert turns an Intel HEX file or a flat binary into a .cyacd file that
+// can be programmed by this tool.
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	in := fs.String("in", "", "Path for the Intel HEX or binary file. - reads the file from stdin")
+	out := fs.String("out", "", "Path for the .cyacd file")
+	format := fs.String("format", "", "Input format: hex or bin. Taken from the file extension by default")
+	siliconID := fs.Uint64("silicon-id", 0, "Silicon ID of the device, e.g. 0x04A61193")
+	siliconRev := fs.Uint64("silicon-rev", 0, "Silicon revision of the device")
+	checksum := fs.String("checksum", "sum", "Packet checksum of the bootloader: sum or crc16")
+	rowSize := fs.Int("row-size", 0, "Size of a flash row in bytes")
+	rowsPerArray := fs.Int("rows-per-array", 0, "Number of rows in each flash array")
+	arrays := fs.Int("arrays", 1, "Number of flash arrays")
+	flashBase := fs.Uint64("flash-base", 0, "Address of the first flash row")
+	bootloaderEnd := fs.Uint64("bootloader-end", 0, "First address after the bootloader. Data below it is not converted")
+	base := fs.Uint64("base", 0, "Load address of a binary file. Defaults to the bootloader end")
+	fill := fs.Uint("fill", 0, "Value of the bytes of a row not covered by the input")
+	fs.Parse(args)
+
+	if *in == "" || *out == "" || *rowSize == 0 || *rowsPerArray == 0 {
+		fs.PrintDefaults()
+		return validationError("In, out, row-size and rows-per-array are required.")
+	}
+	if *siliconID > 0xFFFFFFFF || *siliconRev > 0xFF || *flashBase > 0xFFFFFFFF || *bootloaderEnd > 0xFFFFFFFF || *base > 0xFFFFFFFF || *fill > 0xFF {
+		return validationError("Silicon ID and addresses must fit 32 bits, silicon rev and fill 8 bits.")
+	}
+
+	if *format == "" {
+		*format = convertFormatHex
+		if ext := strings.ToLower(filepath.Ext(*in)); ext == ".bin" || ext == ".raw" {
+			*format = convertFormatBin
+		}
+	}
+
+	checksumType, ok := map[string]cybootloader_protocol.ChecksumType{"sum": cybootloader_protocol.ChecksumSum, "crc16": cybootloader_protocol.ChecksumCRC16}[*checksum]
+	if !ok {
+		return wrapError(fmt.Errorf("unknown checksum %q", *checksum), "Invalid checksum type", ErrorCodeParamValidation)
+	}
+
+	layout := cyacdParse.Layout{
+		SiliconID:     uint32(*siliconID),
+		SiliconRev:    uint8(*siliconRev),
+		ChecksumType:  checksumType,
+		RowSize:       *rowSize,
+		RowsPerArray:  *rowsPerArray,
+		Arrays:        *arrays,
+		FlashBase:     uint32(*flashBase),
+		BootloaderEnd: uint32(*bootloaderEnd),
+		Fill:          byte(*fill),
+	}
+
+	logEvent(slog.LevelInfo, EventProcessStart, "Converting file", "command", "convert", "file", *in, "format", *format)
+
+	var input []byte
+	var err error
+	if *in == "-" {
+		input, err = io.ReadAll(os.Stdin)
+	} else {
+		input, err = os.ReadFile(*in)
+	}
+	if err != nil {
+		return wrapError(err, "Error reading file", ErrorCodeParamValidation)
+	}
+
+	var image *cyacdParse.Cyacd
+	switch *format {
+	case convertFormatHex:
+		image, err = cyacdParse.FromIntelHex(bytes.NewReader(input), layout, *in)
+	case convertFormatBin:
+		loadAddress := layout.BootloaderEnd
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "base" {
+				loadAddress = uint32(*base)
+			}
+		})
+		image, err = cyacdParse.FromBinary(input, loadAddress, layout, *in)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		return wrapError(err, "Error converting file", ErrorCodeParamValidation)
+	}
+
+	err = os.WriteFile(*out, image.Bytes(), 0o644)
+	if err != nil {
+		return wrapError(err, "Error writing converted file", ErrorCodeParamValidation)
+	}
+
+	logEvent(slog.LevelInfo, EventProcessComplete, "Converted file written",
+		"status", "success",
+		"file", *out,
+		"rows", len(image.ParseRowData()))
+	return nil
+}
@@ -0,0 +1,107 @@
+package cyacdParse
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// DataChecksum returns the two's complement of the 8 bit sum of data, the
+// checksum the bootloader computes over the flash of a row.
+func DataChecksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return 1 + ^sum
+}
+
+// DeviceChecksum returns the checksum the bootloader reports through Get Row
+// Checksum once the row is programmed. Unlike the record checksum it only
+// covers the data, so it is computed from the data rather than derived from
+// the checksum byte of the file.
+func (r *Row) DeviceChecksum() byte {
+	return DataChecksum(r.data)
+}
+
+// AppChecksum returns the application checksum the bootloader computes when
+// it validates the application: the two's complement of the 8 bit sum of the
+// application bytes. These are the bytes of the rows before the metadata row,
+// in flash order, up to the length recorded in the metadata. Without a
+// metadata row, every row is summed.
+func (c *Cyacd) AppChecksum() byte {
+	mdRow, _ := c.MetadataRow()
+	limit := -1
+	if md, err := c.Metadata(); err == nil && md.Length > 0 {
+		limit = int(md.Length)
+	}
+
+	rows := append([]*Row(nil), c.rows...)
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].arrayID != rows[j].arrayID {
+			return rows[i].arrayID < rows[j].arrayID
+		}
+		return rows[i].rowNum < rows[j].rowNum
+	})
+
+	var sum byte
+	for _, r := range rows {
+		if r == mdRow {
+			continue
+		}
+		data := r.data
+		if limit >= 0 {
+			data = data[:min(len(data), limit)]
+			limit -= len(data)
+		}
+		for _, b := range data {
+			sum += b
+		}
+	}
+	return 1 + ^sum
+}
+
+// VerifyAppChecksum compares AppChecksum with the checksum recorded in the
+// metadata of the image, which the bootloader checks before starting the
+// application.
+func (c *Cyacd) VerifyAppChecksum() error {
+	md, err := c.Metadata()
+	if err != nil {
+		return err
+	}
+	if sum := c.AppChecksum(); sum != md.Checksum {
+		return fmt.Errorf("%s: application checksum is 0x%02X, the metadata records 0x%02X", c.path, sum, md.Checksum)
+	}
+	return nil
+}
+
+// AppChecksum returns the CRC-32C of the application range declared by
+// @APPINFO, as the DFU middleware computes it over the flash when it verifies
+// the application. Every byte of the range must be held by a row of the file.
+func (c *Cyacd2) AppChecksum() (uint32, error) {
+	if c.appInfo == nil {
+		return 0, fmt.Errorf("%s: the file has no @APPINFO", c.path)
+	}
+	start, length := uint64(c.appInfo.StartAddress), uint64(c.appInfo.Length)
+
+	app := make([]byte, length)
+	covered := make([]bool, length)
+	for _, r := range c.rows {
+		address := uint64(r.address)
+		for i, b := range r.data {
+			if a := address + uint64(i); a >= start && a < start+length {
+				app[a-start] = b
+				covered[a-start] = true
+			}
+		}
+	}
+	for i, ok := range covered {
+		if !ok {
+			return 0, fmt.Errorf("%s: no row holds address 0x%08X of the application", c.path, start+uint64(i))
+		}
+	}
+
+	return crc32.Checksum(app, crc32c), nil
+}
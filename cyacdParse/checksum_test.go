@@ -0,0 +1,121 @@
+package cyacdParse
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+func TestDataChecksum(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want byte
+	}{
+		{nil, 0x00},
+		{[]byte{0x01}, 0xFF},
+		{[]byte{0x80, 0x80}, 0x00},
+		{[]byte("123456789"), 0x23},
+	}
+	for _, tt := range tests {
+		if got := DataChecksum(tt.data); got != tt.want {
+			t.Errorf("DataChecksum(% X) = 0x%02X, want 0x%02X", tt.data, got, tt.want)
+		}
+	}
+}
+
+// appImage builds an image of three application rows of 128 bytes followed
+// by a metadata row recording length and checksum. It returns the image and
+// the application data.
+func appImage(t *testing.T, length uint32, checksum byte) (*Cyacd, []byte) {
+	t.Helper()
+
+	layout := Layout{SiliconID: 0x04C81193, SiliconRev: 0x11, RowSize: 128, RowsPerArray: 256}
+	data := make([]byte, 4*128)
+	for i := range data[:3*128] {
+		data[i] = byte(i*7 + 3)
+	}
+
+	md := data[len(data)-cybootloader_protocol.MetadataRowSize:]
+	md[0x00] = checksum
+	binary.LittleEndian.PutUint32(md[0x0B:], length)
+
+	c, err := FromBinary(data, 0, layout, "app.cyacd")
+	if err != nil {
+		t.Fatalf("FromBinary: %v", err)
+	}
+	return c, data[:3*128]
+}
+
+func TestAppChecksum(t *testing.T) {
+	tests := []struct {
+		name   string
+		length uint32
+		app    func(data []byte) []byte
+	}{
+		{"whole rows without length", 0, func(data []byte) []byte { return data }},
+		{"whole rows", 3 * 128, func(data []byte) []byte { return data }},
+		{"limited by the length", 200, func(data []byte) []byte { return data[:200] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, data := appImage(t, tt.length, 0)
+			if got, want := c.AppChecksum(), DataChecksum(tt.app(data)); got != want {
+				t.Errorf("AppChecksum = 0x%02X, want 0x%02X", got, want)
+			}
+		})
+	}
+}
+
+func TestVerifyAppChecksum(t *testing.T) {
+	_, data := appImage(t, 200, 0)
+	sum := DataChecksum(data[:200])
+
+	c, _ := appImage(t, 200, sum)
+	if err := c.VerifyAppChecksum(); err != nil {
+		t.Errorf("VerifyAppChecksum: %v", err)
+	}
+
+	c, _ = appImage(t, 200, sum+1)
+	if err := c.VerifyAppChecksum(); err == nil {
+		t.Error("VerifyAppChecksum accepted a wrong metadata checksum")
+	}
+}
+
+func TestCyacd2AppChecksum(t *testing.T) {
+	const header = "0104A6119311000101020304\n"
+	const rows = ":00000010000102030405060708090A0B0C0D0E0F\n" +
+		":10000010101112131415161718191A1B1C1D1E1F\n"
+
+	tests := []struct {
+		name    string
+		appInfo string
+		want    uint32
+		wantErr bool
+	}{
+		// CRC-32C of the bytes 0x00 to 0x1F, the iSCSI test vector
+		{"whole file", "@APPINFO:0x10000000,0x20\n", 0x46DD794E, false},
+		{"part of the rows", "@APPINFO:0x10000004,0x10\n", 0x75080B62, false},
+		{"no app info", "", 0, true},
+		{"range past the rows", "@APPINFO:0x10000000,0x21\n", 0, true},
+		{"range before the rows", "@APPINFO:0x0FFFFFFF,0x10\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCyacd2Bytes([]byte(header+tt.appInfo+rows), "test.cyacd2")
+			if err != nil {
+				t.Fatalf("ParseCyacd2Bytes: %v", err)
+			}
+			got, err := c.AppChecksum()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("AppChecksum = 0x%08X, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("AppChecksum = 0x%08X, %v, want 0x%08X", got, err, tt.want)
+			}
+		})
+	}
+}
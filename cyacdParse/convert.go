@@ -0,0 +1,239 @@
+package cyacdParse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+// Layout describes the flash of the target device, used to slice a flat
+// image into .cyacd rows.
+type Layout struct {
+	SiliconID     uint32
+	SiliconRev    uint8
+	ChecksumType  cybootloader_protocol.ChecksumType
+	RowSize       int    // Size of a flash row in bytes
+	RowsPerArray  int    // Number of rows in each flash array
+	Arrays        int    // Number of flash arrays, 0 for 1
+	FlashBase     uint32 // Address of row 0 of array 0
+	BootloaderEnd uint32 // First address after the bootloader, which is not part of the image
+	Fill          byte   // Value of the bytes of a row not covered by the input
+}
+
+func (l Layout) arrays() int {
+	if l.Arrays <= 0 {
+		return 1
+	}
+	return l.Arrays
+}
+
+// flashEnd returns the first address after the flash.
+func (l Layout) flashEnd() uint64 {
+	return uint64(l.FlashBase) + uint64(l.arrays())*uint64(l.RowsPerArray)*uint64(l.RowSize)
+}
+
+func (l Layout) validate() error {
+	if l.RowSize <= 0 || l.RowSize > 0xFFFF {
+		return fmt.Errorf("row size must be between 1 and 65535 bytes, got %d", l.RowSize)
+	}
+	if l.RowsPerArray <= 0 || l.RowsPerArray > 0x10000 {
+		return fmt.Errorf("rows per array must be between 1 and 65536, got %d", l.RowsPerArray)
+	}
+	if l.arrays() > 0x100 {
+		return fmt.Errorf("at most 256 flash arrays are supported, got %d", l.arrays())
+	}
+	if !l.ChecksumType.Valid() {
+		return fmt.Errorf("unsupported checksum type 0x%02x", byte(l.ChecksumType))
+	}
+	if l.BootloaderEnd < l.FlashBase || uint64(l.BootloaderEnd) > l.flashEnd() {
+		return fmt.Errorf("bootloader end 0x%08X is outside the flash 0x%08X-0x%08X", l.BootloaderEnd, l.FlashBase, l.flashEnd())
+	}
+	if (l.BootloaderEnd-l.FlashBase)%uint32(l.RowSize) != 0 {
+		return fmt.Errorf("bootloader end 0x%08X is not aligned to a row of %d bytes", l.BootloaderEnd, l.RowSize)
+	}
+	return nil
+}
+
+// Segment is a block of contiguous data at an address.
+type Segment struct {
+	Address uint32
+	Data    []byte
+}
+
+// FromBinary converts a flat binary loaded at address base into a .cyacd
+// image. name identifies the result in errors and as its Path.
+func FromBinary(b []byte, base uint32, layout Layout, name string) (*Cyacd, error) {
+	return FromSegments([]Segment{{Address: base, Data: b}}, layout, name)
+}
+
+// FromIntelHex converts an Intel HEX file into a .cyacd image.
+func FromIntelHex(r io.Reader, layout Layout, name string) (*Cyacd, error) {
+	segments, err := ParseIntelHex(r, name)
+	if err != nil {
+		return nil, err
+	}
+	return FromSegments(segments, layout, name)
+}
+
+// FromSegments slices data into the rows of layout. Data below the bootloader
+// end is dropped, as is data outside the flash, such as the configuration
+// sections of PSoC Creator HEX files. Rows partly covered are padded with the
+// fill byte; rows not covered at all are left out.
+func FromSegments(segments []Segment, layout Layout, name string) (*Cyacd, error) {
+	if err := layout.validate(); err != nil {
+		return nil, fmt.Errorf("invalid layout: %w", err)
+	}
+
+	rowSize := uint64(layout.RowSize)
+	rows := make(map[uint64][]byte)
+	for _, seg := range segments {
+		for i, b := range seg.Data {
+			address := uint64(seg.Address) + uint64(i)
+			if address < uint64(layout.BootloaderEnd) || address >= layout.flashEnd() {
+				continue
+			}
+
+			index := (address - uint64(layout.FlashBase)) / rowSize
+			row, ok := rows[index]
+			if !ok {
+				row = bytes.Repeat([]byte{layout.Fill}, layout.RowSize)
+				rows[index] = row
+			}
+			row[(address-uint64(layout.FlashBase))%rowSize] = b
+		}
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: no data in the application flash 0x%08X-0x%08X", name, layout.BootloaderEnd, layout.flashEnd())
+	}
+
+	indexes := make([]uint64, 0, len(rows))
+	for index := range rows {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	c := &Cyacd{
+		path:         name,
+		siliconID:    layout.SiliconID,
+		siliconRev:   uint32(layout.SiliconRev),
+		checksumType: layout.ChecksumType,
+		headerSize:   6,
+	}
+	for _, index := range indexes {
+		r := &Row{
+			arrayID: uint8(index / uint64(layout.RowsPerArray)),
+			rowNum:  uint16(index % uint64(layout.RowsPerArray)),
+			size:    uint16(layout.RowSize),
+			data:    rows[index],
+		}
+		r.checksum = r.RecordChecksum()
+		c.rows = append(c.rows, r)
+	}
+
+	return c, nil
+}
+
+// Intel HEX record types.
+const (
+	hexData                   = 0x00
+	hexEndOfFile              = 0x01
+	hexExtendedSegmentAddress = 0x02
+	hexStartSegmentAddress    = 0x03
+	hexExtendedLinearAddress  = 0x04
+	hexStartLinearAddress     = 0x05
+)
+
+// ParseIntelHex reads the data records of an Intel HEX file. When the file is
+// malformed the error is a ParseErrors listing every problem with its line
+// number.
+func ParseIntelHex(r io.Reader, name string) ([]Segment, error) {
+	var errs ParseErrors
+	fail := func(line int, format string, args ...any) {
+		errs = append(errs, &ParseError{File: name, Line: line, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	var segments []Segment
+	var base uint32
+	eof := false
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimRight(scanner.Bytes(), " \t\r")
+		if len(text) == 0 {
+			continue
+		}
+		if eof {
+			fail(line, "data after the end of file record")
+			break
+		}
+		if text[0] != ':' {
+			fail(line, "record must start with ':'")
+			continue
+		}
+
+		record, err := decodeHex(text[1:], 2)
+		if err != nil {
+			fail(line, "%v", err)
+			continue
+		}
+		if len(record) < 5 || len(record) != int(record[0])+5 {
+			fail(line, "record length does not match its byte count")
+			continue
+		}
+
+		var sum byte
+		for _, b := range record {
+			sum += b
+		}
+		if sum != 0 {
+			fail(line, "record checksum mismatch")
+			continue
+		}
+
+		data := record[4 : len(record)-1]
+		switch record[3] {
+		case hexData:
+			address := base + (uint32(record[1])<<8 | uint32(record[2]))
+			// extend the previous segment when the data follows it
+			if n := len(segments); n > 0 && segments[n-1].Address+uint32(len(segments[n-1].Data)) == address {
+				segments[n-1].Data = append(segments[n-1].Data, data...)
+			} else {
+				segments = append(segments, Segment{Address: address, Data: append([]byte(nil), data...)})
+			}
+		case hexEndOfFile:
+			eof = true
+		case hexExtendedSegmentAddress, hexExtendedLinearAddress:
+			if len(data) != 2 {
+				fail(line, "address record must hold 2 bytes, got %d", len(data))
+				continue
+			}
+			if record[3] == hexExtendedSegmentAddress {
+				base = (uint32(data[0])<<8 | uint32(data[1])) << 4
+			} else {
+				base = (uint32(data[0])<<8 | uint32(data[1])) << 16
+			}
+		case hexStartSegmentAddress, hexStartLinearAddress:
+			// entry point, not needed to program the flash
+		default:
+			fail(line, "unknown record type 0x%02X", record[3])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fail(line+1, "%v", err)
+	} else if !eof && len(errs) == 0 {
+		fail(0, "missing end of file record")
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return segments, nil
+}
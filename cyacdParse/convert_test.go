@@ -0,0 +1,152 @@
+package cyacdParse
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testHex = ":020000040000FA\n" +
+	":081000000001020304050607CC\n" +
+	":0810080008090A0B0C0D0E0F84\n" +
+	":0200000490006A\n" +
+	":02000000EEEE22\n" +
+	":00000001FF\n"
+
+// testLayout is a flash of 2 arrays of 4 rows of 8 bytes at 0x1000, whose
+// first row holds the bootloader.
+var testLayout = Layout{
+	SiliconID:     0x04A61193,
+	SiliconRev:    0x11,
+	RowSize:       8,
+	RowsPerArray:  4,
+	Arrays:        2,
+	FlashBase:     0x1000,
+	BootloaderEnd: 0x1008,
+	Fill:          0xFF,
+}
+
+func TestParseIntelHex(t *testing.T) {
+	segments, err := ParseIntelHex(strings.NewReader(testHex), "test.hex")
+	if err != nil {
+		t.Fatalf("ParseIntelHex: %v", err)
+	}
+
+	want := []Segment{
+		{Address: 0x1000, Data: []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F}},
+		{Address: 0x90000000, Data: []byte{0xEE, 0xEE}},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(segments), len(want))
+	}
+	for i, w := range want {
+		if segments[i].Address != w.Address || !bytes.Equal(segments[i].Data, w.Data) {
+			t.Errorf("segment %d = 0x%08X % X, want 0x%08X % X", i, segments[i].Address, segments[i].Data, w.Address, w.Data)
+		}
+	}
+}
+
+func TestParseIntelHexErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		line int
+	}{
+		{"record checksum", ":081000000001020304050607CD\n:00000001FF\n", 1},
+		{"byte count", ":091000000001020304050607CC\n:00000001FF\n", 1},
+		{"missing colon", "081000000001020304050607CC\n:00000001FF\n", 1},
+		{"unknown record type", ":00000006FA\n:00000001FF\n", 1},
+		{"data after end of file", ":00000001FF\n:02000000EEEE22\n", 2},
+		{"missing end of file", ":081000000001020304050607CC\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseIntelHex(strings.NewReader(tt.file), "test.hex")
+			var perrs ParseErrors
+			if !errors.As(err, &perrs) || perrs[0].Line != tt.line {
+				t.Errorf("error = %v, want a ParseErrors at line %d", err, tt.line)
+			}
+		})
+	}
+}
+
+func TestFromIntelHex(t *testing.T) {
+	c, err := FromIntelHex(strings.NewReader(testHex), testLayout, "test.hex")
+	if err != nil {
+		t.Fatalf("FromIntelHex: %v", err)
+	}
+
+	// The bootloader row and the data outside the flash are dropped
+	rows := c.ParseRowData()
+	if len(rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(rows))
+	}
+	if r := rows[0]; r.ArrayID() != 0 || r.RowNum() != 1 || !bytes.Equal(r.Data(), []byte{0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F}) {
+		t.Errorf("row = array %d row %d % X", r.ArrayID(), r.RowNum(), r.Data())
+	}
+}
+
+func TestFromBinary(t *testing.T) {
+	data := make([]byte, 20)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+
+	c, err := FromBinary(data, 0x1010, testLayout, "test.bin")
+	if err != nil {
+		t.Fatalf("FromBinary: %v", err)
+	}
+	if c.SiliconID() != testLayout.SiliconID || c.SiliconRev() != uint32(testLayout.SiliconRev) || c.Path() != "test.bin" {
+		t.Errorf("header = 0x%08X rev 0x%02X path %q", c.SiliconID(), c.SiliconRev(), c.Path())
+	}
+	if err := c.VerifyChecksums(); err != nil {
+		t.Errorf("VerifyChecksums: %v", err)
+	}
+
+	want := []struct {
+		array uint8
+		row   uint16
+		data  []byte
+	}{
+		{0, 2, data[0:8]},
+		{0, 3, data[8:16]},
+		{1, 0, append(append([]byte(nil), data[16:20]...), 0xFF, 0xFF, 0xFF, 0xFF)},
+	}
+	rows := c.ParseRowData()
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(want))
+	}
+	for i, w := range want {
+		r := rows[i]
+		if r.ArrayID() != w.array || r.RowNum() != w.row || !bytes.Equal(r.Data(), w.data) {
+			t.Errorf("row %d = array %d row %d % X, want array %d row %d % X", i, r.ArrayID(), r.RowNum(), r.Data(), w.array, w.row, w.data)
+		}
+	}
+}
+
+func TestFromBinaryErrors(t *testing.T) {
+	misaligned := testLayout
+	misaligned.BootloaderEnd = 0x1004
+
+	badChecksum := testLayout
+	badChecksum.ChecksumType = 0x02
+
+	tests := []struct {
+		name   string
+		base   uint32
+		layout Layout
+	}{
+		{"bootloader only", 0x1000, testLayout},
+		{"outside the flash", 0x2000, testLayout},
+		{"misaligned bootloader end", 0x1010, misaligned},
+		{"unknown checksum type", 0x1010, badChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := FromBinary(make([]byte, 8), tt.base, tt.layout, "test.bin"); err == nil {
+				t.Error("FromBinary succeeded")
+			}
+		})
+	}
+}
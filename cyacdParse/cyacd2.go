@@ -0,0 +1,267 @@
+package cyacdParse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+// Size of the .cyacd2 header: file version, silicon ID, silicon revision,
+// checksum type, app ID and product ID.
+const cyacd2HeaderSize = 12
+
+// Size of the address at the start of a .cyacd2 data row.
+const cyacd2AddressSize = 4
+
+// AppInfo is the location of the application declared by @APPINFO.
+type AppInfo struct {
+	StartAddress uint32
+	Length       uint32
+}
+
+// DataRow is an address based data row of a .cyacd2 file.
+type DataRow struct {
+	address uint32
+	data    []byte
+	line    int
+}
+
+func (r *DataRow) Address() uint32 {
+	return r.address
+}
+
+func (r *DataRow) Data() []byte {
+	return r.data
+}
+
+// Line returns the line of the file the row was read from.
+func (r *DataRow) Line() int {
+	return r.line
+}
+
+// Cyacd2 is a ModusToolbox DFU (.cyacd2) firmware file.
+type Cyacd2 struct {
+	path         string
+	fileVersion  uint8
+	siliconID    uint32
+	siliconRev   uint32
+	checksumType cybootloader_protocol.ChecksumType
+	appID        uint8
+	productID    uint32
+	appInfo      *AppInfo
+	eiv          []byte
+	rows         []*DataRow
+}
+
+func (c *Cyacd2) FileVersion() uint8 {
+	return c.fileVersion
+}
+
+func (c *Cyacd2) SiliconID() uint32 {
+	return c.siliconID
+}
+
+func (c *Cyacd2) SiliconRev() uint32 {
+	return c.siliconRev
+}
+
+// ChecksumType returns the packet checksum algorithm expected by the
+// bootloader.
+func (c *Cyacd2) ChecksumType() cybootloader_protocol.ChecksumType {
+	return c.checksumType
+}
+
+func (c *Cyacd2) AppID() uint8 {
+	return c.appID
+}
+
+func (c *Cyacd2) ProductID() uint32 {
+	return c.productID
+}
+
+// AppInfo returns the application location declared by @APPINFO, or nil if
+// the file has none.
+func (c *Cyacd2) AppInfo() *AppInfo {
+	return c.appInfo
+}
+
+// EIV returns the encryption initialization vector declared by @EIV, or nil
+// if the file is not encrypted.
+func (c *Cyacd2) EIV() []byte {
+	if len(c.eiv) == 0 {
+		return nil
+	}
+	return c.eiv
+}
+
+// Rows returns the data rows of the file in order.
+func (c *Cyacd2) Rows() []*DataRow {
+	return append([]*DataRow(nil), c.rows...)
+}
+
+// NewCyacd2 reads and checks a whole .cyacd2 file. When the file is malformed
+// the error is a ParseErrors listing every problem with its line number.
+func NewCyacd2(path string) (*Cyacd2, error) {
+	file, err := os.Open(path) // For read access.
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := file.Close(); e != nil {
+			slog.Debug("Failed to close cyacd2 file", "error", e)
+		}
+	}()
+
+	return ParseCyacd2(file, path)
+}
+
+// ParseCyacd2 reads a whole .cyacd2 image from r into memory. name identifies
+// the source in errors, such as a file name.
+func ParseCyacd2(r io.Reader, name string) (*Cyacd2, error) {
+	c := &Cyacd2{
+		path: name,
+	}
+
+	if err := c.parse(r); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ParseCyacd2Bytes parses a .cyacd2 image held in memory.
+func ParseCyacd2Bytes(b []byte, name string) (*Cyacd2, error) {
+	return ParseCyacd2(bytes.NewReader(b), name)
+}
+
+func (c *Cyacd2) parse(file io.Reader) error {
+	var errs ParseErrors
+	fail := func(line int, format string, args ...any) {
+		errs = append(errs, &ParseError{File: c.path, Line: line, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+
+	line := 0
+	header := false
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimRight(scanner.Bytes(), " \t\r")
+		if len(text) == 0 {
+			continue
+		}
+
+		if !header {
+			header = true
+			if err := c.parseHeader(text); err != nil {
+				fail(line, "invalid header: %v", err)
+			}
+			continue
+		}
+
+		var err error
+		switch {
+		case bytes.HasPrefix(text, []byte("@APPINFO:")):
+			err = c.parseAppInfo(string(text[len("@APPINFO:"):]))
+		case bytes.HasPrefix(text, []byte("@EIV:")):
+			c.eiv, err = decodeHex(text[len("@EIV:"):], len("@EIV:")+1)
+		case text[0] == '@':
+			err = fmt.Errorf("unknown directive %q", text)
+		default:
+			var row *DataRow
+			row, err = newDataRow(text)
+			if err == nil {
+				row.line = line
+				c.rows = append(c.rows, row)
+			}
+		}
+		if err != nil {
+			fail(line, "%v", err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fail(line+1, "%v", err)
+	} else if !header {
+		fail(0, "file is empty")
+	} else if len(c.rows) == 0 && len(errs) == 0 {
+		fail(0, "file has no data rows")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Cyacd2) parseHeader(line []byte) error {
+	decoded, err := decodeHex(line, 1)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != cyacd2HeaderSize {
+		return fmt.Errorf("expected %d bytes, got %d", cyacd2HeaderSize, len(decoded))
+	}
+
+	c.fileVersion = decoded[0]
+	c.siliconID = uint32(decoded[1])<<24 | uint32(decoded[2])<<16 | uint32(decoded[3])<<8 | uint32(decoded[4])
+	c.siliconRev = uint32(decoded[5])
+	c.checksumType = cybootloader_protocol.ChecksumType(decoded[6])
+	c.appID = decoded[7]
+	c.productID = uint32(decoded[8]) | uint32(decoded[9])<<8 | uint32(decoded[10])<<16 | uint32(decoded[11])<<24
+
+	if !c.checksumType.Valid() {
+		return fmt.Errorf("unsupported checksum type 0x%02x", byte(c.checksumType))
+	}
+
+	return nil
+}
+
+// parseAppInfo parses the "0x<start>,0x<length>" value of @APPINFO.
+func (c *Cyacd2) parseAppInfo(value string) error {
+	start, length, ok := strings.Cut(value, ",")
+	if !ok {
+		return fmt.Errorf("invalid @APPINFO %q: expected start address and length", value)
+	}
+
+	startAddress, err := strconv.ParseUint(strings.TrimSpace(start), 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid @APPINFO start address %q", start)
+	}
+	appLength, err := strconv.ParseUint(strings.TrimSpace(length), 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid @APPINFO length %q", length)
+	}
+
+	c.appInfo = &AppInfo{StartAddress: uint32(startAddress), Length: uint32(appLength)}
+	return nil
+}
+
+// newDataRow parses a data row: ':' followed by the hex encoded little endian
+// address and the data.
+func newDataRow(r []byte) (*DataRow, error) {
+	if r[0] != ':' {
+		return nil, fmt.Errorf("data row must start with ':'")
+	}
+
+	decoded, err := decodeHex(r[1:], 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) <= cyacd2AddressSize {
+		return nil, fmt.Errorf("short data row: expected an address and data, got %d bytes", len(decoded))
+	}
+
+	return &DataRow{
+		address: uint32(decoded[0]) | uint32(decoded[1])<<8 | uint32(decoded[2])<<16 | uint32(decoded[3])<<24,
+		data:    decoded[cyacd2AddressSize:],
+	}, nil
+}
@@ -0,0 +1,73 @@
+package cyacdParse
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+const testCyacd2 = "0104A6119311000101020304\r\n" +
+	"@EIV:A1B2\r\n" +
+	"@APPINFO:0x10000000,0x20\r\n" +
+	":00000010000102030405060708090A0B0C0D0E0F\r\n" +
+	":10000010101112131415161718191A1B1C1D1E1F\r\n"
+
+func TestParseCyacd2(t *testing.T) {
+	c, err := ParseCyacd2Bytes([]byte(testCyacd2), "test.cyacd2")
+	if err != nil {
+		t.Fatalf("ParseCyacd2Bytes: %v", err)
+	}
+
+	if c.FileVersion() != 1 || c.SiliconID() != 0x04A61193 || c.SiliconRev() != 0x11 ||
+		c.ChecksumType() != cybootloader_protocol.ChecksumSum || c.AppID() != 1 || c.ProductID() != 0x04030201 {
+		t.Errorf("header = version %d 0x%08X rev 0x%02X checksum %d app %d product 0x%08X",
+			c.FileVersion(), c.SiliconID(), c.SiliconRev(), c.ChecksumType(), c.AppID(), c.ProductID())
+	}
+	if !bytes.Equal(c.EIV(), []byte{0xA1, 0xB2}) {
+		t.Errorf("EIV = % X", c.EIV())
+	}
+	if app := c.AppInfo(); app == nil || *app != (AppInfo{StartAddress: 0x10000000, Length: 0x20}) {
+		t.Errorf("AppInfo = %+v", app)
+	}
+
+	rows := c.Rows()
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	for i, r := range rows {
+		address := 0x10000000 + uint32(i)*16
+		if r.Address() != address || len(r.Data()) != 16 || r.Data()[0] != byte(i*16) || r.Line() != 4+i {
+			t.Errorf("row %d = 0x%08X % X line %d", i, r.Address(), r.Data(), r.Line())
+		}
+	}
+}
+
+func TestParseCyacd2Errors(t *testing.T) {
+	const header = "0104A6119311000101020304\n"
+	const row = ":00000010000102030405060708090A0B0C0D0E0F\n"
+
+	tests := []struct {
+		name string
+		file string
+		line int
+	}{
+		{"empty", "", 0},
+		{"short header", "0104A61193\n" + row, 1},
+		{"unknown checksum type", "0104A6119311020101020304\n" + row, 1},
+		{"no rows", header, 0},
+		{"unknown directive", header + "@SIGNATURE:00\n" + row, 2},
+		{"bad app info", header + "@APPINFO:0x10000000\n" + row, 2},
+		{"address only", header + ":00000010\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCyacd2Bytes([]byte(tt.file), "test.cyacd2")
+			var perrs ParseErrors
+			if !errors.As(err, &perrs) || perrs[0].Line != tt.line {
+				t.Errorf("error = %v, want a ParseErrors at line %d", err, tt.line)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package cyacdParse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseError describes a problem found on one line of a .cyacd file. Line is
+// 1-based; it is 0 for problems with the file as a whole.
+type ParseError struct {
+	File   string
+	Line   int
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Reason)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Reason)
+}
+
+// ParseErrors is every problem found while parsing a file, in line order.
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d problems found:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+func (e ParseErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
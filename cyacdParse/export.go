@@ -0,0 +1,168 @@
+package cyacdParse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+/* Number of data bytes per Intel HEX record written by WriteIntelHex. */
+const hexRecordSize = 16
+
+// Segments returns the rows of the image placed at their flash address, in
+// address order. Only FlashBase, RowSize and RowsPerArray of layout are used;
+// a zero RowSize takes the size of the rows of the image, and RowsPerArray may
+// be zero for an image using a single array.
+func (c *Cyacd) Segments(layout Layout) ([]Segment, error) {
+	segments := make([]Segment, 0, len(c.rows))
+	for _, r := range c.rows {
+		rowSize := layout.RowSize
+		if rowSize == 0 {
+			rowSize = int(r.size)
+		}
+		if int(r.size) > rowSize {
+			return nil, fmt.Errorf("array %d row %d holds %d bytes, more than a row of %d bytes", r.arrayID, r.rowNum, r.size, rowSize)
+		}
+		if layout.RowsPerArray == 0 && r.arrayID != c.rows[0].arrayID {
+			return nil, fmt.Errorf("the image uses several arrays: rows per array is required")
+		}
+
+		index := uint64(r.rowNum)
+		if layout.RowsPerArray > 0 {
+			if int(r.rowNum) >= layout.RowsPerArray {
+				return nil, fmt.Errorf("array %d row %d is beyond the %d rows of an array", r.arrayID, r.rowNum, layout.RowsPerArray)
+			}
+			index += uint64(r.arrayID) * uint64(layout.RowsPerArray)
+		}
+
+		address := uint64(layout.FlashBase) + index*uint64(rowSize)
+		if address+uint64(len(r.data)) > 1<<32 {
+			return nil, fmt.Errorf("array %d row %d is beyond the 32-bit address space", r.arrayID, r.rowNum)
+		}
+		segments = append(segments, Segment{Address: uint32(address), Data: r.data})
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].Address < segments[j].Address })
+	return segments, nil
+}
+
+// Binary renders the image as a flat binary starting at the address of its
+// first row, which is returned. Gaps between rows are set to layout.Fill.
+func (c *Cyacd) Binary(layout Layout) (uint32, []byte, error) {
+	segments, err := c.Segments(layout)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(segments) == 0 {
+		return 0, nil, nil
+	}
+
+	// the last row may end at the top of the 32-bit address space
+	start := segments[0].Address
+	var end uint64
+	for _, s := range segments {
+		if e := uint64(s.Address) + uint64(len(s.Data)); e > end {
+			end = e
+		}
+	}
+
+	b := bytes.Repeat([]byte{layout.Fill}, int(end-uint64(start)))
+	for _, s := range segments {
+		copy(b[s.Address-start:], s.Data)
+	}
+	return start, b, nil
+}
+
+// WriteIntelHex writes the image as an Intel HEX file, rows at their flash
+// address.
+func (c *Cyacd) WriteIntelHex(w io.Writer, layout Layout) error {
+	segments, err := c.Segments(layout)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	upper := -1
+	for _, s := range segments {
+		for off := 0; off < len(s.Data); {
+			address := s.Address + uint32(off)
+			if int(address>>16) != upper {
+				upper = int(address >> 16)
+				writeHexRecord(bw, 0, hexExtendedLinearAddress, []byte{byte(upper >> 8), byte(upper)})
+			}
+
+			// a record may not cross a 64 KiB boundary
+			n := min(hexRecordSize, len(s.Data)-off, int(0x10000-(address&0xFFFF)))
+			writeHexRecord(bw, uint16(address), hexData, s.Data[off:off+n])
+			off += n
+		}
+	}
+	writeHexRecord(bw, 0, hexEndOfFile, nil)
+
+	return bw.Flush()
+}
+
+func writeHexRecord(w io.Writer, address uint16, recordType byte, data []byte) {
+	record := make([]byte, 0, 5+len(data))
+	record = append(record, byte(len(data)), byte(address>>8), byte(address), recordType)
+	record = append(record, data...)
+
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	record = append(record, 1+^sum)
+
+	writeHexLine(w, ":", record)
+}
+
+// RowDump describes a row in a JSON dump.
+type RowDump struct {
+	ArrayID  uint8  `json:"array_id"`
+	Row      uint16 `json:"row"`
+	Size     uint16 `json:"size"`
+	Checksum string `json:"checksum"`
+	Line     int    `json:"line,omitempty"`
+	Data     string `json:"data"`
+}
+
+// ImageDump describes an image in a JSON dump.
+type ImageDump struct {
+	SiliconID    string    `json:"silicon_id"`
+	SiliconRev   string    `json:"silicon_rev"`
+	ChecksumType string    `json:"checksum_type"`
+	Rows         []RowDump `json:"rows"`
+}
+
+// Dump returns a description of the header and of every row of the image.
+func (c *Cyacd) Dump() ImageDump {
+	d := ImageDump{
+		SiliconID:    fmt.Sprintf("0x%08X", c.siliconID),
+		SiliconRev:   fmt.Sprintf("0x%02X", c.siliconRev),
+		ChecksumType: c.checksumType.String(),
+		Rows:         make([]RowDump, 0, len(c.rows)),
+	}
+	for _, r := range c.rows {
+		d.Rows = append(d.Rows, RowDump{
+			ArrayID:  r.arrayID,
+			Row:      r.rowNum,
+			Size:     r.size,
+			Checksum: fmt.Sprintf("0x%02X", r.checksum),
+			Line:     r.line,
+			Data:     strings.ToUpper(hex.EncodeToString(r.data)),
+		})
+	}
+	return d
+}
+
+// WriteJSON writes the dump of the image as indented JSON.
+func (c *Cyacd) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.Dump())
+}
@@ -0,0 +1,77 @@
+package cyacdParse
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBinary(t *testing.T) {
+	data := make([]byte, 20)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	c, err := FromBinary(data, 0x1010, testLayout, "test.bin")
+	if err != nil {
+		t.Fatalf("FromBinary: %v", err)
+	}
+
+	// The rows are rendered back at their address, with the fill padding
+	start, b, err := c.Binary(testLayout)
+	if err != nil {
+		t.Fatalf("Binary: %v", err)
+	}
+	if start != 0x1010 || !bytes.Equal(b, append(append([]byte(nil), data...), 0xFF, 0xFF, 0xFF, 0xFF)) {
+		t.Errorf("Binary = 0x%08X % X", start, b)
+	}
+}
+
+func TestBinaryTopOfAddressSpace(t *testing.T) {
+	c, err := ParseCyacdBytes([]byte(testCyacd), "test.cyacd")
+	if err != nil {
+		t.Fatalf("ParseCyacdBytes: %v", err)
+	}
+
+	// array 1 row 0 is the last row and ends at 1<<32
+	layout := Layout{FlashBase: 0xFFFFFF74, RowSize: 4, RowsPerArray: 0x22}
+	start, b, err := c.Binary(layout)
+	if err != nil {
+		t.Fatalf("Binary: %v", err)
+	}
+	want := []byte{0x01, 0x02, 0x03, 0x04, 0xAA, 0xBB, 0xCC, 0xDD, 0x10, 0x20, 0x30, 0x40}
+	if start != 0xFFFFFFF4 || !bytes.Equal(b, want) {
+		t.Errorf("Binary = 0x%08X % X, want 0xFFFFFFF4 % X", start, b, want)
+	}
+
+	layout.FlashBase++
+	if _, _, err := c.Binary(layout); err == nil {
+		t.Error("Binary accepted a row past the 32-bit address space")
+	}
+}
+
+func TestWriteIntelHexRoundTrip(t *testing.T) {
+	c, err := ParseCyacdBytes([]byte(testCyacd), "test.cyacd")
+	if err != nil {
+		t.Fatalf("ParseCyacdBytes: %v", err)
+	}
+	layout := Layout{SiliconID: c.SiliconID(), SiliconRev: uint8(c.SiliconRev()), RowSize: 4, RowsPerArray: 0x4000, Arrays: 2}
+
+	var buf bytes.Buffer
+	if err := c.WriteIntelHex(&buf, layout); err != nil {
+		t.Fatalf("WriteIntelHex: %v", err)
+	}
+	back, err := FromIntelHex(&buf, layout, "test.hex")
+	if err != nil {
+		t.Fatalf("FromIntelHex: %v", err)
+	}
+
+	rows, backRows := c.ParseRowData(), back.ParseRowData()
+	if len(backRows) != len(rows) {
+		t.Fatalf("got %d rows back, want %d", len(backRows), len(rows))
+	}
+	for i, r := range rows {
+		b := backRows[i]
+		if b.ArrayID() != r.ArrayID() || b.RowNum() != r.RowNum() || !bytes.Equal(b.Data(), r.Data()) {
+			t.Errorf("row %d = array %d row %d % X, want array %d row %d % X", i, b.ArrayID(), b.RowNum(), b.Data(), r.ArrayID(), r.RowNum(), r.Data())
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package cyacdParse
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+// Format is the layout of a firmware file.
+type Format string
+
+const (
+	// FormatCyacd is the legacy bootloader format with array and row numbers.
+	FormatCyacd Format = "cyacd"
+	// FormatCyacd2 is the ModusToolbox DFU format with addresses.
+	FormatCyacd2 Format = "cyacd2"
+)
+
+// Image is a firmware file of either format.
+type Image interface {
+	Format() Format
+	Path() string
+	SiliconID() uint32
+	SiliconRev() uint32
+	ChecksumType() cybootloader_protocol.ChecksumType
+	// VerifyChecksums checks the integrity of every record the format
+	// protects, returning a ParseErrors for the corrupted ones.
+	VerifyChecksums() error
+}
+
+func (c *Cyacd) Format() Format {
+	return FormatCyacd
+}
+
+// Path returns the file name, or the name given to ParseCyacd.
+func (c *Cyacd) Path() string {
+	return c.path
+}
+
+func (c *Cyacd2) Format() Format {
+	return FormatCyacd2
+}
+
+// Path returns the file name, or the name given to ParseCyacd2.
+func (c *Cyacd2) Path() string {
+	return c.path
+}
+
+// VerifyChecksums always succeeds: .cyacd2 rows carry no checksum, their
+// integrity is checked by the device against the CRC-32C sent with Program
+// Data.
+func (c *Cyacd2) VerifyChecksums() error {
+	return nil
+}
+
+/* Magic number at the start of gzip data. */
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Load parses a firmware file of either format, which may be gzip compressed.
+// The format is taken from the file extension, or from the size of the
+// header when the extension is not known.
+func Load(path string) (Image, error) {
+	file, err := os.Open(path) // For read access.
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return LoadReader(file, path)
+}
+
+// LoadReader reads a whole firmware image of either format from r into
+// memory. name identifies the source in errors; its extension, if any,
+// selects the format.
+func LoadReader(r io.Reader, name string) (Image, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+
+	return LoadBytes(b, name)
+}
+
+// LoadBytes parses a firmware image of either format held in memory.
+func LoadBytes(b []byte, name string) (Image, error) {
+	b, err := decompress(b, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if detectFormat(name, b) == FormatCyacd2 {
+		return ParseCyacd2Bytes(b, name)
+	}
+	return ParseCyacdBytes(b, name)
+}
+
+// DetectFormat returns the format of a firmware file.
+func DetectFormat(path string) (Format, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	b, err = decompress(b, path)
+	if err != nil {
+		return "", err
+	}
+
+	return detectFormat(path, b), nil
+}
+
+// decompress inflates gzip compressed data, recognised by its magic number.
+func decompress(b []byte, name string) ([]byte, error) {
+	if !bytes.HasPrefix(b, gzipMagic) {
+		return b, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s: %w", name, err)
+	}
+	defer zr.Close()
+
+	inflated, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s: %w", name, err)
+	}
+	return inflated, nil
+}
+
+// detectFormat picks the format from the name, ignoring a .gz suffix, or else
+// from the size of the header line.
+func detectFormat(name string, b []byte) Format {
+	name = strings.TrimSuffix(strings.ToLower(name), ".gz")
+	switch filepath.Ext(name) {
+	case ".cyacd2":
+		return FormatCyacd2
+	case ".cyacd":
+		return FormatCyacd
+	}
+
+	header, _, _ := bufio.NewReader(bytes.NewReader(b)).ReadLine()
+	if len(bytes.TrimSpace(header)) == 2*cyacd2HeaderSize {
+		return FormatCyacd2
+	}
+	return FormatCyacd
+}
@@ -0,0 +1,65 @@
+package cyacdParse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestLoadBytesDetectsFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want Format
+	}{
+		{"test.cyacd", testCyacd, FormatCyacd},
+		{"test.cyacd2", testCyacd2, FormatCyacd2},
+		{"stdin", testCyacd, FormatCyacd},
+		{"stdin", testCyacd2, FormatCyacd2},
+		{"test.cyacd2.gz", gzipped(t, testCyacd2), FormatCyacd2},
+		{"stdin", gzipped(t, testCyacd2), FormatCyacd2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+string(tt.want), func(t *testing.T) {
+			image, err := LoadBytes([]byte(tt.file), tt.name)
+			if err != nil {
+				t.Fatalf("LoadBytes: %v", err)
+			}
+			if image.Format() != tt.want {
+				t.Errorf("Format = %s, want %s", image.Format(), tt.want)
+			}
+			if image.Path() != tt.name {
+				t.Errorf("Path = %q, want %q", image.Path(), tt.name)
+			}
+		})
+	}
+}
+
+func TestLoadReader(t *testing.T) {
+	image, err := LoadReader(strings.NewReader(testCyacd), "test.cyacd")
+	if err != nil {
+		t.Fatalf("LoadReader: %v", err)
+	}
+	if n := len(image.(*Cyacd).ParseRowData()); n != 3 {
+		t.Errorf("got %d rows, want 3", n)
+	}
+
+	if _, err := LoadBytes([]byte("\x1f\x8bnot gzip"), "test.cyacd.gz"); err == nil {
+		t.Error("LoadBytes accepted corrupted gzip data")
+	}
+}
@@ -0,0 +1,78 @@
+package cyacdParse
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RowRange is a run of consecutive row numbers, First and Last included.
+type RowRange struct {
+	First uint16 `json:"first"`
+	Last  uint16 `json:"last"`
+}
+
+func (r RowRange) String() string {
+	if r.First == r.Last {
+		return fmt.Sprint(r.First)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// ArrayUsage lists the rows of a flash array used by an image.
+type ArrayUsage struct {
+	ArrayID uint8      `json:"array_id"`
+	Rows    int        `json:"rows"`
+	Ranges  []RowRange `json:"ranges"`
+}
+
+// Arrays returns the flash arrays used by the image in ascending order, with
+// the ranges of rows programmed in each.
+func (c *Cyacd) Arrays() []ArrayUsage {
+	rowsByArray := make(map[uint8][]uint16)
+	for _, r := range c.rows {
+		rowsByArray[r.arrayID] = append(rowsByArray[r.arrayID], r.rowNum)
+	}
+
+	arrays := make([]ArrayUsage, 0, len(rowsByArray))
+	for id, rows := range rowsByArray {
+		sort.Slice(rows, func(i, j int) bool { return rows[i] < rows[j] })
+
+		usage := ArrayUsage{ArrayID: id, Rows: len(rows)}
+		for _, row := range rows {
+			n := len(usage.Ranges)
+			switch {
+			case n > 0 && row == usage.Ranges[n-1].Last:
+				// duplicated row, already counted in the range
+			case n > 0 && row == usage.Ranges[n-1].Last+1:
+				usage.Ranges[n-1].Last = row
+			default:
+				usage.Ranges = append(usage.Ranges, RowRange{First: row, Last: row})
+			}
+		}
+		arrays = append(arrays, usage)
+	}
+
+	sort.Slice(arrays, func(i, j int) bool { return arrays[i].ArrayID < arrays[j].ArrayID })
+	return arrays
+}
+
+// PayloadSize returns the number of bytes sent to the bootloader with Program
+// Row: the data of every row, ECC bytes included.
+func (c *Cyacd) PayloadSize() int {
+	n := 0
+	for _, r := range c.rows {
+		n += len(r.data)
+	}
+	return n
+}
+
+// PayloadSize returns the number of bytes sent to the bootloader with Program
+// Data: the data of every row, without its address. For an encrypted file
+// these are the encrypted bytes.
+func (c *Cyacd2) PayloadSize() int {
+	n := 0
+	for _, r := range c.rows {
+		n += len(r.data)
+	}
+	return n
+}
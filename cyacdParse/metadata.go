@@ -0,0 +1,37 @@
+package cyacdParse
+
+import (
+	"fmt"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+// MetadataRow returns the row holding the bootloadable metadata of the image:
+// its last row, which the build places at the end of the flash of the
+// application slot.
+func (c *Cyacd) MetadataRow() (*Row, error) {
+	var last *Row
+	for _, r := range c.rows {
+		if last == nil || r.arrayID > last.arrayID || r.arrayID == last.arrayID && r.rowNum > last.rowNum {
+			last = r
+		}
+	}
+	if last == nil {
+		return nil, fmt.Errorf("%s: the image has no rows", c.path)
+	}
+	if len(last.data) < cybootloader_protocol.MetadataRowSize {
+		return nil, fmt.Errorf("%s: array %d row %d holds %d bytes, too few for the %d bytes of metadata",
+			c.path, last.arrayID, last.rowNum, len(last.data), cybootloader_protocol.MetadataRowSize)
+	}
+	return last, nil
+}
+
+// Metadata extracts the bootloadable metadata from the end of the metadata
+// row of the image, as Get Metadata reads it from the device.
+func (c *Cyacd) Metadata() (cybootloader_protocol.Metadata, error) {
+	r, err := c.MetadataRow()
+	if err != nil {
+		return cybootloader_protocol.Metadata{}, err
+	}
+	return cybootloader_protocol.ParseMetadata(r.data[len(r.data)-cybootloader_protocol.MetadataRowSize:])
+}
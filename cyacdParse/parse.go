@@ -2,16 +2,25 @@ package cyacdParse
 
 import (
 	"bufio"
-	"encoding/hex"
+	"bytes"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
+
+	"bootloader-usb/cybootloader_protocol"
 )
 
+/* Longest line accepted: a row of 64 KiB of data, hex encoded. */
+const maxLineSize = 2*(0xFFFF+rowOverhead) + 3
+
 type Cyacd struct {
-	path       string
-	file       *os.File
-	siliconID  uint32
-	siliconRev uint32
+	path         string
+	siliconID    uint32
+	siliconRev   uint32
+	checksumType cybootloader_protocol.ChecksumType
+	headerSize   int // 5 or 6 bytes, kept when writing the file back
+	rows         []*Row
 }
 
 func (c *Cyacd) SiliconRev() uint32 {
@@ -22,64 +31,144 @@ func (c *Cyacd) SiliconID() uint32 {
 	return c.siliconID
 }
 
+// ChecksumType returns the packet checksum algorithm expected by the
+// bootloader, as declared in the header.
+func (c *Cyacd) ChecksumType() cybootloader_protocol.ChecksumType {
+	return c.checksumType
+}
+
+// NewCyacd reads and checks the whole file. When the file is malformed the
+// error is a ParseErrors listing every problem with its line number.
 func NewCyacd(path string) (*Cyacd, error) {
-	r := &Cyacd{
-		path: path,
+	file, err := os.Open(path) // For read access.
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := file.Close(); e != nil {
+			slog.Debug("Failed to close cyacd file", "error", e)
+		}
+	}()
+
+	return ParseCyacd(file, path)
+}
+
+// ParseCyacd reads a whole .cyacd image from r into memory. name identifies
+// the source in errors, such as a file name.
+func ParseCyacd(r io.Reader, name string) (*Cyacd, error) {
+	c := &Cyacd{
+		path: name,
 	}
 
-	if err := r.parseHeader(); err != nil {
+	if err := c.parse(r); err != nil {
 		return nil, err
 	}
 
-	return r, nil
+	return c, nil
 }
 
-func (c *Cyacd) open() error {
-	var err error
-	c.file, err = os.Open(c.path) // For read access.
-	if err != nil {
-		return err
-	}
-	return nil
+// ParseCyacdBytes parses a .cyacd image held in memory.
+func ParseCyacdBytes(b []byte, name string) (*Cyacd, error) {
+	return ParseCyacd(bytes.NewReader(b), name)
 }
 
-func (c *Cyacd) parseHeader() error {
-	if err := c.open(); err != nil {
-		return err
+func (c *Cyacd) parse(file io.Reader) error {
+	var errs ParseErrors
+	fail := func(line int, format string, args ...any) {
+		errs = append(errs, &ParseError{File: c.path, Line: line, Reason: fmt.Sprintf(format, args...)})
 	}
-	defer c.close()
 
-	scanner := bufio.NewReader(c.file)
-	line, _, err := scanner.ReadLine()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+
+	line := 0
+	header := false
+	for scanner.Scan() {
+		line++
+		// bufio.ScanLines drops the \r of Windows line endings; trailing
+		// whitespace left by editors is ignored as well
+		text := bytes.TrimRight(scanner.Bytes(), " \t\r")
+		if len(text) == 0 {
+			continue
+		}
+
+		if !header {
+			header = true
+			if err := c.parseHeader(text); err != nil {
+				fail(line, "invalid header: %v", err)
+			}
+			continue
+		}
+
+		row, err := NewRow(text)
+		if err != nil {
+			fail(line, "%v", err)
+			continue
+		}
+		row.line = line
+		c.rows = append(c.rows, row)
+	}
+
+	if err := scanner.Err(); err != nil {
+		fail(line+1, "%v", err)
+	} else if !header {
+		fail(0, "file is empty")
+	} else if len(c.rows) == 0 && len(errs) == 0 {
+		fail(0, "file has no row records")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Cyacd) parseHeader(line []byte) error {
+	decoded, err := decodeHex(line, 1)
 	if err != nil {
 		return err
 	}
-
-	decoded, _ := hex.DecodeString(string(line))
+	if len(decoded) != 5 && len(decoded) != 6 {
+		return fmt.Errorf("expected 5 or 6 bytes, got %d", len(decoded))
+	}
 
 	c.siliconID = uint32(decoded[0])<<24 | uint32(decoded[1])<<16 | uint32(decoded[2])<<8 | uint32(decoded[3])
 	c.siliconRev = uint32(decoded[4])
+	c.headerSize = len(decoded)
+
+	// Older files have no checksum type byte and use the basic summation
+	if len(decoded) == 6 {
+		c.checksumType = cybootloader_protocol.ChecksumType(decoded[5])
+	}
+	if !c.checksumType.Valid() {
+		return fmt.Errorf("unsupported checksum type 0x%02x", byte(c.checksumType))
+	}
 
 	return nil
 }
 
-func (c *Cyacd) close() {
-	if e := c.file.Close(); e != nil {
-		slog.Debug("Failed to close cyacd file", "error", e)
+// VerifyChecksums checks the checksum byte of every row record. The error is
+// a ParseErrors listing each corrupted record with its line number.
+func (c *Cyacd) VerifyChecksums() error {
+	var errs ParseErrors
+	for _, r := range c.rows {
+		if !r.ChecksumValid() {
+			errs = append(errs, &ParseError{
+				File: c.path,
+				Line: r.line,
+				Reason: fmt.Sprintf("record checksum mismatch for array %d row %d: file has 0x%02x, expected 0x%02x",
+					r.arrayID, r.rowNum, r.checksum, r.RecordChecksum()),
+			})
+		}
 	}
-}
 
-func (c *Cyacd) ParseRowData() []*Row {
-	var r = make([]*Row, 0)
-	c.open()
-	scanner := bufio.NewScanner(c.file)
-	scanner.Scan()
-	for scanner.Scan() {
-		r = append(r, NewRow(scanner.Bytes()))
+	if len(errs) > 0 {
+		return errs
 	}
+	return nil
+}
 
-	if err := scanner.Err(); err != nil {
-		slog.Debug("Scanner error while parsing row data", "error", err)
-	}
-	return r
+// ParseRowData returns the rows of the file in order.
+func (c *Cyacd) ParseRowData() []*Row {
+	return append([]*Row(nil), c.rows...)
 }
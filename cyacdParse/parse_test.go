@@ -0,0 +1,133 @@
+package cyacdParse
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+const testCyacd = "04A6119311\r\n" +
+	":000020000401020304D2\r\n" +
+	":0000210004AABBCCDDCD\r\n" +
+	":0100000004102030405B\r\n"
+
+func TestParseCyacd(t *testing.T) {
+	c, err := ParseCyacdBytes([]byte(testCyacd), "test.cyacd")
+	if err != nil {
+		t.Fatalf("ParseCyacdBytes: %v", err)
+	}
+	if c.SiliconID() != 0x04A61193 || c.SiliconRev() != 0x11 || c.ChecksumType() != cybootloader_protocol.ChecksumSum {
+		t.Errorf("header = 0x%08X rev 0x%02X checksum %v", c.SiliconID(), c.SiliconRev(), c.ChecksumType())
+	}
+	if err := c.VerifyChecksums(); err != nil {
+		t.Errorf("VerifyChecksums: %v", err)
+	}
+
+	want := []struct {
+		array uint8
+		row   uint16
+		data  []byte
+		line  int
+	}{
+		{0, 0x20, []byte{0x01, 0x02, 0x03, 0x04}, 2},
+		{0, 0x21, []byte{0xAA, 0xBB, 0xCC, 0xDD}, 3},
+		{1, 0x00, []byte{0x10, 0x20, 0x30, 0x40}, 4},
+	}
+	rows := c.ParseRowData()
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(want))
+	}
+	for i, w := range want {
+		r := rows[i]
+		if r.ArrayID() != w.array || r.RowNum() != w.row || !bytes.Equal(r.Data(), w.data) || r.Line() != w.line {
+			t.Errorf("row %d = array %d row %d % X line %d, want array %d row %d % X line %d",
+				i, r.ArrayID(), r.RowNum(), r.Data(), r.Line(), w.array, w.row, w.data, w.line)
+		}
+		if int(r.Size()) != len(w.data) {
+			t.Errorf("row %d size = %d, want %d", i, r.Size(), len(w.data))
+		}
+	}
+}
+
+func TestParseCyacdHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		checksum cybootloader_protocol.ChecksumType
+		wantErr  bool
+	}{
+		{name: "no checksum type", header: "04A6119311", checksum: cybootloader_protocol.ChecksumSum},
+		{name: "sum", header: "04A611931100", checksum: cybootloader_protocol.ChecksumSum},
+		{name: "crc16", header: "04A611931101", checksum: cybootloader_protocol.ChecksumCRC16},
+		{name: "unknown checksum type", header: "04A611931102", wantErr: true},
+		{name: "short", header: "04A61193", wantErr: true},
+		{name: "long", header: "04A61193110000", wantErr: true},
+		{name: "not hex", header: "04A61193XX", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCyacdBytes([]byte(tt.header+"\n:000020000401020304D2\n"), "test.cyacd")
+			if tt.wantErr {
+				var perrs ParseErrors
+				if !errors.As(err, &perrs) || perrs[0].Line != 1 {
+					t.Errorf("error = %v, want a ParseErrors at line 1", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCyacdBytes: %v", err)
+			}
+			if c.ChecksumType() != tt.checksum {
+				t.Errorf("ChecksumType = %v, want %v", c.ChecksumType(), tt.checksum)
+			}
+		})
+	}
+}
+
+func TestParseCyacdErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		lines []int
+	}{
+		{"empty", "", []int{0}},
+		{"no rows", "04A6119311\n", []int{0}},
+		{"missing colon", "04A6119311\n000020000401020304D2\n", []int{2}},
+		{"length mismatch", "04A6119311\n:000020000501020304D2\n", []int{2}},
+		{"every bad line", "04A6119311\n:0000\n:000020000401020304D2\n:00002100G4\n", []int{2, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCyacdBytes([]byte(tt.file), "test.cyacd")
+			var perrs ParseErrors
+			if !errors.As(err, &perrs) {
+				t.Fatalf("error = %v, want a ParseErrors", err)
+			}
+			if len(perrs) != len(tt.lines) {
+				t.Fatalf("got %d errors, want %d: %v", len(perrs), len(tt.lines), err)
+			}
+			for i, line := range tt.lines {
+				if perrs[i].Line != line {
+					t.Errorf("error %d at line %d, want %d", i, perrs[i].Line, line)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	file := strings.Replace(testCyacd, "CDDCD", "CDDCE", 1)
+	c, err := ParseCyacdBytes([]byte(file), "test.cyacd")
+	if err != nil {
+		t.Fatalf("ParseCyacdBytes: %v", err)
+	}
+
+	err = c.VerifyChecksums()
+	var perrs ParseErrors
+	if !errors.As(err, &perrs) || len(perrs) != 1 || perrs[0].Line != 3 {
+		t.Errorf("VerifyChecksums = %v, want one error at line 3", err)
+	}
+}
@@ -2,14 +2,20 @@ package cyacdParse
 
 import (
 	"encoding/hex"
+	"fmt"
 )
 
+// rowOverhead is the size of a row record without its data: array ID, row
+// number, data length and checksum.
+const rowOverhead = 6
+
 type Row struct {
-	arrayID uint8
-	rowNum uint16
-	size uint16
+	arrayID  uint8
+	rowNum   uint16
+	size     uint16
 	checksum uint8
-	data []byte
+	data     []byte
+	line     int
 }
 
 func (r *Row) Data() []byte {
@@ -32,21 +38,76 @@ func (r *Row) ArrayID() uint8 {
 	return r.arrayID
 }
 
-func (r *Row)ProgramRow(){
-
+// Line returns the line of the file the row was read from, 0 if unknown.
+func (r *Row) Line() int {
+	return r.line
 }
 
-func NewRow(r []byte) *Row {
-	decoded, _  := hex.DecodeString(string(r[1:]))
-	size := uint16(decoded[3]) << 8 | uint16(decoded[4])
-	return &Row{
-		decoded[0],
-		uint16(decoded[1]) << 8 | uint16(decoded[2]),
-		size,
-		decoded[len(decoded) - 1],
-		decoded[5:size + 5],
+// RecordChecksum returns the checksum the record should carry: the two's
+// complement of the sum of every other byte of the record.
+func (r *Row) RecordChecksum() uint8 {
+	sum := r.arrayID + byte(r.rowNum>>8) + byte(r.rowNum) + byte(r.size>>8) + byte(r.size)
+	for _, b := range r.data {
+		sum += b
 	}
+	return 1 + ^sum
+}
+
+// ChecksumValid reports whether the checksum stored in the record matches
+// its content.
+func (r *Row) ChecksumValid() bool {
+	return r.checksum == r.RecordChecksum()
 }
 
+func (r *Row) ProgramRow() {
+
+}
+
+// NewRow parses a row record: ':' followed by the hex encoded array ID, row
+// number, data length, data and checksum.
+func NewRow(r []byte) (*Row, error) {
+	if len(r) == 0 || r[0] != ':' {
+		return nil, fmt.Errorf("row record must start with ':'")
+	}
+
+	decoded, err := decodeHex(r[1:], 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) < rowOverhead {
+		return nil, fmt.Errorf("short row record: expected at least %d bytes, got %d", rowOverhead, len(decoded))
+	}
 
+	size := uint16(decoded[3])<<8 | uint16(decoded[4])
+	if len(decoded) != int(size)+rowOverhead {
+		return nil, fmt.Errorf("row length field is %d bytes but the record holds %d bytes of data", size, len(decoded)-rowOverhead)
+	}
 
+	return &Row{
+		arrayID:  decoded[0],
+		rowNum:   uint16(decoded[1])<<8 | uint16(decoded[2]),
+		size:     size,
+		checksum: decoded[len(decoded)-1],
+		data:     decoded[5 : size+5],
+	}, nil
+}
+
+// decodeHex decodes a hex record starting at the given 1-based column of its
+// line, so that a bad character is reported where it appears.
+func decodeHex(s []byte, column int) ([]byte, error) {
+	decoded := make([]byte, hex.DecodedLen(len(s)))
+	if _, err := hex.Decode(decoded, s); err != nil {
+		if invalid, ok := err.(hex.InvalidByteError); ok {
+			for i, c := range s {
+				if c == byte(invalid) {
+					return nil, fmt.Errorf("malformed hex: invalid character %q at column %d", c, column+i)
+				}
+			}
+		}
+		if err == hex.ErrLength {
+			return nil, fmt.Errorf("malformed hex: odd number of digits (%d)", len(s))
+		}
+		return nil, fmt.Errorf("malformed hex: %w", err)
+	}
+	return decoded, nil
+}
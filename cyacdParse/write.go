@@ -0,0 +1,158 @@
+package cyacdParse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+// ErrRowNotFound is returned when patching a row the image does not contain.
+var ErrRowNotFound = errors.New("row not found in image")
+
+/* Line ending written to .cyacd files, as PSoC Creator does. */
+const lineEnding = "\r\n"
+
+// WriteTo serialises the image as a .cyacd file. Record checksums are
+// recomputed, so patched rows are written with a valid checksum.
+func (c *Cyacd) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	header := []byte{byte(c.siliconID >> 24), byte(c.siliconID >> 16), byte(c.siliconID >> 8), byte(c.siliconID), byte(c.siliconRev)}
+	// The checksum type byte is only written if the original header had one
+	if c.headerSize > 5 || c.checksumType != cybootloader_protocol.ChecksumSum {
+		header = append(header, byte(c.checksumType))
+	}
+	writeHexLine(cw, "", header)
+
+	for _, r := range c.rows {
+		record := make([]byte, 0, rowOverhead+len(r.data))
+		record = append(record, r.arrayID, byte(r.rowNum>>8), byte(r.rowNum), byte(r.size>>8), byte(r.size))
+		record = append(record, r.data...)
+		record = append(record, r.RecordChecksum())
+		writeHexLine(cw, ":", record)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+// Bytes returns the image serialised as a .cyacd file.
+func (c *Cyacd) Bytes() []byte {
+	var buf bytes.Buffer
+	c.WriteTo(&buf) // writing to a bytes.Buffer cannot fail
+	return buf.Bytes()
+}
+
+func writeHexLine(w io.Writer, prefix string, b []byte) {
+	io.WriteString(w, prefix+strings.ToUpper(hex.EncodeToString(b))+lineEnding)
+}
+
+// countingWriter counts the bytes written and keeps the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// Row returns the row with the given array ID and row number, or nil.
+func (c *Cyacd) Row(arrayID uint8, row uint16) *Row {
+	if i := c.rowIndex(arrayID, row); i >= 0 {
+		return c.rows[i]
+	}
+	return nil
+}
+
+func (c *Cyacd) rowIndex(arrayID uint8, row uint16) int {
+	for i, r := range c.rows {
+		if r.arrayID == arrayID && r.rowNum == row {
+			return i
+		}
+	}
+	return -1
+}
+
+// ReplaceRow replaces the whole data of a row. The new data must have the size
+// of the row. The application checksum of the metadata is updated as
+// described for PatchRow.
+func (c *Cyacd) ReplaceRow(arrayID uint8, row uint16, data []byte) error {
+	i := c.rowIndex(arrayID, row)
+	if i < 0 {
+		return fmt.Errorf("%w: array %d row %d", ErrRowNotFound, arrayID, row)
+	}
+	if len(data) != len(c.rows[i].data) {
+		return fmt.Errorf("array %d row %d holds %d bytes, got %d", arrayID, row, len(c.rows[i].data), len(data))
+	}
+
+	c.setRowData(i, append([]byte(nil), data...))
+	return nil
+}
+
+// PatchRow overwrites part of a row, starting at offset bytes from the start
+// of its data.
+//
+// If the application checksum recorded in the metadata matched the image, it
+// is recomputed so that the bootloader still accepts the patched application.
+// A stale checksum is left as it is, and so is the metadata row when it is the
+// row being changed; VerifyAppChecksum reports whether the result is
+// consistent.
+func (c *Cyacd) PatchRow(arrayID uint8, row uint16, offset int, b []byte) error {
+	i := c.rowIndex(arrayID, row)
+	if i < 0 {
+		return fmt.Errorf("%w: array %d row %d", ErrRowNotFound, arrayID, row)
+	}
+
+	size := len(c.rows[i].data)
+	if offset < 0 || offset+len(b) > size {
+		return fmt.Errorf("patch of %d bytes at offset %d does not fit array %d row %d of %d bytes", len(b), offset, arrayID, row, size)
+	}
+
+	data := append([]byte(nil), c.rows[i].data...)
+	copy(data[offset:], b)
+	c.setRowData(i, data)
+	return nil
+}
+
+// setRowData replaces a row with a copy holding data, and keeps the
+// application checksum of the metadata in step.
+func (c *Cyacd) setRowData(i int, data []byte) {
+	consistent := c.VerifyAppChecksum() == nil
+	mdRow, _ := c.MetadataRow()
+
+	c.replaceRowData(i, data)
+
+	if !consistent || c.rows[i].arrayID == mdRow.arrayID && c.rows[i].rowNum == mdRow.rowNum {
+		return
+	}
+	j := c.rowIndex(mdRow.arrayID, mdRow.rowNum)
+	md := append([]byte(nil), mdRow.data...)
+	md[len(md)-cybootloader_protocol.MetadataRowSize] = c.AppChecksum()
+	c.replaceRowData(j, md)
+}
+
+// replaceRowData replaces a row with a copy holding data and a valid record
+// checksum. Rows already handed out by ParseRowData are left untouched.
+func (c *Cyacd) replaceRowData(i int, data []byte) {
+	r := *c.rows[i]
+	r.data = data
+	r.checksum = r.RecordChecksum()
+	c.rows[i] = &r
+}
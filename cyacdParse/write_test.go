@@ -0,0 +1,170 @@
+package cyacdParse
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+func TestWriteToRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"short header", testCyacd},
+		{"crc16", "04A611931101\r\n:000020000401020304D2\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCyacdBytes([]byte(tt.file), "test.cyacd")
+			if err != nil {
+				t.Fatalf("ParseCyacdBytes: %v", err)
+			}
+
+			var buf bytes.Buffer
+			n, err := c.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("WriteTo: %v", err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+			}
+			if buf.String() != tt.file {
+				t.Errorf("WriteTo =\n%q\nwant\n%q", buf.String(), tt.file)
+			}
+		})
+	}
+}
+
+func TestPatchRow(t *testing.T) {
+	c, err := ParseCyacdBytes([]byte(testCyacd), "test.cyacd")
+	if err != nil {
+		t.Fatalf("ParseCyacdBytes: %v", err)
+	}
+	before := c.ParseRowData()
+
+	if err := c.PatchRow(0, 0x21, 1, []byte{0x11, 0x22}); err != nil {
+		t.Fatalf("PatchRow: %v", err)
+	}
+
+	if got := before[1].Data(); !bytes.Equal(got, []byte{0xAA, 0xBB, 0xCC, 0xDD}) {
+		t.Errorf("row handed out before the patch changed to % X", got)
+	}
+
+	patched, err := ParseCyacdBytes(c.Bytes(), "patched.cyacd")
+	if err != nil {
+		t.Fatalf("parsing the patched image: %v", err)
+	}
+	if err := patched.VerifyChecksums(); err != nil {
+		t.Errorf("VerifyChecksums: %v", err)
+	}
+	if got := patched.Row(0, 0x21).Data(); !bytes.Equal(got, []byte{0xAA, 0x11, 0x22, 0xDD}) {
+		t.Errorf("patched row = % X", got)
+	}
+	if got := patched.Row(0, 0x20).Data(); !bytes.Equal(got, []byte{0x01, 0x02, 0x03, 0x04}) {
+		t.Errorf("other row = % X", got)
+	}
+}
+
+func TestPatchRowErrors(t *testing.T) {
+	c, err := ParseCyacdBytes([]byte(testCyacd), "test.cyacd")
+	if err != nil {
+		t.Fatalf("ParseCyacdBytes: %v", err)
+	}
+
+	if err := c.PatchRow(0, 0x22, 0, []byte{0x00}); !errors.Is(err, ErrRowNotFound) {
+		t.Errorf("patching a missing row: %v, want ErrRowNotFound", err)
+	}
+	if err := c.PatchRow(0, 0x20, 3, []byte{0x00, 0x00}); err == nil {
+		t.Error("PatchRow accepted a patch past the end of the row")
+	}
+	if err := c.PatchRow(0, 0x20, -1, []byte{0x00}); err == nil {
+		t.Error("PatchRow accepted a negative offset")
+	}
+	if err := c.ReplaceRow(0, 0x20, []byte{0x00}); err == nil {
+		t.Error("ReplaceRow accepted data shorter than the row")
+	}
+}
+
+func TestPatchRowAppChecksum(t *testing.T) {
+	_, data := appImage(t, 200, 0)
+	sum := DataChecksum(data[:200])
+
+	tests := []struct {
+		name       string
+		checksum   byte // Checksum recorded in the metadata before the change
+		change     func(c *Cyacd) error
+		want       func(c *Cyacd) byte
+		consistent bool
+	}{
+		{
+			name:       "patch inside the application",
+			checksum:   sum,
+			change:     func(c *Cyacd) error { return c.PatchRow(0, 0, 10, []byte{0x00, 0x00}) },
+			want:       func(c *Cyacd) byte { return c.AppChecksum() },
+			consistent: true,
+		},
+		{
+			name:       "replace a row",
+			checksum:   sum,
+			change:     func(c *Cyacd) error { return c.ReplaceRow(0, 1, make([]byte, 128)) },
+			want:       func(c *Cyacd) byte { return c.AppChecksum() },
+			consistent: true,
+		},
+		{
+			name:       "patch past the application length",
+			checksum:   sum,
+			change:     func(c *Cyacd) error { return c.PatchRow(0, 2, 100, []byte{0x00}) },
+			want:       func(*Cyacd) byte { return sum },
+			consistent: true,
+		},
+		{
+			name:       "stale checksum",
+			checksum:   sum + 1,
+			change:     func(c *Cyacd) error { return c.PatchRow(0, 0, 10, []byte{0x00, 0x00}) },
+			want:       func(*Cyacd) byte { return sum + 1 },
+			consistent: false,
+		},
+		{
+			name:       "metadata row",
+			checksum:   sum,
+			change:     func(c *Cyacd) error { return c.PatchRow(0, 3, 128-cybootloader_protocol.MetadataRowSize, []byte{0x42}) },
+			want:       func(*Cyacd) byte { return 0x42 },
+			consistent: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := appImage(t, 200, tt.checksum)
+			before := c.ParseRowData()
+
+			if err := tt.change(c); err != nil {
+				t.Fatalf("changing the image: %v", err)
+			}
+
+			md, err := c.Metadata()
+			if err != nil {
+				t.Fatalf("Metadata: %v", err)
+			}
+			if want := tt.want(c); md.Checksum != want {
+				t.Errorf("metadata checksum = 0x%02X, want 0x%02X", md.Checksum, want)
+			}
+			if err := c.VerifyAppChecksum(); (err == nil) != tt.consistent {
+				t.Errorf("VerifyAppChecksum = %v, want consistent %v", err, tt.consistent)
+			}
+			if got := before[3].Data()[128-cybootloader_protocol.MetadataRowSize]; got != tt.checksum {
+				t.Errorf("metadata row handed out before the change holds checksum 0x%02X", got)
+			}
+
+			written, err := ParseCyacdBytes(c.Bytes(), "patched.cyacd")
+			if err != nil {
+				t.Fatalf("parsing the patched image: %v", err)
+			}
+			if err := written.VerifyChecksums(); err != nil {
+				t.Errorf("VerifyChecksums: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package cybootloader_protocol
+
+import "fmt"
+
+// ChecksumType selects the algorithm used for the packet checksum. It matches
+// the checksum type byte of the .cyacd header.
+type ChecksumType byte
+
+const (
+	/* Basic summation: two's complement of the 16 bit sum of the packet bytes. */
+	ChecksumSum ChecksumType = 0x00
+	/* CRC-16-CCITT of the packet bytes. */
+	ChecksumCRC16 ChecksumType = 0x01
+)
+
+func (t ChecksumType) String() string {
+	switch t {
+	case ChecksumSum:
+		return "sum"
+	case ChecksumCRC16:
+		return "crc16"
+	default:
+		return fmt.Sprintf("unknown(0x%02X)", byte(t))
+	}
+}
+
+// Valid reports whether t is a checksum type supported by the bootloader.
+func (t ChecksumType) Valid() bool {
+	return t == ChecksumSum || t == ChecksumCRC16
+}
+
+// Compute returns the 16 bit packet checksum of data, in the form stored in a
+// frame (low byte first).
+func (t ChecksumType) Compute(data []byte) uint16 {
+	if t == ChecksumCRC16 {
+		return crc16(data)
+	}
+
+	var sum uint16
+	for _, b := range data {
+		sum += uint16(b)
+	}
+	return 1 + ^sum
+}
+
+// crc16 computes the CRC-16-CCITT used by the Cypress bootloader. The result
+// is byte swapped, as done by the reference host implementation.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+
+	if len(data) == 0 {
+		return ^crc
+	}
+
+	for _, b := range data {
+		tmp := uint16(b)
+		for i := 0; i < 8; i++ {
+			if (crc&0x0001)^(tmp&0x0001) != 0 {
+				crc = (crc >> 1) ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+			tmp >>= 1
+		}
+	}
+
+	crc = ^crc
+	return crc<<8 | crc>>8
+}
+
+// UpdateFrameChecksum recomputes the packet checksum of a complete frame
+// using the given algorithm.
+func UpdateFrameChecksum(frame []byte, t ChecksumType) {
+	if len(frame) < BaseCmdSize {
+		return
+	}
+	frame[len(frame)-3], frame[len(frame)-2] = calcChecksum(frame, t)
+}
@@ -0,0 +1,38 @@
+package cybootloader_protocol
+
+import "testing"
+
+func TestChecksumCompute(t *testing.T) {
+	tests := []struct {
+		name string
+		t    ChecksumType
+		data []byte
+		want uint16
+	}{
+		{"sum empty", ChecksumSum, nil, 0x0000},
+		{"sum check string", ChecksumSum, []byte("123456789"), 0xFE23},
+		{"sum enter bootloader", ChecksumSum, []byte{0x01, 0x38, 0x00, 0x00}, 0xFFC7},
+		{"sum zeros", ChecksumSum, []byte{0x00, 0x00, 0x00, 0x00}, 0x0000},
+		{"crc16 empty", ChecksumCRC16, nil, 0x0000},
+		// CRC-16/X-25 of the check string is 0x906E, byte swapped
+		{"crc16 check string", ChecksumCRC16, []byte("123456789"), 0x6E90},
+		{"crc16 enter bootloader", ChecksumCRC16, []byte{0x01, 0x38, 0x00, 0x00}, 0x09A0},
+		{"crc16 zeros", ChecksumCRC16, []byte{0x00, 0x00, 0x00, 0x00}, 0xDEFC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.t.Compute(tt.data); got != tt.want {
+				t.Errorf("Compute(% X) = 0x%04X, want 0x%04X", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCRC16(t *testing.T) {
+	if got := crc16([]byte("123456789")); got != 0x6E90 {
+		t.Errorf("crc16 = 0x%04X, want 0x6E90", got)
+	}
+	if got := crc16(nil); got != 0 {
+		t.Errorf("crc16 of no data = 0x%04X, want 0", got)
+	}
+}
@@ -1,6 +1,7 @@
 package cybootloader_protocol
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -37,23 +38,24 @@ const (
 	CmdGetRowChecksum = 0x3A
 	/* Command identifier for exiting the bootloader and restarting the target program. */
 	CmdExitBootloader = 0x3B
+	/* Command identifier for reading the metadata of a bootloadable application. */
+	CmdGetMetadata = 0x3C
 
 	CyretSuccess = 0x00
-)
-
-func calcChecksum(frame []byte) (uint8, uint8) {
-	var sum uint = 0
 
-	for _, f := range frame[:len(frame)-3] {
-		sum += uint(f)
-	}
+	/* Number of application slots of a multi app bootloader. */
+	MaxApps = 2
+)
 
-	result := 1 + (0xffff ^ sum)
+// calcChecksum returns the packet checksum of a frame computed with the
+// algorithm t, low byte first.
+func calcChecksum(frame []byte, t ChecksumType) (uint8, uint8) {
+	result := t.Compute(frame[:len(frame)-3])
 
 	return uint8(result & 0xff), uint8(result >> 8)
 }
 
-func CreateEnterBootloaderCmd(key []byte) ([]byte, error) {
+func CreateEnterBootloaderCmd(key []byte, t ChecksumType) ([]byte, error) {
 	const CommandDataSize = 6
 	const CommandSize = BaseCmdSize + CommandDataSize
 	var frame []byte
@@ -75,15 +77,13 @@ func CreateEnterBootloaderCmd(key []byte) ([]byte, error) {
 
 	frame[3] = 0x00
 
-	if key != nil {
-		if len(key) != 6 {
-			return nil, errors.New("invalid size of key. Must be 6 bytes")
-		}
-		frame = append(frame[0:4], key...)
+	if key != nil && len(key) != 6 {
+		return nil, errors.New("invalid size of key. Must be 6 bytes")
 	}
+	frame = append(frame[0:4], key...)
 
 	frame = append(frame, 0, 0, 0)
-	frame[len(frame)-3], frame[len(frame)-2] = calcChecksum(frame)
+	frame[len(frame)-3], frame[len(frame)-2] = calcChecksum(frame, t)
 	frame[len(frame)-1] = CmdStop
 
 	return frame, nil
@@ -98,60 +98,37 @@ func CreateEnterBootloaderCmd(key []byte) ([]byte, error) {
 //
 // Returns:
 //   - map[string]uint32: A map with keys "siliconID", "siliconRev", and "bootloaderVersion"
-//   - error: An error if the response has an invalid format or indicates a bootloader error
-func ParseEnterBootloaderCmdResult(r []byte) (map[string]uint32, error) {
+//   - error: A *BootloaderError if the bootloader reported an error, a
+//     *ChecksumError if the packet checksum is wrong, or an error wrapping
+//     ErrInvalidFrame if the response has an invalid format
+func ParseEnterBootloaderCmdResult(r []byte, t ChecksumType) (map[string]uint32, error) {
 	const ResultDataSize = 8
-	const expectedFrameSize = BaseCmdSize + ResultDataSize
-
-	// Check if we have enough data to process
-	if len(r) < expectedFrameSize {
-		return nil, fmt.Errorf("invalid response: expected at least %d bytes, got %d", expectedFrameSize, len(r))
-	}
 
-	frame := r[:expectedFrameSize]
-
-	// Check if bootloader reported an error
-	if frame[1] != CyretSuccess {
-		return nil, fmt.Errorf("bootloader reported an error: status code 0x%02X", frame[1])
-	}
-
-	// Validate frame format
-	if frame[0] != CmdStart {
-		return nil, fmt.Errorf("invalid start byte: expected 0x%02X, got 0x%02X", CmdStart, frame[0])
-	}
-
-	// Validate data size (little-endian format)
-	dataSize := uint16(frame[2]) | (uint16(frame[3]) << 8)
-	if dataSize != ResultDataSize {
-		return nil, fmt.Errorf("invalid data size: expected %d, got %d", ResultDataSize, dataSize)
-	}
-
-	// Check the end marker
-	if frame[expectedFrameSize-1] != CmdStop {
-		return nil, fmt.Errorf("invalid end byte: expected 0x%02X, got 0x%02X", CmdStop, frame[expectedFrameSize-1])
+	data, err := checkResponse(CmdEnterBootloader, r, ResultDataSize, t)
+	if err != nil {
+		return nil, err
 	}
 
-	// All validation passed, extract the data fields
 	result := make(map[string]uint32)
 
 	// Silicon ID (4 bytes, little-endian)
-	result["siliconID"] = uint32(frame[4]) |
-		(uint32(frame[5]) << 8) |
-		(uint32(frame[6]) << 16) |
-		(uint32(frame[7]) << 24)
+	result["siliconID"] = uint32(data[0]) |
+		(uint32(data[1]) << 8) |
+		(uint32(data[2]) << 16) |
+		(uint32(data[3]) << 24)
 
 	// Silicon Revision (1 byte)
-	result["siliconRev"] = uint32(frame[8])
+	result["siliconRev"] = uint32(data[4])
 
 	// Bootloader Version (3 bytes, little-endian)
-	result["bootloaderVersion"] = uint32(frame[9]) |
-		(uint32(frame[10]) << 8) |
-		(uint32(frame[11]) << 16)
+	result["bootloaderVersion"] = uint32(data[5]) |
+		(uint32(data[6]) << 8) |
+		(uint32(data[7]) << 16)
 
 	return result, nil
 }
 
-func CreateExitBootloaderCmd() []byte {
+func CreateExitBootloaderCmd(t ChecksumType) []byte {
 
 	frame := make([]byte, BaseCmdSize)
 
@@ -159,13 +136,19 @@ func CreateExitBootloaderCmd() []byte {
 	frame[1] = CmdExitBootloader
 	frame[2] = 0x00
 	frame[3] = 0x00
-	frame[4], frame[5] = calcChecksum(frame)
+	frame[4], frame[5] = calcChecksum(frame, t)
 	frame[6] = CmdStop
 
 	return frame
 }
 
-func CreateGetFlashSizeCmd() []byte {
+func CreateGetFlashSizeCmd(t ChecksumType) []byte {
+	return CreateGetFlashSizeArrayCmd(0x00, t)
+}
+
+// CreateGetFlashSizeArrayCmd builds the Get Flash Size command for a given
+// flash array.
+func CreateGetFlashSizeArrayCmd(arrayID byte, t ChecksumType) []byte {
 	const CommandDataSize = 1
 	const CommandSize = BaseCmdSize + CommandDataSize
 
@@ -174,33 +157,28 @@ func CreateGetFlashSizeCmd() []byte {
 	frame[1] = CmdGetFlashSize
 	frame[2] = byte(CommandDataSize)
 	frame[3] = byte(CommandDataSize) >> 8
-	frame[4] = 0x00
-	frame[5], frame[6] = calcChecksum(frame)
+	frame[4] = arrayID
+	frame[5], frame[6] = calcChecksum(frame, t)
 	frame[7] = CmdStop
 
 	return frame
 }
 
-func ParseCreateGetFlashSizeCmdResult(r []byte) (map[string]uint16, error) {
+func ParseCreateGetFlashSizeCmdResult(r []byte, t ChecksumType) (map[string]uint16, error) {
 	const ResultDataSize = 4
-	const sizeResult = BaseCmdSize + ResultDataSize
-
-	frame := r[:sizeResult]
 
-	if frame[1] != CyretSuccess {
-		return nil, errors.New("[ERROR] The bootloader reported an error")
-	} else if frame[0] != CmdStart || frame[2] != ResultDataSize || frame[3] != (ResultDataSize>>8) || frame[sizeResult-1] != CmdStop {
-		return nil, errors.New("[ERROR] The data is not of the proper form")
-	} else {
-		var r = make(map[string]uint16)
-		r["startRow"] = uint16(frame[5])<<8 | uint16(frame[4])
-		r["endRow"] = uint16(frame[7])<<8 | uint16(frame[6])
-		return r, nil
+	data, err := checkResponse(CmdGetFlashSize, r, ResultDataSize, t)
+	if err != nil {
+		return nil, err
 	}
 
+	var result = make(map[string]uint16)
+	result["startRow"] = uint16(data[1])<<8 | uint16(data[0])
+	result["endRow"] = uint16(data[3])<<8 | uint16(data[2])
+	return result, nil
 }
 
-func CreateSendDataCmd(b []byte) []byte {
+func CreateSendDataCmd(b []byte, t ChecksumType) []byte {
 
 	CommandSize := BaseCmdSize + len(b)
 
@@ -208,34 +186,26 @@ func CreateSendDataCmd(b []byte) []byte {
 	frame[0] = CmdStart
 	frame[1] = CmdSendData
 	frame[2] = byte(len(b))
-	frame[3] = byte(len(b)) >> 8
+	frame[3] = byte(len(b) >> 8)
 	frame = append(frame[0:4], b...)
 	frame = append(frame, 0, 0, 0)
-	frame[len(frame)-3], frame[len(frame)-2] = calcChecksum(frame)
+	frame[len(frame)-3], frame[len(frame)-2] = calcChecksum(frame, t)
 	frame[len(frame)-1] = CmdStop
 
 	return frame
 }
 
-func ParseDefaultCmdResult(r []byte) bool {
-	const sizeResult = BaseCmdSize
-
-	frame := r[:sizeResult]
-
-	if frame[1] != CyretSuccess {
-		return false
-	} else if frame[0] != CmdStart || frame[2] != 0 || frame[3] != 0 || frame[6] != CmdStop {
-		return false
-	}
-
-	return true
+// ParseDefaultCmdResult validates a response to cmd that carries no data.
+func ParseDefaultCmdResult(cmd byte, r []byte, t ChecksumType) error {
+	_, err := checkResponse(cmd, r, 0, t)
+	return err
 }
 
-func ParseSendDataCmdResult(r []byte) bool {
-	return ParseDefaultCmdResult(r)
+func ParseSendDataCmdResult(r []byte, t ChecksumType) error {
+	return ParseDefaultCmdResult(CmdSendData, r, t)
 }
 
-func CreateProgramRowCmd(b []byte, arrayID byte, row uint16) []byte {
+func CreateProgramRowCmd(b []byte, arrayID byte, row uint16, t ChecksumType) []byte {
 	const CommandDataSize = 3
 	CommandSize := BaseCmdSize + CommandDataSize + len(b)
 
@@ -243,23 +213,23 @@ func CreateProgramRowCmd(b []byte, arrayID byte, row uint16) []byte {
 	frame[0] = CmdStart
 	frame[1] = CmdProgramRow
 	frame[2] = byte(CommandDataSize + len(b))
-	frame[3] = byte(CommandDataSize+len(b)) >> 8
+	frame[3] = byte((CommandDataSize + len(b)) >> 8)
 	frame[4] = arrayID
 	frame[5] = byte(row)
 	frame[6] = byte(row >> 8)
 	frame = append(frame[0:7], b...)
 	frame = append(frame, 0, 0, 0)
-	frame[len(frame)-3], frame[len(frame)-2] = calcChecksum(frame)
+	frame[len(frame)-3], frame[len(frame)-2] = calcChecksum(frame, t)
 	frame[len(frame)-1] = CmdStop
 
 	return frame
 }
 
-func ParseProgramRowCmdResult(r []byte) bool {
-	return ParseDefaultCmdResult(r)
+func ParseProgramRowCmdResult(r []byte, t ChecksumType) error {
+	return ParseDefaultCmdResult(CmdProgramRow, r, t)
 }
 
-func CreateGetRowChecksumCmd(arrayID byte, row uint16) []byte {
+func CreateGetRowChecksumCmd(arrayID byte, row uint16, t ChecksumType) []byte {
 	const CommandDataSize = 3
 	const CommandSize = BaseCmdSize + CommandDataSize
 
@@ -271,33 +241,28 @@ func CreateGetRowChecksumCmd(arrayID byte, row uint16) []byte {
 	frame[4] = arrayID
 	frame[5] = byte(row)
 	frame[6] = byte(row >> 8)
-	frame[7], frame[8] = calcChecksum(frame)
+	frame[7], frame[8] = calcChecksum(frame, t)
 	frame[9] = CmdStop
 
 	return frame
 }
 
-func ParseGetRowChecksumCmdResult(r []byte) (byte, error) {
+func ParseGetRowChecksumCmdResult(r []byte, t ChecksumType) (byte, error) {
 	const ResultDataSize = 1
-	const sizeResult = BaseCmdSize + ResultDataSize
-
-	frame := r[:sizeResult]
 
-	if frame[1] != CyretSuccess {
-		return 0xff, errors.New("[ERROR] The bootloader reported an error")
-	} else if frame[0] != CmdStart || frame[2] != ResultDataSize || frame[3] != (ResultDataSize>>8) || frame[sizeResult-1] != CmdStop {
-		return 0xff, errors.New("[ERROR] The data is not of the proper form")
-	} else {
-
-		return frame[4], nil
+	data, err := checkResponse(CmdGetRowChecksum, r, ResultDataSize, t)
+	if err != nil {
+		return 0xff, err
 	}
+
+	return data[0], nil
 }
 
-func ParseEraseRowCmdResult(r []byte) bool {
-	return ParseDefaultCmdResult(r)
+func ParseEraseRowCmdResult(r []byte, t ChecksumType) error {
+	return ParseDefaultCmdResult(CmdEraseRow, r, t)
 }
 
-func CreateEraseRowCmd(arrayID byte, row uint16) []byte {
+func CreateEraseRowCmd(arrayID byte, row uint16, t ChecksumType) []byte {
 	const CommandDataSize = 3
 	const CommandSize = BaseCmdSize + CommandDataSize
 
@@ -309,13 +274,13 @@ func CreateEraseRowCmd(arrayID byte, row uint16) []byte {
 	frame[4] = arrayID
 	frame[5] = byte(row)
 	frame[6] = byte(row >> 8)
-	frame[7], frame[8] = calcChecksum(frame)
+	frame[7], frame[8] = calcChecksum(frame, t)
 	frame[9] = CmdStop
 
 	return frame
 }
 
-func CreateVerifyAppChecksumCmd() []byte {
+func CreateVerifyAppChecksumCmd(t ChecksumType) []byte {
 	const CommandDataSize = 0
 	const CommandSize = BaseCmdSize + CommandDataSize
 
@@ -324,98 +289,202 @@ func CreateVerifyAppChecksumCmd() []byte {
 	frame[1] = CmdVerifyChecksum
 	frame[2] = byte(CommandDataSize)
 	frame[3] = byte(CommandDataSize) >> 8
-	frame[4], frame[5] = calcChecksum(frame)
+	frame[4], frame[5] = calcChecksum(frame, t)
 	frame[6] = CmdStop
 
 	return frame
 }
 
-func ParseVerifyAppChecksumCmdResult(r []byte) (byte, error) {
+func ParseVerifyAppChecksumCmdResult(r []byte, t ChecksumType) (byte, error) {
 	const ResultDataSize = 1
-	const sizeResult = BaseCmdSize + ResultDataSize
 
-	frame := r[:sizeResult]
+	data, err := checkResponse(CmdVerifyChecksum, r, ResultDataSize, t)
+	if err != nil {
+		return 0xff, err
+	}
 
-	if frame[1] != CyretSuccess {
-		return 0xff, errors.New("[ERROR] The bootloader reported an error")
-	} else if frame[0] != CmdStart || frame[2] != ResultDataSize || frame[3] != (ResultDataSize>>8) || frame[sizeResult-1] != CmdStop {
-		return 0xff, errors.New("[ERROR] The data is not of the proper form")
-	} else {
+	return data[0], nil
+}
 
-		return frame[4], nil
-	}
+// AppStatus is the state of an application slot of a multi app bootloader.
+type AppStatus struct {
+	Valid  bool // The application passed its checksum verification
+	Active bool // The application is the one started by the bootloader
+}
+
+func CreateGetAppStatusCmd(appID byte, t ChecksumType) []byte {
+	const CommandDataSize = 1
+	const CommandSize = BaseCmdSize + CommandDataSize
+
+	frame := make([]byte, CommandSize)
+	frame[0] = CmdStart
+	frame[1] = CMD_GET_APP_STATUS
+	frame[2] = byte(CommandDataSize)
+	frame[3] = byte(CommandDataSize >> 8)
+	frame[4] = appID
+	frame[5], frame[6] = calcChecksum(frame, t)
+	frame[7] = CmdStop
+
+	return frame
 }
 
-func GetFlashSize(dev io.ReadWriter) (error, uint16, uint16) {
-	frame := CreateGetFlashSizeCmd()
+func ParseGetAppStatusCmdResult(r []byte, t ChecksumType) (AppStatus, error) {
+	const ResultDataSize = 2
 
-	_, err := dev.Write(frame)
+	data, err := checkResponse(CMD_GET_APP_STATUS, r, ResultDataSize, t)
 	if err != nil {
-		return err, 0, 0
+		return AppStatus{}, err
 	}
 
-	time.Sleep(time.Millisecond * 20)
+	return AppStatus{Valid: data[0] != 0, Active: data[1] != 0}, nil
+}
 
-	readBuf := make([]byte, 64)
-	_, err = dev.Read(readBuf)
+func CreateSetActiveAppCmd(appID byte, t ChecksumType) []byte {
+	const CommandDataSize = 1
+	const CommandSize = BaseCmdSize + CommandDataSize
+
+	frame := make([]byte, CommandSize)
+	frame[0] = CmdStart
+	frame[1] = CMD_SET_ACTIVE_APP
+	frame[2] = byte(CommandDataSize)
+	frame[3] = byte(CommandDataSize >> 8)
+	frame[4] = appID
+	frame[5], frame[6] = calcChecksum(frame, t)
+	frame[7] = CmdStop
+
+	return frame
+}
+
+func ParseSetActiveAppCmdResult(r []byte, t ChecksumType) error {
+	return ParseDefaultCmdResult(CMD_SET_ACTIVE_APP, r, t)
+}
+
+func CreateGetMetadataCmd(appID byte, t ChecksumType) []byte {
+	const CommandDataSize = 1
+	const CommandSize = BaseCmdSize + CommandDataSize
+
+	frame := make([]byte, CommandSize)
+	frame[0] = CmdStart
+	frame[1] = CmdGetMetadata
+	frame[2] = byte(CommandDataSize)
+	frame[3] = byte(CommandDataSize >> 8)
+	frame[4] = appID
+	frame[5], frame[6] = calcChecksum(frame, t)
+	frame[7] = CmdStop
+
+	return frame
+}
+
+func ParseGetMetadataCmdResult(r []byte, t ChecksumType) (Metadata, error) {
+	data, err := checkResponse(CmdGetMetadata, r, MetadataSize, t)
 	if err != nil {
-		if err.Error() == "read operation timed out" || err.Error() == "timeout" {
-			return errors.New("communication timeout: device is unresponsive or not in bootloader mode"), 0, 0
+		return Metadata{}, err
+	}
+
+	return ParseMetadata(data)
+}
+
+// CreateSyncCmd builds the SYNC command, which makes the bootloader discard
+// any partially received data so that the host and the target are back in
+// step. The bootloader does not send a response to this command.
+func CreateSyncCmd(t ChecksumType) []byte {
+	frame := make([]byte, BaseCmdSize)
+
+	frame[0] = CmdStart
+	frame[1] = CMD_SYNC
+	frame[2] = 0x00
+	frame[3] = 0x00
+	frame[4], frame[5] = calcChecksum(frame, t)
+	frame[6] = CmdStop
+
+	return frame
+}
+
+// Sync sends the SYNC command and gives the bootloader time to reset its
+// buffers, returning early with the context error if ctx is done. Data already
+// buffered by the bootloader for a row is discarded, so any SendData chunks of
+// the current row have to be sent again.
+func Sync(ctx context.Context, dev io.Writer, t ChecksumType) error {
+	if _, err := writeContext(ctx, dev, CreateSyncCmd(t)); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	return nil
+}
+
+// IsRecoverable reports whether err is a transient communication error after
+// which the host can resynchronise with the bootloader and retry: a malformed
+// response, a response with a bad packet checksum, a read timeout, or a
+// status showing the bootloader received a corrupted frame.
+func IsRecoverable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrInvalidFrame) || errors.Is(err, ErrChecksum) || IsTimeout(err) {
+		return true
+	}
+	var blErr *BootloaderError
+	if errors.As(err, &blErr) {
+		switch blErr.Status {
+		case StatusErrChecksum, StatusErrData, StatusErrLength:
+			return true
 		}
-		return err, 0, 0
 	}
+	return false
+}
 
-	val, err := ParseCreateGetFlashSizeCmdResult(readBuf)
-	if err != nil {
-		return err, 0, 0
+// transact writes a command frame and reads one complete response frame.
+func transact(dev io.ReadWriter, frames *FrameReader, frame []byte) ([]byte, error) {
+	frames.Reset()
+
+	if _, err := dev.Write(frame); err != nil {
+		return nil, err
 	}
 
-	return nil, val["startRow"], val["endRow"]
+	return frames.ReadFrame()
 }
 
-func CleanFlash(dev io.ReadWriter, arrayID byte) error {
-	frame := CreateGetFlashSizeCmd()
+func GetFlashSize(dev io.ReadWriter, t ChecksumType) (error, uint16, uint16) {
+	resp, err := transact(dev, NewFrameReader(dev), CreateGetFlashSizeCmd(t))
+	if err != nil {
+		return err, 0, 0
+	}
 
-	_, err := dev.Write(frame)
+	val, err := ParseCreateGetFlashSizeCmdResult(resp, t)
 	if err != nil {
-		return err
+		return err, 0, 0
 	}
 
-	time.Sleep(time.Millisecond * 20)
+	return nil, val["startRow"], val["endRow"]
+}
 
-	readBuf := make([]byte, 64)
-	_, err = dev.Read(readBuf)
+func CleanFlash(dev io.ReadWriter, arrayID byte, t ChecksumType) error {
+	frames := NewFrameReader(dev)
+
+	resp, err := transact(dev, frames, CreateGetFlashSizeCmd(t))
 	if err != nil {
-		if err.Error() == "read operation timed out" || err.Error() == "timeout" {
-			return errors.New("communication timeout: device is unresponsive or not in bootloader mode")
-		}
 		return err
 	}
 
-	val, err := ParseCreateGetFlashSizeCmdResult(readBuf)
+	val, err := ParseCreateGetFlashSizeCmdResult(resp, t)
 	if err != nil {
 		return err
 	}
 
 	for i := val["startRow"]; i <= val["endRow"]; i++ {
-		frame = CreateEraseRowCmd(arrayID, i)
-		_, err = dev.Write(frame)
-		if err != nil {
-			return err
-		}
-
-		time.Sleep(time.Millisecond * 20)
-
-		_, err = dev.Read(readBuf)
+		resp, err = transact(dev, frames, CreateEraseRowCmd(arrayID, i, t))
 		if err != nil {
-			if err.Error() == "read operation timed out" || err.Error() == "timeout" {
-				return errors.New("communication timeout: device is unresponsive or not in bootloader mode")
-			}
 			return err
 		}
 
-		if !ParseEraseRowCmdResult(readBuf) {
-			return errors.New(fmt.Sprintf("Error erasing row number: %d ", i))
+		if err = ParseEraseRowCmdResult(resp, t); err != nil {
+			return fmt.Errorf("error erasing row number %d: %w", i, err)
 		}
 	}
 	return nil
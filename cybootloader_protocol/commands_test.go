@@ -0,0 +1,60 @@
+package cybootloader_protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestEnterBootloaderFrame(t *testing.T) {
+	key := []byte{0x0A, 0x1B, 0x2C, 0x3D, 0x4E, 0x5F}
+
+	tests := []struct {
+		name string
+		key  []byte
+		t    ChecksumType
+		want []byte
+	}{
+		{"sum", nil, ChecksumSum, []byte{0x01, 0x38, 0x00, 0x00, 0xC7, 0xFF, 0x17}},
+		{"crc16", nil, ChecksumCRC16, []byte{0x01, 0x38, 0x00, 0x00, 0xA0, 0x09, 0x17}},
+		{"sum with key", key, ChecksumSum, []byte{0x01, 0x38, 0x06, 0x00, 0x0A, 0x1B, 0x2C, 0x3D, 0x4E, 0x5F, 0x86, 0xFE, 0x17}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := CreateEnterBootloaderCmd(tt.key, tt.t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(frame, tt.want) {
+				t.Errorf("frame = % X, want % X", frame, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnterBootloaderKeySize(t *testing.T) {
+	if _, err := CreateEnterBootloaderCmd([]byte{0x01, 0x02}, ChecksumSum); err == nil {
+		t.Error("CreateEnterBootloaderCmd accepted a 2 byte key")
+	}
+}
+
+func TestSync(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Sync(context.Background(), &buf, ChecksumSum); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if want := CreateSyncCmd(ChecksumSum); !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Sync wrote % X, want % X", buf.Bytes(), want)
+	}
+
+	buf.Reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Sync(ctx, &buf, ChecksumSum); !errors.Is(err, context.Canceled) {
+		t.Errorf("Sync with a cancelled context = %v, want context.Canceled", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Sync with a cancelled context wrote % X", buf.Bytes())
+	}
+}
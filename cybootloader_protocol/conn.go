@@ -0,0 +1,114 @@
+package cybootloader_protocol
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Conn exchanges command frames with a bootloader over a transport. It holds
+// the session state shared by Host and the ModusToolbox DFU host: the frame
+// reader and its timeout, the packet checksum and the packet size. It is not
+// safe for concurrent use.
+type Conn struct {
+	dev          io.ReadWriter
+	frames       *FrameReader
+	checksumType ChecksumType
+	packetSize   int
+	rowHeader    int
+}
+
+// NewConn creates a Conn talking over dev, using the basic summation checksum
+// and DefaultPacketSize. rowHeader is the size of the fields ahead of the row
+// data in the command programming a row, which every packet must leave room
+// for.
+func NewConn(dev io.ReadWriter, rowHeader int) *Conn {
+	return &Conn{
+		dev:          dev,
+		frames:       NewFrameReader(dev),
+		checksumType: ChecksumSum,
+		packetSize:   DefaultPacketSize,
+		rowHeader:    rowHeader,
+	}
+}
+
+// SetChecksumType selects the packet checksum used for commands and
+// responses. It must match the checksum type of the firmware file.
+func (c *Conn) SetChecksumType(t ChecksumType) {
+	c.checksumType = t
+}
+
+// ChecksumType returns the packet checksum used by the session.
+func (c *Conn) ChecksumType() ChecksumType {
+	return c.checksumType
+}
+
+// SetPacketSize sets the maximum size of a command frame. Rows larger than a
+// packet are sent in several Send Data commands. A size leaving no room for
+// row data selects DefaultPacketSize.
+func (c *Conn) SetPacketSize(size int) {
+	if size <= BaseCmdSize+c.rowHeader {
+		size = DefaultPacketSize
+	}
+	c.packetSize = size
+}
+
+// SetTimeout sets the time allowed for the device to answer a command.
+func (c *Conn) SetTimeout(d time.Duration) {
+	c.frames.SetTimeout(d)
+}
+
+// SplitRow splits row data into the chunks sent ahead with Send Data and the
+// rest, carried by the command programming the row. Chunks are sent until the
+// rest fits a packet with the row header, which may leave no data for the
+// last command.
+func (c *Conn) SplitRow(data []byte) ([][]byte, []byte) {
+	chunkSize := c.packetSize - BaseCmdSize
+
+	var chunks [][]byte
+	for len(data)+BaseCmdSize+c.rowHeader > c.packetSize {
+		n := min(chunkSize, len(data))
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks, data
+}
+
+// Send writes a command frame the device does not answer.
+func (c *Conn) Send(ctx context.Context, frame []byte) error {
+	c.frames.Reset()
+	_, err := writeContext(ctx, c.dev, frame)
+	return err
+}
+
+// Transact sends a command frame and returns the payload of its response,
+// which must carry dataSize bytes, or any number with AnyDataSize.
+func (c *Conn) Transact(ctx context.Context, frame []byte, dataSize int) ([]byte, error) {
+	if err := c.Send(ctx, frame); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.frames.ReadFrameContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return checkResponse(frame[1], resp, dataSize, c.checksumType)
+}
+
+// Resync sends a Sync command frame and gives the device time to reset its
+// buffers, discarding any row data it holds and any late response.
+func (c *Conn) Resync(ctx context.Context, frame []byte) error {
+	if err := c.Send(ctx, frame); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Millisecond * 20):
+	}
+	c.frames.Reset()
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package cybootloader_protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSplitRow(t *testing.T) {
+	headers := []struct {
+		name string
+		size int
+	}{
+		{"legacy", 3},
+		{"dfu", 8}, // dfu_protocol.RowHeaderSize
+	}
+	for _, h := range headers {
+		for _, packetSize := range []int{DefaultPacketSize, 300} {
+			for _, rowSize := range []int{1, 54, 55, 56, 57, 112, 113, 128, 256, 288, 512} {
+				t.Run(fmt.Sprintf("%s/packet %d/row %d", h.name, packetSize, rowSize), func(t *testing.T) {
+					c := NewConn(nil, h.size)
+					c.SetPacketSize(packetSize)
+
+					data := make([]byte, rowSize)
+					for i := range data {
+						data[i] = byte(i)
+					}
+
+					chunks, rest := c.SplitRow(data)
+					var joined []byte
+					for i, chunk := range chunks {
+						if len(chunk) == 0 || BaseCmdSize+len(chunk) > packetSize {
+							t.Errorf("chunk %d holds %d bytes, packets hold %d", i, len(chunk), packetSize)
+						}
+						joined = append(joined, chunk...)
+					}
+					if BaseCmdSize+h.size+len(rest) > packetSize {
+						t.Errorf("last command carries %d bytes, packets hold %d", BaseCmdSize+h.size+len(rest), packetSize)
+					}
+					if joined = append(joined, rest...); !bytes.Equal(joined, data) {
+						t.Errorf("chunks do not rebuild the row")
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestSetPacketSize(t *testing.T) {
+	c := NewConn(nil, 8)
+	for _, size := range []int{0, BaseCmdSize, BaseCmdSize + 8} {
+		c.SetPacketSize(size)
+		if c.packetSize != DefaultPacketSize {
+			t.Errorf("SetPacketSize(%d) selected %d, want the default %d", size, c.packetSize, DefaultPacketSize)
+		}
+	}
+	c.SetPacketSize(BaseCmdSize + 9)
+	if c.packetSize != BaseCmdSize+9 {
+		t.Errorf("SetPacketSize(%d) selected %d", BaseCmdSize+9, c.packetSize)
+	}
+}
+
+// deadlineDevice fails every transfer with an I/O deadline error, as the USB
+// and HID transports do when their timeout expires.
+type deadlineDevice struct{}
+
+func (deadlineDevice) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("read timeout after 1s: %w", os.ErrDeadlineExceeded)
+}
+
+func (deadlineDevice) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("write timeout after 1s: %w", os.ErrDeadlineExceeded)
+}
+
+func TestTransportTimeout(t *testing.T) {
+	ctx := context.Background()
+	frame := CreateGetFlashSizeArrayCmd(0, ChecksumSum)
+
+	c := NewConn(deadlineDevice{}, 3)
+	if err := c.Send(ctx, frame); !errors.Is(err, ErrTimeout) || !IsRecoverable(err) {
+		t.Errorf("Send = %v, want a recoverable ErrTimeout", err)
+	}
+
+	if _, err := NewFrameReader(deadlineDevice{}).ReadFrameContext(ctx); !errors.Is(err, ErrTimeout) || !IsRecoverable(err) {
+		t.Errorf("ReadFrameContext = %v, want a recoverable ErrTimeout", err)
+	}
+}
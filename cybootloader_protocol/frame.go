@@ -0,0 +1,180 @@
+package cybootloader_protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	/* Largest data field accepted in a response; anything larger is treated as garbage. */
+	MaxFrameDataSize = 512
+
+	/* Default time allowed to receive one complete response. */
+	DefaultFrameTimeout = 5 * time.Second
+
+	readChunkSize = 64
+)
+
+// ContextReader is implemented by transports whose reads can be bounded by a
+// context.
+type ContextReader interface {
+	ReadContext(ctx context.Context, b []byte) (int, error)
+}
+
+// ContextWriter is implemented by transports whose writes can be bounded by a
+// context.
+type ContextWriter interface {
+	WriteContext(ctx context.Context, b []byte) (int, error)
+}
+
+// writeContext writes b to w, through WriteContext when w supports it. A
+// write timeout reported by the transport is returned wrapping ErrTimeout.
+func writeContext(ctx context.Context, w io.Writer, b []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var n int
+	var err error
+	if cw, ok := w.(ContextWriter); ok {
+		n, err = cw.WriteContext(ctx, b)
+	} else {
+		n, err = w.Write(b)
+	}
+	if err != nil && ctx.Err() == nil && IsTimeout(err) && !errors.Is(err, ErrTimeout) {
+		err = fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return n, err
+}
+
+// FrameReader reads complete response packets from a transport. It works with
+// packet oriented transports (USB, HID), which deliver a whole frame padded to
+// the report size, as well as byte streams (UART), which may deliver a frame
+// in several partial reads.
+type FrameReader struct {
+	r       io.Reader
+	timeout time.Duration
+	buf     []byte
+}
+
+// NewFrameReader creates a FrameReader reading from r with DefaultFrameTimeout.
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: r, timeout: DefaultFrameTimeout}
+}
+
+// SetTimeout sets the time allowed to receive one complete frame.
+func (fr *FrameReader) SetTimeout(d time.Duration) {
+	if d <= 0 {
+		d = DefaultFrameTimeout
+	}
+	fr.timeout = d
+}
+
+// Reset discards any buffered bytes, such as report padding or the rest of a
+// late response. It should be called before sending a new command.
+func (fr *FrameReader) Reset() {
+	fr.buf = fr.buf[:0]
+}
+
+// ReadFrame returns the next complete response packet. Bytes before the start
+// byte and candidate frames whose length or end byte do not fit are
+// discarded. If no complete frame arrives in time an error wrapping
+// ErrTimeout is returned.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	return fr.ReadFrameContext(context.Background())
+}
+
+// ReadFrameContext is ReadFrame bounded by ctx as well as by the frame
+// timeout. If ctx is done first, its error is returned.
+func (fr *FrameReader) ReadFrameContext(ctx context.Context) ([]byte, error) {
+	readCtx, cancel := context.WithTimeout(ctx, fr.timeout)
+	defer cancel()
+
+	chunk := make([]byte, readChunkSize)
+
+	for {
+		if frame, ok := fr.extract(); ok {
+			return frame, nil
+		}
+
+		if readCtx.Err() != nil {
+			return nil, fr.doneError(ctx)
+		}
+
+		var n int
+		var err error
+		if cr, ok := fr.r.(ContextReader); ok {
+			n, err = cr.ReadContext(readCtx, chunk)
+		} else {
+			n, err = fr.r.Read(chunk)
+		}
+		fr.buf = append(fr.buf, chunk[:n]...)
+		if err != nil {
+			if readCtx.Err() != nil {
+				return nil, fr.doneError(ctx)
+			}
+			if errors.Is(err, ErrTimeout) {
+				return nil, err
+			}
+			if IsTimeout(err) {
+				return nil, fmt.Errorf("%w: %v", ErrTimeout, err)
+			}
+			// Serial ports report an expired read timeout as EOF
+			if !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+		}
+		if n == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// doneError reports why ctx ended: the frame timeout expired, or the caller's
+// context was cancelled or reached its deadline.
+func (fr *FrameReader) doneError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: no complete frame after %v (%d bytes pending)", ErrTimeout, fr.timeout, len(fr.buf))
+}
+
+// extract removes the first complete frame from the buffer.
+func (fr *FrameReader) extract() ([]byte, bool) {
+	for {
+		// Skip everything up to the next start byte
+		start := 0
+		for start < len(fr.buf) && fr.buf[start] != CmdStart {
+			start++
+		}
+		fr.buf = fr.buf[start:]
+
+		if len(fr.buf) < 4 {
+			return nil, false
+		}
+
+		size := int(fr.buf[2]) | int(fr.buf[3])<<8
+		if size > MaxFrameDataSize {
+			fr.buf = fr.buf[1:]
+			continue
+		}
+
+		frameSize := BaseCmdSize + size
+		if len(fr.buf) < frameSize {
+			return nil, false
+		}
+
+		if fr.buf[frameSize-1] != CmdStop {
+			fr.buf = fr.buf[1:]
+			continue
+		}
+
+		frame := make([]byte, frameSize)
+		copy(frame, fr.buf[:frameSize])
+		fr.buf = fr.buf[frameSize:]
+		return frame, true
+	}
+}
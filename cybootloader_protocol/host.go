@@ -0,0 +1,166 @@
+package cybootloader_protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+/* Default maximum size of a command frame, the size of a USB/HID report. */
+const DefaultPacketSize = 64
+
+// DeviceInfo is the information returned by the bootloader when entering
+// bootloader mode.
+type DeviceInfo struct {
+	SiliconID         uint32
+	SiliconRev        uint8
+	BootloaderVersion uint32
+}
+
+// FlashSize is the range of rows of a flash array that can be programmed.
+type FlashSize struct {
+	StartRow uint16
+	EndRow   uint16
+}
+
+// Host drives a bootloader session over a transport. It owns the transport
+// for the duration of the session; it is not safe for concurrent use.
+//
+// Every command takes a context bounding the transaction; transports that
+// implement ContextReader and ContextWriter are interrupted as soon as the
+// context is done.
+type Host struct {
+	*Conn
+}
+
+// NewHost creates a Host talking to the bootloader over dev, using the basic
+// summation checksum and DefaultPacketSize.
+func NewHost(dev io.ReadWriter) *Host {
+	// Program Row carries the array ID and row number ahead of the data
+	return &Host{Conn: NewConn(dev, 3)}
+}
+
+// EnterBootloader starts a bootloader session. key is the 6 byte bootloader
+// key, or nil if the bootloader does not use one.
+func (h *Host) EnterBootloader(ctx context.Context, key []byte) (DeviceInfo, error) {
+	frame, err := CreateEnterBootloaderCmd(key, h.checksumType)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+
+	data, err := h.Transact(ctx, frame, 8)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+
+	return DeviceInfo{
+		SiliconID:         uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24,
+		SiliconRev:        data[4],
+		BootloaderVersion: uint32(data[5]) | uint32(data[6])<<8 | uint32(data[7])<<16,
+	}, nil
+}
+
+// GetFlashSize returns the range of rows available in a flash array.
+func (h *Host) GetFlashSize(ctx context.Context, arrayID byte) (FlashSize, error) {
+	data, err := h.Transact(ctx, CreateGetFlashSizeArrayCmd(arrayID, h.checksumType), 4)
+	if err != nil {
+		return FlashSize{}, err
+	}
+
+	return FlashSize{
+		StartRow: uint16(data[1])<<8 | uint16(data[0]),
+		EndRow:   uint16(data[3])<<8 | uint16(data[2]),
+	}, nil
+}
+
+// SendData sends a block of row data to be buffered by the bootloader.
+func (h *Host) SendData(ctx context.Context, b []byte) error {
+	_, err := h.Transact(ctx, CreateSendDataCmd(b, h.checksumType), 0)
+	return err
+}
+
+// ProgramRow writes a row of flash. Data that does not fit in a single packet
+// is sent ahead with Send Data commands. If it fails, the bootloader may still
+// hold part of the row; call Sync before trying again.
+func (h *Host) ProgramRow(ctx context.Context, arrayID byte, row uint16, data []byte) error {
+	chunks, rest := h.SplitRow(data)
+	for _, chunk := range chunks {
+		if err := h.SendData(ctx, chunk); err != nil {
+			return fmt.Errorf("sending data for row %d: %w", row, err)
+		}
+	}
+
+	if _, err := h.Transact(ctx, CreateProgramRowCmd(rest, arrayID, row, h.checksumType), 0); err != nil {
+		return fmt.Errorf("programming row %d: %w", row, err)
+	}
+
+	return nil
+}
+
+// EraseRow erases a row of flash.
+func (h *Host) EraseRow(ctx context.Context, arrayID byte, row uint16) error {
+	_, err := h.Transact(ctx, CreateEraseRowCmd(arrayID, row, h.checksumType), 0)
+	return err
+}
+
+// GetRowChecksum returns the checksum of a row of flash as computed by the
+// bootloader.
+func (h *Host) GetRowChecksum(ctx context.Context, arrayID byte, row uint16) (byte, error) {
+	data, err := h.Transact(ctx, CreateGetRowChecksumCmd(arrayID, row, h.checksumType), 1)
+	if err != nil {
+		return 0xff, err
+	}
+
+	return data[0], nil
+}
+
+// VerifyAppChecksum asks the bootloader to verify the checksum of the
+// application. It returns a non zero value if the application is valid.
+func (h *Host) VerifyAppChecksum(ctx context.Context) (byte, error) {
+	data, err := h.Transact(ctx, CreateVerifyAppChecksumCmd(h.checksumType), 1)
+	if err != nil {
+		return 0xff, err
+	}
+
+	return data[0], nil
+}
+
+// GetAppStatus returns the state of an application slot of a multi app
+// bootloader.
+func (h *Host) GetAppStatus(ctx context.Context, appID byte) (AppStatus, error) {
+	data, err := h.Transact(ctx, CreateGetAppStatusCmd(appID, h.checksumType), 2)
+	if err != nil {
+		return AppStatus{}, err
+	}
+
+	return AppStatus{Valid: data[0] != 0, Active: data[1] != 0}, nil
+}
+
+// SetActiveApp selects the application started by a multi app bootloader.
+func (h *Host) SetActiveApp(ctx context.Context, appID byte) error {
+	_, err := h.Transact(ctx, CreateSetActiveAppCmd(appID, h.checksumType), 0)
+	return err
+}
+
+// GetMetadata reads the metadata of an application slot, 0 on a single app
+// bootloader.
+func (h *Host) GetMetadata(ctx context.Context, appID byte) (Metadata, error) {
+	data, err := h.Transact(ctx, CreateGetMetadataCmd(appID, h.checksumType), MetadataSize)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return ParseMetadata(data)
+}
+
+// Sync resynchronises the host and the bootloader after a communication
+// error, discarding any row data buffered by the bootloader.
+func (h *Host) Sync(ctx context.Context) error {
+	return h.Resync(ctx, CreateSyncCmd(h.checksumType))
+}
+
+// Exit leaves the bootloader and starts the application. The bootloader does
+// not answer this command.
+func (h *Host) Exit(ctx context.Context) error {
+	return h.Send(ctx, CreateExitBootloaderCmd(h.checksumType))
+}
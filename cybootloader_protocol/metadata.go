@@ -0,0 +1,60 @@
+package cybootloader_protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	/* Size of the metadata of a bootloadable application in flash, at the end of its metadata row. */
+	MetadataRowSize = 64
+	/* Number of metadata bytes returned by Get Metadata. */
+	MetadataSize = 56
+)
+
+// Version is the 16 bit application version of the metadata, major version
+// in the high byte and minor version in the low byte. The field has no room
+// for a patch level, so versions print as "v1.5".
+type Version uint16
+
+func (v Version) String() string {
+	return fmt.Sprintf("v%d.%d", v>>8, v&0xFF)
+}
+
+// Metadata is the bootloadable metadata the bootloader keeps at the end of
+// flash for each application.
+type Metadata struct {
+	Checksum          byte    // Application checksum
+	StartAddress      uint32  // Entry point of the application
+	BootloaderLastRow uint32  // Last flash row used by the bootloader
+	Length            uint32  // Application length in bytes
+	Active            bool    // The application is the one started by the bootloader
+	Verified          bool    // The application passed its checksum verification
+	BootloaderVersion Version // Version of the bootloader that built the application
+	AppID             uint16
+	AppVersion        Version
+	CustomID          uint32
+}
+
+// ParseMetadata decodes the metadata layout of PSoC 4 and PSoC 5LP
+// bootloaders, whose fields are little endian. b holds at least the
+// MetadataSize bytes returned by Get Metadata.
+func ParseMetadata(b []byte) (Metadata, error) {
+	if len(b) < MetadataSize {
+		return Metadata{}, fmt.Errorf("metadata must hold %d bytes, got %d", MetadataSize, len(b))
+	}
+
+	le := binary.LittleEndian
+	return Metadata{
+		Checksum:          b[0x00],
+		StartAddress:      le.Uint32(b[0x01:]),
+		BootloaderLastRow: le.Uint32(b[0x05:]),
+		Length:            le.Uint32(b[0x0B:]),
+		Active:            b[0x0F] != 0,
+		Verified:          b[0x10] != 0,
+		BootloaderVersion: Version(le.Uint16(b[0x11:])),
+		AppID:             le.Uint16(b[0x13:]),
+		AppVersion:        Version(le.Uint16(b[0x15:])),
+		CustomID:          le.Uint32(b[0x17:]),
+	}, nil
+}
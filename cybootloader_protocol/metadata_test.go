@@ -0,0 +1,70 @@
+package cybootloader_protocol
+
+import "testing"
+
+func TestParseMetadata(t *testing.T) {
+	b := make([]byte, MetadataSize)
+	b[0x00] = 0xA5
+	copy(b[0x01:], []byte{0x00, 0x10, 0x00, 0x00}) // start address 0x1000
+	copy(b[0x05:], []byte{0x1F, 0x00, 0x00, 0x00}) // bootloader last row 31
+	copy(b[0x0B:], []byte{0x80, 0x07, 0x00, 0x00}) // length 1920
+	b[0x0F] = 0x01
+	b[0x10] = 0x00
+	copy(b[0x11:], []byte{0x0A, 0x01}) // bootloader v1.10
+	copy(b[0x13:], []byte{0x34, 0x12})
+	copy(b[0x15:], []byte{0x05, 0x02}) // app v2.5
+	copy(b[0x17:], []byte{0xEF, 0xBE, 0xAD, 0xDE})
+
+	want := Metadata{
+		Checksum:          0xA5,
+		StartAddress:      0x1000,
+		BootloaderLastRow: 31,
+		Length:            1920,
+		Active:            true,
+		Verified:          false,
+		BootloaderVersion: 0x010A,
+		AppID:             0x1234,
+		AppVersion:        0x0205,
+		CustomID:          0xDEADBEEF,
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"get metadata response", b},
+		{"metadata row", append(append([]byte(nil), b...), make([]byte, MetadataRowSize-MetadataSize)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, err := ParseMetadata(tt.b)
+			if err != nil {
+				t.Fatalf("ParseMetadata: %v", err)
+			}
+			if md != want {
+				t.Errorf("ParseMetadata =\n%+v\nwant\n%+v", md, want)
+			}
+		})
+	}
+
+	if _, err := ParseMetadata(b[:MetadataSize-1]); err == nil {
+		t.Errorf("ParseMetadata accepted %d bytes", MetadataSize-1)
+	}
+}
+
+func TestVersionString(t *testing.T) {
+	tests := []struct {
+		v    Version
+		want string
+	}{
+		{0x0000, "v0.0"},
+		{0x0105, "v1.5"},
+		{0x010A, "v1.10"},
+		{0xFFFF, "v255.255"},
+	}
+	for _, tt := range tests {
+		if got := tt.v.String(); got != tt.want {
+			t.Errorf("Version(0x%04X) = %q, want %q", uint16(tt.v), got, tt.want)
+		}
+	}
+}
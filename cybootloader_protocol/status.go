@@ -0,0 +1,190 @@
+package cybootloader_protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Status is the status byte returned by the bootloader in every response frame.
+type Status byte
+
+// Status codes reported by the Cypress bootloader (see cybtldr_utils.h).
+const (
+	StatusSuccess     Status = 0x00 /* The command was successfully received and executed. */
+	StatusErrKey      Status = 0x01 /* The provided key does not match the expected value. */
+	StatusErrVerify   Status = 0x02 /* The verification of flash failed. */
+	StatusErrLength   Status = 0x03 /* The amount of data available is outside the expected range. */
+	StatusErrData     Status = 0x04 /* The data is not of the proper form. */
+	StatusErrCmd      Status = 0x05 /* The command is not recognized. */
+	StatusErrDevice   Status = 0x06 /* The expected device does not match the detected device. */
+	StatusErrVersion  Status = 0x07 /* The bootloader version detected is not supported. */
+	StatusErrChecksum Status = 0x08 /* The checksum does not match the expected value. */
+	StatusErrArray    Status = 0x09 /* The flash array is not valid. */
+	StatusErrRow      Status = 0x0A /* The flash row is not valid. */
+	StatusErrProtect  Status = 0x0B /* The flash row is protected and can not be programmed. */
+	StatusErrApp      Status = 0x0C /* The application is not valid and cannot be set as active. */
+	StatusErrActive   Status = 0x0D /* The application is currently marked as active. */
+	StatusErrUnknown  Status = 0x0F /* An unknown error occurred. */
+)
+
+var statusNames = map[Status]string{
+	StatusSuccess:     "CYRET_SUCCESS",
+	StatusErrKey:      "CYRET_ERR_KEY",
+	StatusErrVerify:   "CYRET_ERR_VERIFY",
+	StatusErrLength:   "CYRET_ERR_LENGTH",
+	StatusErrData:     "CYRET_ERR_DATA",
+	StatusErrCmd:      "CYRET_ERR_CMD",
+	StatusErrDevice:   "CYRET_ERR_DEVICE",
+	StatusErrVersion:  "CYRET_ERR_VERSION",
+	StatusErrChecksum: "CYRET_ERR_CHECKSUM",
+	StatusErrArray:    "CYRET_ERR_ARRAY",
+	StatusErrRow:      "CYRET_ERR_ROW",
+	StatusErrProtect:  "CYRET_ERR_PROTECT",
+	StatusErrApp:      "CYRET_ERR_APP",
+	StatusErrActive:   "CYRET_ERR_ACTIVE",
+	StatusErrUnknown:  "CYRET_ERR_UNK",
+}
+
+var statusDescriptions = map[Status]string{
+	StatusSuccess:     "success",
+	StatusErrKey:      "the provided key does not match the expected value",
+	StatusErrVerify:   "the verification of flash failed",
+	StatusErrLength:   "the amount of data available is outside the expected range",
+	StatusErrData:     "the data is not of the proper form",
+	StatusErrCmd:      "the command is not recognized",
+	StatusErrDevice:   "the expected device does not match the detected device",
+	StatusErrVersion:  "the bootloader version detected is not supported",
+	StatusErrChecksum: "the checksum does not match the expected value",
+	StatusErrArray:    "the flash array is not valid",
+	StatusErrRow:      "the flash row is not valid",
+	StatusErrProtect:  "the flash row is protected and can not be programmed",
+	StatusErrApp:      "the application is not valid and cannot be set as active",
+	StatusErrActive:   "the application is currently marked as active",
+	StatusErrUnknown:  "an unknown error occurred",
+}
+
+// String returns the Cypress name of the status code, e.g. "CYRET_ERR_KEY".
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("CYRET_0x%02X", byte(s))
+}
+
+// Error makes Status usable as a sentinel, so callers can test a returned
+// error with errors.Is(err, StatusErrKey).
+func (s Status) Error() string {
+	if desc, ok := statusDescriptions[s]; ok {
+		return fmt.Sprintf("%s: %s", s.String(), desc)
+	}
+	return fmt.Sprintf("%s: unknown status code", s.String())
+}
+
+// ErrInvalidFrame is returned when a response does not have the proper form
+// (wrong start/stop byte, wrong length or too short).
+var ErrInvalidFrame = errors.New("invalid response frame")
+
+// ErrTimeout is returned when the device does not answer a command in time.
+var ErrTimeout = errors.New("communication timeout: device is unresponsive or not in bootloader mode")
+
+// IsTimeout reports whether err is a read or write timeout: ErrTimeout, a
+// context deadline, or an I/O deadline (os.ErrDeadlineExceeded), which is how
+// the transports report their timeouts.
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// ErrChecksum is matched by errors.Is for any response whose packet checksum
+// does not match its contents.
+var ErrChecksum = errors.New("response packet checksum mismatch")
+
+// ChecksumError is returned when the packet checksum of a response does not
+// match the checksum computed over the received bytes.
+type ChecksumError struct {
+	Cmd      byte   // Command identifier the response belongs to
+	Expected uint16 // Checksum computed over the received frame
+	Received uint16 // Checksum carried by the frame
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("response to command 0x%02X: packet checksum mismatch: computed 0x%04X, received 0x%04X", e.Cmd, e.Expected, e.Received)
+}
+
+// Is makes every ChecksumError match ErrChecksum.
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksum
+}
+
+// BootloaderError is returned when the bootloader answers a command with a
+// status other than CYRET_SUCCESS.
+type BootloaderError struct {
+	Cmd    byte   // Command identifier the response belongs to
+	Status Status // Status code reported by the bootloader
+	Frame  []byte // Raw response frame
+}
+
+func (e *BootloaderError) Error() string {
+	return fmt.Sprintf("bootloader reported an error for command 0x%02X: %s", e.Cmd, e.Status.Error())
+}
+
+// Unwrap exposes the status code to errors.Is.
+func (e *BootloaderError) Unwrap() error {
+	return e.Status
+}
+
+// AnyDataSize is passed to CheckResponse for commands whose response payload
+// has no fixed size.
+const AnyDataSize = -1
+
+// CheckResponse validates a response frame for cmd using the checksum
+// algorithm t and returns its payload. It serves protocols sharing the
+// bootloader framing, such as the ModusToolbox DFU protocol.
+func CheckResponse(cmd byte, r []byte, dataSize int, t ChecksumType) ([]byte, error) {
+	return checkResponse(cmd, r, dataSize, t)
+}
+
+// checkResponse validates a response frame for cmd carrying exactly dataSize
+// bytes of payload and returns the payload. The packet checksum is verified
+// with the algorithm t.
+func checkResponse(cmd byte, r []byte, dataSize int, t ChecksumType) ([]byte, error) {
+	if len(r) < BaseCmdSize {
+		return nil, fmt.Errorf("%w: expected at least %d bytes, got %d", ErrInvalidFrame, BaseCmdSize, len(r))
+	}
+
+	if r[0] != CmdStart {
+		return nil, fmt.Errorf("%w: invalid start byte: expected 0x%02X, got 0x%02X", ErrInvalidFrame, CmdStart, r[0])
+	}
+
+	// The little-endian length field locates the checksum and the end marker
+	size := int(r[2]) | int(r[3])<<8
+	frameSize := BaseCmdSize + size
+	if len(r) < frameSize {
+		return nil, fmt.Errorf("%w: data size %d needs %d bytes, got %d", ErrInvalidFrame, size, frameSize, len(r))
+	}
+
+	frame := r[:frameSize]
+
+	if frame[frameSize-1] != CmdStop {
+		return nil, fmt.Errorf("%w: invalid end byte: expected 0x%02X, got 0x%02X", ErrInvalidFrame, CmdStop, frame[frameSize-1])
+	}
+
+	expected := t.Compute(frame[:4+size])
+	received := uint16(frame[4+size]) | uint16(frame[5+size])<<8
+	if expected != received {
+		return nil, &ChecksumError{Cmd: cmd, Expected: expected, Received: received}
+	}
+
+	if Status(frame[1]) != StatusSuccess {
+		raw := make([]byte, frameSize)
+		copy(raw, frame)
+		return nil, &BootloaderError{Cmd: cmd, Status: Status(frame[1]), Frame: raw}
+	}
+
+	if dataSize != AnyDataSize && size != dataSize {
+		return nil, fmt.Errorf("%w: invalid data size: expected %d, got %d", ErrInvalidFrame, dataSize, size)
+	}
+
+	return frame[4 : 4+size], nil
+}
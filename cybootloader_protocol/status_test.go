@@ -0,0 +1,122 @@
+package cybootloader_protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+// response builds a response frame carrying status and data.
+func response(status Status, data []byte, t ChecksumType) []byte {
+	frame := []byte{CmdStart, byte(status), byte(len(data)), byte(len(data) >> 8)}
+	frame = append(frame, data...)
+	frame = append(frame, 0, 0, CmdStop)
+	UpdateFrameChecksum(frame, t)
+	return frame
+}
+
+func TestCheckResponse(t *testing.T) {
+	badChecksum := response(StatusSuccess, []byte{0x01}, ChecksumSum)
+	badChecksum[4] ^= 0xFF
+
+	badStart := response(StatusSuccess, nil, ChecksumSum)
+	badStart[0] = 0x02
+
+	badEnd := response(StatusSuccess, nil, ChecksumSum)
+	badEnd[len(badEnd)-1] = 0x18
+
+	tooLong := response(StatusSuccess, []byte{0x01, 0x02}, ChecksumSum)
+	tooLong[2] = 0x10
+
+	tests := []struct {
+		name     string
+		frame    []byte
+		dataSize int
+		t        ChecksumType
+		want     []byte
+		wantErr  error
+	}{
+		{name: "no data", frame: response(StatusSuccess, nil, ChecksumSum), dataSize: 0, want: []byte{}},
+		{name: "data", frame: response(StatusSuccess, []byte{0x11, 0x22}, ChecksumSum), dataSize: 2, want: []byte{0x11, 0x22}},
+		{name: "any data size", frame: response(StatusSuccess, []byte{0x11, 0x22, 0x33}, ChecksumSum), dataSize: AnyDataSize, want: []byte{0x11, 0x22, 0x33}},
+		{name: "report padding", frame: append(response(StatusSuccess, []byte{0x11}, ChecksumSum), 0, 0, 0), dataSize: 1, want: []byte{0x11}},
+		{name: "crc16", frame: response(StatusSuccess, []byte{0x11}, ChecksumCRC16), dataSize: 1, t: ChecksumCRC16, want: []byte{0x11}},
+		{name: "crc16 frame checked as sum", frame: response(StatusSuccess, []byte{0x11}, ChecksumCRC16), dataSize: 1, wantErr: ErrChecksum},
+		{name: "short", frame: []byte{CmdStart, 0x00, 0x00, 0x00, CmdStop}, wantErr: ErrInvalidFrame},
+		{name: "bad start", frame: badStart, wantErr: ErrInvalidFrame},
+		{name: "bad end", frame: badEnd, wantErr: ErrInvalidFrame},
+		{name: "length beyond frame", frame: tooLong, dataSize: AnyDataSize, wantErr: ErrInvalidFrame},
+		{name: "bad checksum", frame: badChecksum, dataSize: 1, wantErr: ErrChecksum},
+		{name: "bootloader status", frame: response(StatusErrKey, nil, ChecksumSum), wantErr: StatusErrKey},
+		{name: "wrong data size", frame: response(StatusSuccess, []byte{0x11}, ChecksumSum), dataSize: 2, wantErr: ErrInvalidFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkResponse(CmdEnterBootloader, tt.frame, tt.dataSize, tt.t)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("checkResponse error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkResponse: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("checkResponse = % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckResponseErrorDetails(t *testing.T) {
+	frame := response(StatusErrRow, nil, ChecksumSum)
+	_, err := checkResponse(CmdProgramRow, frame, 0, ChecksumSum)
+
+	var blErr *BootloaderError
+	if !errors.As(err, &blErr) {
+		t.Fatalf("error = %v, want a BootloaderError", err)
+	}
+	if blErr.Cmd != CmdProgramRow || blErr.Status != StatusErrRow || !bytes.Equal(blErr.Frame, frame) {
+		t.Errorf("BootloaderError = %+v", blErr)
+	}
+
+	frame = response(StatusSuccess, nil, ChecksumSum)
+	frame[4]++
+	_, err = checkResponse(CmdProgramRow, frame, 0, ChecksumSum)
+
+	var ckErr *ChecksumError
+	if !errors.As(err, &ckErr) {
+		t.Fatalf("error = %v, want a ChecksumError", err)
+	}
+	if ckErr.Cmd != CmdProgramRow || ckErr.Expected != 0xFFFF || ckErr.Received != 0xFF00 {
+		t.Errorf("ChecksumError = %+v", ckErr)
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", ErrTimeout, true},
+		{"wrapped timeout", fmt.Errorf("read: %w", ErrTimeout), true},
+		{"context deadline", context.DeadlineExceeded, true},
+		{"I/O deadline", fmt.Errorf("read: %w", os.ErrDeadlineExceeded), true},
+		{"EOF", io.EOF, false},
+		{"timeout text only", errors.New("communication timeout"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTimeout(tt.err); got != tt.want {
+				t.Errorf("IsTimeout(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
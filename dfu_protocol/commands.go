@@ -0,0 +1,200 @@
+// Package dfu_protocol implements the host side of the ModusToolbox DFU
+// protocol used by PSoC 6 devices to program .cyacd2 images. It shares the
+// packet framing, checksums and status codes of cybootloader_protocol; rows
+// are addressed by their 32-bit flash address instead of array and row
+// numbers.
+package dfu_protocol
+
+import (
+	"hash/crc32"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+const (
+	/* Command identifier for verifying the application. */
+	CmdVerifyApp = 0x31
+	/* Command identifier for making sure the host and the DFU middleware are in sync. */
+	CmdSync = 0x35
+	/* Command identifier for sending a block of data to be buffered by the device. */
+	CmdSendData = 0x37
+	/* Command identifier for starting a DFU session. All other commands are ignored until this is sent. */
+	CmdEnterDFU = 0x38
+	/* Command identifier for ending the DFU session and starting the application. */
+	CmdExitDFU = 0x3B
+	/* Command identifier for reading a range of the application metadata. */
+	CmdGetMetadata = 0x3C
+	/* Command identifier for erasing the flash row at an address. */
+	CmdEraseData = 0x44
+	/* Command identifier for sending a block of data without waiting for a response. */
+	CmdSendDataWithoutResponse = 0x47
+	/* Command identifier for programming the flash row at an address. */
+	CmdProgramData = 0x49
+	/* Command identifier for comparing the flash row at an address with the given data. */
+	CmdVerifyData = 0x4A
+	/* Command identifier for setting the start address and length of an application. */
+	CmdSetAppMetadata = 0x4C
+	/* Command identifier for setting the initialization vector of encrypted images. */
+	CmdSetEIV = 0x4D
+
+	/* Size of the address and CRC-32C heading Program Data and Verify Data. */
+	RowHeaderSize = 8
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// RowChecksum returns the CRC-32C of a whole row, as carried by Program Data
+// and Verify Data.
+func RowChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32c)
+}
+
+// newFrame builds a command frame for cmd carrying data, with the checksum
+// algorithm t.
+func newFrame(cmd byte, data []byte, t cybootloader_protocol.ChecksumType) []byte {
+	frame := make([]byte, 0, cybootloader_protocol.BaseCmdSize+len(data))
+	frame = append(frame, cybootloader_protocol.CmdStart, cmd, byte(len(data)), byte(len(data)>>8))
+	frame = append(frame, data...)
+	frame = append(frame, 0, 0, cybootloader_protocol.CmdStop)
+	cybootloader_protocol.UpdateFrameChecksum(frame, t)
+
+	return frame
+}
+
+func putUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// CreateEnterDFUCmd starts a session with a device running the given product.
+func CreateEnterDFUCmd(productID uint32, t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdEnterDFU, putUint32(nil, productID), t)
+}
+
+// ParseEnterDFUCmdResult returns the silicon ID, silicon revision and DFU SDK
+// version reported by the device.
+func ParseEnterDFUCmdResult(r []byte, t cybootloader_protocol.ChecksumType) (cybootloader_protocol.DeviceInfo, error) {
+	data, err := checkResponse(CmdEnterDFU, r, 8, t)
+	if err != nil {
+		return cybootloader_protocol.DeviceInfo{}, err
+	}
+
+	return cybootloader_protocol.DeviceInfo{
+		SiliconID:         uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24,
+		SiliconRev:        data[4],
+		BootloaderVersion: uint32(data[5]) | uint32(data[6])<<8 | uint32(data[7])<<16,
+	}, nil
+}
+
+func CreateSendDataCmd(b []byte, t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdSendData, b, t)
+}
+
+func ParseSendDataCmdResult(r []byte, t cybootloader_protocol.ChecksumType) error {
+	return ParseDefaultCmdResult(CmdSendData, r, t)
+}
+
+// CreateSendDataWithoutResponseCmd sends data the device buffers silently,
+// which saves a round trip per packet on reliable links.
+func CreateSendDataWithoutResponseCmd(b []byte, t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdSendDataWithoutResponse, b, t)
+}
+
+// rowData lays out the address, CRC-32C of the whole row and the last part of
+// the row data sent with the command.
+func rowData(address uint32, crc uint32, b []byte) []byte {
+	data := make([]byte, 0, RowHeaderSize+len(b))
+	data = putUint32(data, address)
+	data = putUint32(data, crc)
+	return append(data, b...)
+}
+
+// CreateProgramDataCmd programs the row at address. crc is the CRC-32C of the
+// whole row, including the data sent ahead with Send Data.
+func CreateProgramDataCmd(address uint32, crc uint32, b []byte, t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdProgramData, rowData(address, crc, b), t)
+}
+
+func ParseProgramDataCmdResult(r []byte, t cybootloader_protocol.ChecksumType) error {
+	return ParseDefaultCmdResult(CmdProgramData, r, t)
+}
+
+// CreateVerifyDataCmd compares the row at address with the data. crc is the
+// CRC-32C of the whole row, including the data sent ahead with Send Data.
+func CreateVerifyDataCmd(address uint32, crc uint32, b []byte, t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdVerifyData, rowData(address, crc, b), t)
+}
+
+func ParseVerifyDataCmdResult(r []byte, t cybootloader_protocol.ChecksumType) error {
+	return ParseDefaultCmdResult(CmdVerifyData, r, t)
+}
+
+func CreateEraseDataCmd(address uint32, t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdEraseData, putUint32(nil, address), t)
+}
+
+func ParseEraseDataCmdResult(r []byte, t cybootloader_protocol.ChecksumType) error {
+	return ParseDefaultCmdResult(CmdEraseData, r, t)
+}
+
+// CreateSetAppMetadataCmd records where application appID is located.
+func CreateSetAppMetadataCmd(appID byte, startAddress uint32, length uint32, t cybootloader_protocol.ChecksumType) []byte {
+	data := []byte{appID}
+	data = putUint32(data, startAddress)
+	data = putUint32(data, length)
+	return newFrame(CmdSetAppMetadata, data, t)
+}
+
+func ParseSetAppMetadataCmdResult(r []byte, t cybootloader_protocol.ChecksumType) error {
+	return ParseDefaultCmdResult(CmdSetAppMetadata, r, t)
+}
+
+// CreateGetMetadataCmd reads the metadata bytes between two offsets.
+func CreateGetMetadataCmd(from uint16, to uint16, t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdGetMetadata, []byte{byte(from), byte(from >> 8), byte(to), byte(to >> 8)}, t)
+}
+
+// ParseGetMetadataCmdResult returns the metadata bytes sent by the device.
+func ParseGetMetadataCmdResult(r []byte, t cybootloader_protocol.ChecksumType) ([]byte, error) {
+	return checkResponse(CmdGetMetadata, r, cybootloader_protocol.AnyDataSize, t)
+}
+
+func CreateSetEIVCmd(eiv []byte, t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdSetEIV, eiv, t)
+}
+
+func ParseSetEIVCmdResult(r []byte, t cybootloader_protocol.ChecksumType) error {
+	return ParseDefaultCmdResult(CmdSetEIV, r, t)
+}
+
+// CreateVerifyAppCmd asks the device to validate application appID.
+func CreateVerifyAppCmd(appID byte, t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdVerifyApp, []byte{appID}, t)
+}
+
+// ParseVerifyAppCmdResult returns 1 if the application is valid.
+func ParseVerifyAppCmdResult(r []byte, t cybootloader_protocol.ChecksumType) (byte, error) {
+	data, err := checkResponse(CmdVerifyApp, r, 1, t)
+	if err != nil {
+		return 0xff, err
+	}
+	return data[0], nil
+}
+
+func CreateSyncCmd(t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdSync, nil, t)
+}
+
+func CreateExitDFUCmd(t cybootloader_protocol.ChecksumType) []byte {
+	return newFrame(CmdExitDFU, nil, t)
+}
+
+// ParseDefaultCmdResult validates a response to cmd that carries no data.
+func ParseDefaultCmdResult(cmd byte, r []byte, t cybootloader_protocol.ChecksumType) error {
+	_, err := checkResponse(cmd, r, 0, t)
+	return err
+}
+
+// checkResponse validates a response with the checksum algorithm t.
+func checkResponse(cmd byte, r []byte, dataSize int, t cybootloader_protocol.ChecksumType) ([]byte, error) {
+	return cybootloader_protocol.CheckResponse(cmd, r, dataSize, t)
+}
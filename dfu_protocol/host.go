@@ -0,0 +1,157 @@
+package dfu_protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+// Host drives a DFU session over a transport. It owns the transport for the
+// duration of the session; it is not safe for concurrent use.
+type Host struct {
+	*cybootloader_protocol.Conn
+	noDataResponses bool
+}
+
+// NewHost creates a Host talking to the device over dev, using the basic
+// summation checksum and cybootloader_protocol.DefaultPacketSize.
+func NewHost(dev io.ReadWriter) *Host {
+	return &Host{Conn: cybootloader_protocol.NewConn(dev, RowHeaderSize)}
+}
+
+// EnterDFU starts a DFU session with a device running productID, 0 if the
+// application does not check it.
+func (h *Host) EnterDFU(ctx context.Context, productID uint32) (cybootloader_protocol.DeviceInfo, error) {
+	data, err := h.Transact(ctx, CreateEnterDFUCmd(productID, h.ChecksumType()), 8)
+	if err != nil {
+		return cybootloader_protocol.DeviceInfo{}, err
+	}
+
+	return cybootloader_protocol.DeviceInfo{
+		SiliconID:         uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24,
+		SiliconRev:        data[4],
+		BootloaderVersion: uint32(data[5]) | uint32(data[6])<<8 | uint32(data[7])<<16,
+	}, nil
+}
+
+// SendData sends a block of row data to be buffered by the device.
+func (h *Host) SendData(ctx context.Context, b []byte) error {
+	_, err := h.Transact(ctx, CreateSendDataCmd(b, h.ChecksumType()), 0)
+	return err
+}
+
+// SetSendDataWithoutResponse makes row data ahead of Program Data and Verify
+// Data go out with Send Data Without Response, skipping one round trip per
+// packet. A lost packet is then only reported by the final command.
+func (h *Host) SetSendDataWithoutResponse(enabled bool) {
+	h.noDataResponses = enabled
+}
+
+// SendDataWithoutResponse sends a block of row data without waiting for the
+// device to acknowledge it.
+func (h *Host) SendDataWithoutResponse(ctx context.Context, b []byte) error {
+	return h.Send(ctx, CreateSendDataWithoutResponseCmd(b, h.ChecksumType()))
+}
+
+// sendRow sends the part of a row that does not fit in the final command and
+// returns the remainder.
+func (h *Host) sendRow(ctx context.Context, data []byte) ([]byte, error) {
+	chunks, rest := h.SplitRow(data)
+	for _, chunk := range chunks {
+		var err error
+		if h.noDataResponses {
+			err = h.SendDataWithoutResponse(ctx, chunk)
+		} else {
+			err = h.SendData(ctx, chunk)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rest, nil
+}
+
+// ProgramData writes the flash row at address. If it fails, the device may
+// still hold part of the row; call Sync before trying again.
+func (h *Host) ProgramData(ctx context.Context, address uint32, data []byte) error {
+	rest, err := h.sendRow(ctx, data)
+	if err != nil {
+		return fmt.Errorf("sending data for address 0x%08X: %w", address, err)
+	}
+
+	if _, err := h.Transact(ctx, CreateProgramDataCmd(address, RowChecksum(data), rest, h.ChecksumType()), 0); err != nil {
+		return fmt.Errorf("programming address 0x%08X: %w", address, err)
+	}
+
+	return nil
+}
+
+// VerifyData compares the flash row at address with data. A difference is
+// reported as a *cybootloader_protocol.BootloaderError with StatusErrVerify.
+func (h *Host) VerifyData(ctx context.Context, address uint32, data []byte) error {
+	rest, err := h.sendRow(ctx, data)
+	if err != nil {
+		return fmt.Errorf("sending data for address 0x%08X: %w", address, err)
+	}
+
+	if _, err := h.Transact(ctx, CreateVerifyDataCmd(address, RowChecksum(data), rest, h.ChecksumType()), 0); err != nil {
+		return fmt.Errorf("verifying address 0x%08X: %w", address, err)
+	}
+
+	return nil
+}
+
+// EraseData erases the flash row at address.
+func (h *Host) EraseData(ctx context.Context, address uint32) error {
+	_, err := h.Transact(ctx, CreateEraseDataCmd(address, h.ChecksumType()), 0)
+	return err
+}
+
+// SetAppMetadata records the start address and length of application appID,
+// which Verify Application and the bootloader use to validate it.
+func (h *Host) SetAppMetadata(ctx context.Context, appID byte, startAddress uint32, length uint32) error {
+	_, err := h.Transact(ctx, CreateSetAppMetadataCmd(appID, startAddress, length, h.ChecksumType()), 0)
+	return err
+}
+
+// GetMetadata reads the metadata bytes between two offsets, inclusive.
+func (h *Host) GetMetadata(ctx context.Context, from uint16, to uint16) ([]byte, error) {
+	data, err := h.Transact(ctx, CreateGetMetadataCmd(from, to, h.ChecksumType()), cybootloader_protocol.AnyDataSize)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// SetEIV sets the initialization vector used to decrypt the rows of an
+// encrypted image.
+func (h *Host) SetEIV(ctx context.Context, eiv []byte) error {
+	_, err := h.Transact(ctx, CreateSetEIVCmd(eiv, h.ChecksumType()), 0)
+	return err
+}
+
+// VerifyApp asks the device to validate application appID. It returns a non
+// zero value if the application is valid.
+func (h *Host) VerifyApp(ctx context.Context, appID byte) (byte, error) {
+	data, err := h.Transact(ctx, CreateVerifyAppCmd(appID, h.ChecksumType()), 1)
+	if err != nil {
+		return 0xff, err
+	}
+
+	return data[0], nil
+}
+
+// Sync resynchronises the host and the device after a communication error,
+// discarding any row data buffered by the device.
+func (h *Host) Sync(ctx context.Context) error {
+	return h.Resync(ctx, CreateSyncCmd(h.ChecksumType()))
+}
+
+// Exit ends the DFU session and starts the application. The device does not
+// answer this command.
+func (h *Host) Exit(ctx context.Context) error {
+	return h.Send(ctx, CreateExitDFUCmd(h.ChecksumType()))
+}
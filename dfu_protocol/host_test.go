@@ -0,0 +1,193 @@
+package dfu_protocol_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/dfu_protocol"
+	"bootloader-usb/simulator"
+)
+
+const testProductID = 0x04030201
+
+// enter starts a DFU session with a simulated PSoC 6 device.
+func enter(t *testing.T, checksumType cybootloader_protocol.ChecksumType) (*dfu_protocol.Host, *simulator.Target) {
+	t.Helper()
+
+	sim := simulator.New(simulator.Config{
+		SiliconID:         0xE2072100,
+		SiliconRev:        0x11,
+		BootloaderVersion: 0x040000,
+		ChecksumType:      checksumType,
+		DFU:               true,
+		ProductID:         testProductID,
+	})
+	h := dfu_protocol.NewHost(sim)
+	h.SetChecksumType(checksumType)
+
+	info, err := h.EnterDFU(context.Background(), testProductID)
+	if err != nil {
+		t.Fatalf("EnterDFU: %v", err)
+	}
+	if info.SiliconID != 0xE2072100 || info.SiliconRev != 0x11 || info.BootloaderVersion != 0x040000 {
+		t.Fatalf("EnterDFU = %+v", info)
+	}
+	return h, sim
+}
+
+func testRow(size int, seed byte) []byte {
+	row := make([]byte, size)
+	for i := range row {
+		row[i] = byte(i*7) + seed
+	}
+	return row
+}
+
+func TestEnterDFUProductID(t *testing.T) {
+	sim := simulator.New(simulator.Config{DFU: true, ProductID: testProductID})
+	h := dfu_protocol.NewHost(sim)
+
+	_, err := h.EnterDFU(context.Background(), testProductID+1)
+	if !errors.Is(err, cybootloader_protocol.StatusErrDevice) {
+		t.Errorf("EnterDFU error = %v, want CYRET_ERR_DEVICE", err)
+	}
+}
+
+func TestProgramData(t *testing.T) {
+	ctx := context.Background()
+	for _, checksumType := range []cybootloader_protocol.ChecksumType{cybootloader_protocol.ChecksumSum, cybootloader_protocol.ChecksumCRC16} {
+		for _, noResponse := range []bool{false, true} {
+			for _, size := range []int{1, 49, 50, 56, 57, 128, 512} {
+				t.Run(fmt.Sprintf("%s/without response %v/row %d", checksumType, noResponse, size), func(t *testing.T) {
+					h, sim := enter(t, checksumType)
+					h.SetSendDataWithoutResponse(noResponse)
+
+					row := testRow(size, 1)
+					if err := h.ProgramData(ctx, 0x10000000, row); err != nil {
+						t.Fatalf("ProgramData: %v", err)
+					}
+					if got := sim.Data(0x10000000); !bytes.Equal(got, row) {
+						t.Errorf("device holds % X, want % X", got, row)
+					}
+					if err := h.VerifyData(ctx, 0x10000000, row); err != nil {
+						t.Errorf("VerifyData: %v", err)
+					}
+
+					chunks, _ := h.SplitRow(row)
+					sent, unanswered := sim.CommandCount(dfu_protocol.CmdSendData), sim.CommandCount(dfu_protocol.CmdSendDataWithoutResponse)
+					if noResponse {
+						sent, unanswered = unanswered, sent
+					}
+					// each row goes out twice, for Program Data and Verify Data
+					if sent != 2*len(chunks) || unanswered != 0 {
+						t.Errorf("%d packets sent with the selected command and %d with the other, want %d and 0", sent, unanswered, 2*len(chunks))
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestVerifyDataMismatch(t *testing.T) {
+	ctx := context.Background()
+	h, _ := enter(t, cybootloader_protocol.ChecksumSum)
+
+	if err := h.ProgramData(ctx, 0x10000000, testRow(512, 1)); err != nil {
+		t.Fatalf("ProgramData: %v", err)
+	}
+	err := h.VerifyData(ctx, 0x10000000, testRow(512, 2))
+	if !errors.Is(err, cybootloader_protocol.StatusErrVerify) {
+		t.Errorf("VerifyData error = %v, want CYRET_ERR_VERIFY", err)
+	}
+}
+
+func TestEraseData(t *testing.T) {
+	ctx := context.Background()
+	h, sim := enter(t, cybootloader_protocol.ChecksumSum)
+
+	row := testRow(512, 1)
+	if err := h.ProgramData(ctx, 0x10000200, row); err != nil {
+		t.Fatalf("ProgramData: %v", err)
+	}
+	if err := h.EraseData(ctx, 0x10000200); err != nil {
+		t.Fatalf("EraseData: %v", err)
+	}
+	if got := sim.Data(0x10000200); got != nil {
+		t.Errorf("erased row holds % X", got)
+	}
+	if err := h.VerifyData(ctx, 0x10000200, row); !errors.Is(err, cybootloader_protocol.StatusErrVerify) {
+		t.Errorf("VerifyData of an erased row: %v, want CYRET_ERR_VERIFY", err)
+	}
+}
+
+func TestAppMetadata(t *testing.T) {
+	ctx := context.Background()
+	h, _ := enter(t, cybootloader_protocol.ChecksumCRC16)
+
+	if err := h.SetAppMetadata(ctx, 1, 0x10000000, 0x400); err != nil {
+		t.Fatalf("SetAppMetadata: %v", err)
+	}
+
+	// app 1 is the second entry of the table of start addresses and lengths
+	md, err := h.GetMetadata(ctx, 8, 15)
+	if err != nil {
+		t.Fatalf("GetMetadata: %v", err)
+	}
+	if len(md) != 8 || binary.LittleEndian.Uint32(md) != 0x10000000 || binary.LittleEndian.Uint32(md[4:]) != 0x400 {
+		t.Errorf("GetMetadata = % X", md)
+	}
+
+	if valid, err := h.VerifyApp(ctx, 1); err != nil || valid != 0 {
+		t.Errorf("VerifyApp before programming = %d, %v, want 0", valid, err)
+	}
+	for _, address := range []uint32{0x10000000, 0x10000200} {
+		if err := h.ProgramData(ctx, address, testRow(512, byte(address>>8))); err != nil {
+			t.Fatalf("ProgramData: %v", err)
+		}
+	}
+	if valid, err := h.VerifyApp(ctx, 1); err != nil || valid == 0 {
+		t.Errorf("VerifyApp after programming = %d, %v, want valid", valid, err)
+	}
+}
+
+func TestSetEIV(t *testing.T) {
+	h, _ := enter(t, cybootloader_protocol.ChecksumSum)
+	if err := h.SetEIV(context.Background(), []byte{0xA1, 0xB2, 0xC3, 0xD4}); err != nil {
+		t.Errorf("SetEIV: %v", err)
+	}
+}
+
+func TestSyncDiscardsData(t *testing.T) {
+	ctx := context.Background()
+	h, sim := enter(t, cybootloader_protocol.ChecksumSum)
+
+	if err := h.SendData(ctx, []byte{0xEE, 0xEE, 0xEE}); err != nil {
+		t.Fatalf("SendData: %v", err)
+	}
+	if err := h.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	row := testRow(128, 1)
+	if err := h.ProgramData(ctx, 0x10000000, row); err != nil {
+		t.Fatalf("ProgramData after Sync: %v", err)
+	}
+	if got := sim.Data(0x10000000); !bytes.Equal(got, row) {
+		t.Errorf("device holds % X, want % X", got, row)
+	}
+}
+
+func TestExit(t *testing.T) {
+	h, sim := enter(t, cybootloader_protocol.ChecksumSum)
+	if err := h.Exit(context.Background()); err != nil {
+		t.Fatalf("Exit: %v", err)
+	}
+	if !sim.Exited() {
+		t.Error("device did not leave DFU")
+	}
+}
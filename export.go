@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bootloader-usb/cyacdParse"
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Output formats of the export subcommand.
+const (
+	exportFormatBin  = "bin"
+	exportFormatHex  = "hex"
+	exportFormatJSON = "json"
+)
+
+// runExport renders a .cyacd file as a flat binary, an Intel HEX file or a
+// per row JSON dump, so that two builds can be compared with standard tools.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	in := fs.String("in", "", "Path for the .cyacd file, optionally gzip compressed. - reads the file from stdin")
+	out := fs.String("out", "", "Path for the exported file")
+	format := fs.String("format", "", "Output format: bin, hex or json. Taken from the file extension by default")
+	rowSize := fs.Int("row-size", 0, "Size of a flash row in bytes. Defaults to the size of the rows of the file")
+	rowsPerArray := fs.Int("rows-per-array", 0, "Number of rows in each flash array. Required for files using several arrays")
+	flashBase := fs.Uint64("flash-base", 0, "Address of the first flash row")
+	fill := fs.Uint("fill", 0, "Value of the bytes between rows in a binary")
+	fs.Parse(args)
+
+	if *in == "" || *out == "" {
+		fs.PrintDefaults()
+		return validationError("In and out are required.")
+	}
+	if *flashBase > 0xFFFFFFFF || *fill > 0xFF || *rowSize < 0 || *rowsPerArray < 0 {
+		return validationError("Flash base must fit 32 bits, fill 8 bits, row size and rows per array cannot be negative.")
+	}
+
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(*out)) {
+		case ".hex":
+			*format = exportFormatHex
+		case ".json":
+			*format = exportFormatJSON
+		default:
+			*format = exportFormatBin
+		}
+	}
+
+	logEvent(slog.LevelInfo, EventProcessStart, "Exporting file", "command", "export", "file", *in, "format", *format)
+
+	image, err := loadImage(*in)
+	if err != nil {
+		return wrapError(err, "Error parsing file", ErrorCodeParamValidation)
+	}
+	f, ok := image.(*cyacdParse.Cyacd)
+	if !ok {
+		return wrapError(fmt.Errorf("%s files cannot be exported", image.Format()), "Unsupported firmware format", ErrorCodeParamValidation)
+	}
+
+	layout := cyacdParse.Layout{
+		RowSize:      *rowSize,
+		RowsPerArray: *rowsPerArray,
+		FlashBase:    uint32(*flashBase),
+		Fill:         byte(*fill),
+	}
+
+	var buf bytes.Buffer
+	var start uint32
+	switch *format {
+	case exportFormatBin:
+		var b []byte
+		start, b, err = f.Binary(layout)
+		buf.Write(b)
+	case exportFormatHex:
+		err = f.WriteIntelHex(&buf, layout)
+	case exportFormatJSON:
+		err = f.WriteJSON(&buf)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		return wrapError(err, "Error exporting file", ErrorCodeParamValidation)
+	}
+
+	err = os.WriteFile(*out, buf.Bytes(), 0o644)
+	if err != nil {
+		return wrapError(err, "Error writing exported file", ErrorCodeParamValidation)
+	}
+
+	attrs := []any{
+		"status", "success",
+		"file", *out,
+		"rows", len(f.ParseRowData()),
+	}
+	if *format == exportFormatBin {
+		attrs = append(attrs, "start_address", fmt.Sprintf("0x%08X", start), "size", buf.Len())
+	}
+	logEvent(slog.LevelInfo, EventProcessComplete, "Exported file written", attrs...)
+	return nil
+}
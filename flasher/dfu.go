@@ -0,0 +1,227 @@
+package flasher
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"bootloader-usb/cyacdParse"
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/dfu_protocol"
+)
+
+// DFUProgrammer programs a .cyacd2 image into a device running the
+// ModusToolbox DFU middleware. The caller owns the transport and closes it
+// once Run returns.
+//
+// Options.Key, Options.SetActive and Options.Metadata do not apply to DFU;
+// NewDFU rejects the last two. Options.App selects the
+// application slot, -1 for the app ID of the image header.
+type DFUProgrammer struct {
+	session
+	image *cyacdParse.Cyacd2
+	host  *dfu_protocol.Host
+	appID byte
+}
+
+// NewDFU creates a DFUProgrammer for image talking to the device over dev.
+func NewDFU(image *cyacdParse.Cyacd2, dev io.ReadWriter, opts Options) (*DFUProgrammer, error) {
+	if image == nil {
+		return nil, fmt.Errorf("firmware image cannot be nil")
+	}
+	if dev == nil {
+		return nil, fmt.Errorf("transport cannot be nil")
+	}
+	if opts.App < -1 || opts.App > 0xFF {
+		return nil, fmt.Errorf("app must be between 0 and 255, or -1 for the app of the image")
+	}
+	if opts.SetActive {
+		return nil, fmt.Errorf("the active application cannot be set over DFU")
+	}
+	if opts.Metadata {
+		return nil, fmt.Errorf("the bootloadable metadata cannot be read over DFU")
+	}
+
+	appID := image.AppID()
+	if opts.App >= 0 {
+		appID = byte(opts.App)
+	}
+
+	host := dfu_protocol.NewHost(dev)
+	configureConn(host.Conn, image, opts)
+
+	return &DFUProgrammer{
+		session: newSession(opts),
+		image:   image,
+		host:    host,
+		appID:   appID,
+	}, nil
+}
+
+// Host returns the protocol session used by the DFUProgrammer.
+func (p *DFUProgrammer) Host() *dfu_protocol.Host {
+	return p.host
+}
+
+// Restart ends the DFU session without programming, starting the application.
+func (p *DFUProgrammer) Restart(ctx context.Context) error {
+	p.reporter.Report(Event{Type: EventBootloaderExit})
+	return stageError(StageExit, p.host.Exit(ctx))
+}
+
+// Run executes the DFU workflow: enter DFU, program every row, record the
+// application metadata, verify the application and exit. Cancellation
+// behaves as for Programmer.Run.
+func (p *DFUProgrammer) Run(ctx context.Context) (*Result, error) {
+	return p.session.execute(ctx, p.run, p.Restart)
+}
+
+func (p *DFUProgrammer) run(ctx context.Context, res *Result) error {
+	if p.opts.CheckImage {
+		if err := p.image.VerifyChecksums(); err != nil {
+			return stageError(StageImage, fmt.Errorf("%w: %w", ErrRecordChecksum, err))
+		}
+	}
+	if err := p.checkGeometry(p.image); err != nil {
+		return stageError(StageImage, err)
+	}
+
+	if err := p.checkpoint(ctx, StageEnter); err != nil {
+		return err
+	}
+
+	p.reporter.Report(Event{Type: EventBootloaderEnter})
+	info, err := p.host.EnterDFU(ctx, p.image.ProductID())
+	if err != nil {
+		return stageError(StageEnter, err)
+	}
+	res.Device = info
+	p.entered = true
+
+	if err := p.checkDevice(p.image, info); err != nil {
+		return stageError(StageEnter, err)
+	}
+
+	if eiv := p.image.EIV(); eiv != nil {
+		if err := p.checkpoint(ctx, StageEnter); err != nil {
+			return err
+		}
+		if err := p.host.SetEIV(ctx, eiv); err != nil {
+			return stageError(StageEnter, err)
+		}
+	}
+
+	rows := p.image.Rows()
+	res.TotalRows = len(rows)
+
+	if !p.opts.DryRun {
+		if err := p.program(ctx, rows, res); err != nil {
+			return err
+		}
+
+		if err := p.checkpoint(ctx, StageMetadata); err != nil {
+			return err
+		}
+		start, length := p.appLocation(rows)
+		if err := p.host.SetAppMetadata(ctx, p.appID, start, length); err != nil {
+			return stageError(StageMetadata, err)
+		}
+
+		if p.opts.Verify {
+			if err := p.verify(ctx, res); err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.opts.Restart {
+		if err := p.checkpoint(ctx, StageExit); err != nil {
+			return err
+		}
+		if err := p.Restart(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appLocation returns the application location declared by @APPINFO, or the
+// range covered by the rows when the image has none.
+func (p *DFUProgrammer) appLocation(rows []*cyacdParse.DataRow) (uint32, uint32) {
+	if info := p.image.AppInfo(); info != nil {
+		return info.StartAddress, info.Length
+	}
+
+	var start, end uint32
+	for i, r := range rows {
+		rowEnd := r.Address() + uint32(len(r.Data()))
+		if i == 0 || r.Address() < start {
+			start = r.Address()
+		}
+		if rowEnd > end {
+			end = rowEnd
+		}
+	}
+	return start, end - start
+}
+
+// program writes every row of the image. The device checks each row against
+// the CRC-32C carried by Program Data.
+func (p *DFUProgrammer) program(ctx context.Context, rows []*cyacdParse.DataRow, res *Result) error {
+	p.reporter.Report(Event{Type: EventProgrammingStart, TotalRows: len(rows)})
+
+	for i, r := range rows {
+		if err := p.checkpoint(ctx, StageProgram); err != nil {
+			return err
+		}
+		if err := p.programDataWithRetry(ctx, r, res); err != nil {
+			return stageError(StageProgram, err)
+		}
+		res.RowsProgrammed++
+		p.reporter.Report(Event{Type: EventRowProgrammed, Address: r.Address(), RowIndex: i, TotalRows: len(rows)})
+	}
+
+	p.reporter.Report(Event{Type: EventProgrammingComplete, TotalRows: len(rows)})
+	return nil
+}
+
+// programDataWithRetry programs a row and, when the transfer fails with a
+// recoverable error, resynchronises with the device and sends the whole row
+// again, up to Retries times.
+func (p *DFUProgrammer) programDataWithRetry(ctx context.Context, r *cyacdParse.DataRow, res *Result) error {
+	for attempt := 0; ; attempt++ {
+		err := p.host.ProgramData(ctx, r.Address(), r.Data())
+		if err == nil || ctx.Err() != nil || attempt >= p.opts.Retries || !cybootloader_protocol.IsRecoverable(err) {
+			return err
+		}
+
+		res.Resyncs++
+		p.reporter.Report(Event{Type: EventProgrammingResync, Address: r.Address(), Attempt: attempt + 1, Err: err})
+
+		if err := p.host.Sync(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// verify asks the device to validate the application.
+func (p *DFUProgrammer) verify(ctx context.Context, res *Result) error {
+	if err := p.checkpoint(ctx, StageVerify); err != nil {
+		return err
+	}
+
+	valid, err := p.host.VerifyApp(ctx, p.appID)
+	if err != nil {
+		return stageError(StageVerify, err)
+	}
+	res.AppChecksum = valid
+	res.Verified = valid != 0
+
+	p.reporter.Report(Event{Type: EventVerificationComplete, App: int(p.appID), AppChecksum: valid})
+
+	if !res.Verified {
+		return stageError(StageVerify, fmt.Errorf("%w: app %d", ErrAppInvalid, p.appID))
+	}
+	return nil
+}
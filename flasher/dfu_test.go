@@ -0,0 +1,138 @@
+package flasher_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"bootloader-usb/cyacdParse"
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/dfu_protocol"
+	"bootloader-usb/flasher"
+	"bootloader-usb/simulator"
+)
+
+// testCyacd2 builds a .cyacd2 image for a CY8C6347BZI-BLD53 (PSoC 6) holding
+// rows of 512 bytes from the start of its flash.
+func testCyacd2(t *testing.T, checksumType cybootloader_protocol.ChecksumType, rows int) *cyacdParse.Cyacd2 {
+	t.Helper()
+	return buildCyacd2(t, 0xE2072100, checksumType, 0x10000000, 512, rows)
+}
+
+// buildCyacd2 builds a .cyacd2 image of consecutive rows starting at address.
+func buildCyacd2(t *testing.T, siliconID uint32, checksumType cybootloader_protocol.ChecksumType, address uint32, rowSize, rows int) *cyacdParse.Cyacd2 {
+	t.Helper()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "01%08X11%02X0101020304\n", siliconID, byte(checksumType))
+	for i := 0; i < rows; i++ {
+		row := make([]byte, 4, 4+rowSize)
+		binary.LittleEndian.PutUint32(row, address+uint32(i*rowSize))
+		for j := 0; j < rowSize; j++ {
+			row = append(row, byte(i*rowSize+j*7))
+		}
+		fmt.Fprintf(&b, ":%s\n", strings.ToUpper(hex.EncodeToString(row)))
+	}
+
+	image, err := cyacdParse.ParseCyacd2Bytes([]byte(b.String()), "test.cyacd2")
+	if err != nil {
+		t.Fatalf("ParseCyacd2Bytes: %v", err)
+	}
+	return image
+}
+
+func TestProgramDFU(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum cybootloader_protocol.ChecksumType
+	}{
+		{"sum", cybootloader_protocol.ChecksumSum},
+		{"crc16", cybootloader_protocol.ChecksumCRC16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := testCyacd2(t, tt.checksum, 4)
+			sim := simulator.New(simulator.ConfigForDFUImage(image))
+
+			p, err := flasher.NewDFU(image, sim, flasher.DefaultOptions())
+			if err != nil {
+				t.Fatalf("NewDFU: %v", err)
+			}
+
+			res, err := p.Run(context.Background())
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if res.RowsProgrammed != 4 || res.Resyncs != 0 || !res.Verified {
+				t.Errorf("Result = %+v", res)
+			}
+			for _, r := range image.Rows() {
+				if got := sim.Data(r.Address()); !bytes.Equal(got, r.Data()) {
+					t.Errorf("row at 0x%08X holds % X, want % X", r.Address(), got, r.Data())
+				}
+			}
+			if !sim.Exited() {
+				t.Error("DFU session was not ended")
+			}
+		})
+	}
+}
+
+func TestDFUImageGeometry(t *testing.T) {
+	tests := []struct {
+		name    string
+		address uint32
+		rowSize int
+		rows    int
+	}{
+		{"PSoC 4 row size", 0x10000000, 128, 4},
+		{"before the flash", 0x0FFFFE00, 512, 1},
+		{"past the flash", 0x100FFE00, 512, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := buildCyacd2(t, 0xE2072100, cybootloader_protocol.ChecksumSum, tt.address, tt.rowSize, tt.rows)
+			sim := simulator.New(simulator.ConfigForDFUImage(image))
+
+			p, err := flasher.NewDFU(image, sim, flasher.DefaultOptions())
+			if err != nil {
+				t.Fatalf("NewDFU: %v", err)
+			}
+			_, err = p.Run(context.Background())
+
+			var ferr *flasher.Error
+			if !errors.Is(err, flasher.ErrImageGeometry) || !errors.As(err, &ferr) || ferr.Stage != flasher.StageImage {
+				t.Fatalf("Run error = %v, want ErrImageGeometry at the image stage", err)
+			}
+			if n := sim.CommandCount(dfu_protocol.CmdEnterDFU); n != 0 {
+				t.Errorf("device received %d Enter DFU commands, want 0", n)
+			}
+		})
+	}
+}
+
+func TestNewDFURejectsOptions(t *testing.T) {
+	image := testCyacd2(t, cybootloader_protocol.ChecksumSum, 1)
+
+	tests := []struct {
+		name string
+		set  func(*flasher.Options)
+	}{
+		{"metadata", func(o *flasher.Options) { o.Metadata = true }},
+		{"set active", func(o *flasher.Options) { o.App, o.SetActive = 0, true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := flasher.DefaultOptions()
+			tt.set(&opts)
+			if _, err := flasher.NewDFU(image, simulator.New(simulator.ConfigForDFUImage(image)), opts); err == nil {
+				t.Error("NewDFU accepted the option")
+			}
+		})
+	}
+}
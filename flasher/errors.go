@@ -0,0 +1,67 @@
+package flasher
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Stage is the step of the programming workflow in which an error occurred.
+type Stage string
+
+const (
+	StageImage     Stage = "image"
+	StageEnter     Stage = "enter"
+	StageAppStatus Stage = "app_status"
+	StageFlashSize Stage = "flash_size"
+	StageProgram   Stage = "program"
+	StageMetadata  Stage = "metadata"
+	StageVerify    Stage = "verify"
+	StageActivate  Stage = "activate"
+	StageExit      Stage = "exit"
+)
+
+var (
+	// ErrDeviceMismatch is returned when the silicon ID or revision of the
+	// device does not match the firmware image.
+	ErrDeviceMismatch = errors.New("the expected device does not match the detected device")
+	// ErrRowOutOfRange is returned when a row of the image is outside the
+	// flash range reported by the device.
+	ErrRowOutOfRange = errors.New("the row number is out of range")
+	// ErrRowChecksum is returned when the checksum of a programmed row read
+	// back from the device differs from the one computed from the image.
+	ErrRowChecksum = errors.New("the checksum does not match the expected value")
+	// ErrAppInvalid is returned when the device reports the application
+	// checksum as invalid after programming.
+	ErrAppInvalid = errors.New("the application checksum is not valid")
+	// ErrAppActive is returned when the selected application slot of a multi
+	// app bootloader is the active one and cannot be programmed.
+	ErrAppActive = errors.New("the application is the active application and cannot be programmed")
+	// ErrRecordChecksum is returned when a row record of the image does not
+	// match its own checksum byte, meaning the file is corrupted.
+	ErrRecordChecksum = errors.New("the firmware image has corrupted records")
+	// ErrImageGeometry is returned when the rows of the image do not fit the
+	// flash geometry of the part it targets.
+	ErrImageGeometry = errors.New("the firmware image does not fit the flash of the part")
+)
+
+// Error reports the stage of the workflow that failed and the underlying
+// cause, which may be a *cybootloader_protocol.BootloaderError.
+type Error struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func stageError(stage Stage, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Stage: stage, Err: err}
+}
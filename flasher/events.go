@@ -0,0 +1,81 @@
+package flasher
+
+import (
+	"bootloader-usb/cyacdParse"
+	"bootloader-usb/cybootloader_protocol"
+)
+
+// EventType identifies the step of the programming workflow an Event reports.
+type EventType string
+
+const (
+	EventBootloaderEnter      EventType = "bootloader.enter"
+	EventDeviceIdentified     EventType = "device.identified"
+	EventDeviceAccepted       EventType = "device.accepted"
+	EventBootloaderExit       EventType = "bootloader.exit"
+	EventAppStatus            EventType = "app.status"
+	EventAppActivate          EventType = "app.activate"
+	EventMetadata             EventType = "app.metadata"
+	EventProgrammingStart     EventType = "programming.start"
+	EventRowProgrammed        EventType = "programming.row"
+	EventProgrammingResync    EventType = "programming.resync"
+	EventProgrammingComplete  EventType = "programming.complete"
+	EventVerificationComplete EventType = "verification.complete"
+)
+
+// Event describes progress of a Programmer. Only the fields relevant to the
+// event type are set.
+type Event struct {
+	Type EventType
+
+	// Device reported on entering the bootloader and the description of its
+	// part, for the device events. Rule is the compatibility rule that
+	// accepted a device differing from the image, for EventDeviceAccepted.
+	Device cybootloader_protocol.DeviceInfo
+	Part   string
+	Rule   string
+
+	// Row being programmed and its position, for programming events. DFU
+	// rows are identified by Address and leave Row nil.
+	Row       *cyacdParse.Row
+	Address   uint32
+	RowIndex  int
+	TotalRows int
+
+	// Retry attempt and the error that caused it, for EventProgrammingResync
+	Attempt int
+	Err     error
+
+	// Application slot and its state, for the app events
+	App       int
+	AppStatus cybootloader_protocol.AppStatus
+
+	// Application metadata read from the device and extracted from the image,
+	// for EventMetadata. Err is set instead when the bootloader rejected Get
+	// Metadata; ImageMetadata is nil when the image holds none.
+	Metadata      *cybootloader_protocol.Metadata
+	ImageMetadata *cybootloader_protocol.Metadata
+
+	// Application checksum reported by the device and the one computed from
+	// the image, for EventVerificationComplete. The DFU workflow leaves
+	// ImageChecksum zero.
+	AppChecksum   byte
+	ImageChecksum byte
+}
+
+// Reporter receives progress events from a Programmer. Report is called
+// synchronously from Run, so it should return quickly.
+type Reporter interface {
+	Report(ev Event)
+}
+
+// ReporterFunc adapts a function to the Reporter interface.
+type ReporterFunc func(ev Event)
+
+func (f ReporterFunc) Report(ev Event) {
+	f(ev)
+}
+
+type nopReporter struct{}
+
+func (nopReporter) Report(Event) {}
@@ -0,0 +1,106 @@
+package flasher_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/flasher"
+	"bootloader-usb/simulator"
+	"bootloader-usb/transport"
+)
+
+// TestProgramFaults corrupts one transfer and checks that the row is
+// resynchronised and programmed again.
+func TestProgramFaults(t *testing.T) {
+	// Rows of 128 bytes are sent as two Send Data commands and a Program Row
+	// command with the default packet size
+	tests := []struct {
+		name     string
+		schedule string
+		row      int // index of the row retried
+	}{
+		{"drop", "action=drop,cmd=ProgramRow,nth=2", 1},
+		{"corrupt", "action=bitflip,cmd=ProgramRow,nth=2", 1},
+		{"truncate", "action=truncate,cmd=GetRowChecksum,nth=3,bytes=4", 2},
+		{"delay", "action=delay,cmd=ProgramRow,nth=2,delay=250ms", 1},
+		{"duplicate", "action=duplicate,dir=write,cmd=SendData,nth=3", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := testImage(t, cybootloader_protocol.ChecksumSum, 4)
+			sim := simulator.New(simulator.ConfigForImage(image, testKey))
+
+			schedule, err := transport.ParseSchedule(tt.schedule)
+			if err != nil {
+				t.Fatalf("ParseSchedule: %v", err)
+			}
+			dev := transport.NewFaultInjector(sim, schedule, 1)
+
+			var resyncs []flasher.Event
+			opts := flasher.DefaultOptions()
+			opts.Key = testKey
+			opts.Timeout = 50 * time.Millisecond
+			opts.Reporter = flasher.ReporterFunc(func(ev flasher.Event) {
+				if ev.Type == flasher.EventProgrammingResync {
+					resyncs = append(resyncs, ev)
+				}
+			})
+			p, err := flasher.New(image, dev, opts)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			res, err := p.Run(context.Background())
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if n := len(dev.Injections()); n != 1 {
+				t.Fatalf("%d faults injected, want 1", n)
+			}
+			if res.Resyncs != 1 || len(resyncs) != 1 {
+				t.Fatalf("%d resyncs, %d resync events, want 1", res.Resyncs, len(resyncs))
+			}
+			want := image.ParseRowData()[tt.row]
+			if ev := resyncs[0]; ev.Row.RowNum() != want.RowNum() || ev.Attempt != 1 || ev.Err == nil {
+				t.Errorf("resync of row %d attempt %d (%v), want row %d attempt 1", ev.Row.RowNum(), ev.Attempt, ev.Err, want.RowNum())
+			}
+			if n := sim.CommandCount(cybootloader_protocol.CMD_SYNC); n != 1 {
+				t.Errorf("Sync sent %d times, want 1", n)
+			}
+			if res.RowsProgrammed != 4 || !res.Verified {
+				t.Errorf("%d rows programmed, verified %v", res.RowsProgrammed, res.Verified)
+			}
+			checkFlash(t, sim, image)
+		})
+	}
+}
+
+func TestProgramFaultRetriesExhausted(t *testing.T) {
+	image := testImage(t, cybootloader_protocol.ChecksumSum, 4)
+	sim := simulator.New(simulator.ConfigForImage(image, testKey))
+	dev := transport.NewFaultInjector(sim, transport.Schedule{
+		{Action: transport.ActionDrop, Direction: transport.DirRead, Cmd: cybootloader_protocol.CmdProgramRow},
+	}, 1)
+
+	opts := flasher.DefaultOptions()
+	opts.Key = testKey
+	opts.Timeout = 20 * time.Millisecond
+	opts.Retries = 2
+	p, err := flasher.New(image, dev, opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	res, err := p.Run(context.Background())
+	var ferr *flasher.Error
+	if !errors.As(err, &ferr) || ferr.Stage != flasher.StageProgram || !cybootloader_protocol.IsTimeout(err) {
+		t.Fatalf("Run error = %v, want a timeout while programming", err)
+	}
+	if res.Resyncs != 2 || res.RowsProgrammed != 0 {
+		t.Errorf("%d resyncs, %d rows programmed, want 2 and 0", res.Resyncs, res.RowsProgrammed)
+	}
+}
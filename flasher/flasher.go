@@ -0,0 +1,507 @@
+// Package flasher implements the complete bootloader programming workflow on
+// top of cybootloader_protocol: enter the bootloader, check the silicon,
+// program and check every row, verify the application and exit.
+package flasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"bootloader-usb/cyacdParse"
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/silicon"
+)
+
+// Options configures a Programmer.
+type Options struct {
+	Key        []byte        // 6 byte bootloader key, nil if the bootloader has none
+	Verify     bool          // Verify the application checksum after programming
+	CheckImage bool          // Reject an image with corrupted records before entering the bootloader
+	DryRun     bool          // Check the device and the image without programming
+	Metadata   bool          // Read the application metadata of the device before programming
+	Restart    bool          // Exit the bootloader and start the application when done
+	Retries    int           // Times a row is retried after resynchronising
+	App        int           // Application slot of a multi app bootloader, -1 for single app
+	SetActive  bool          // Mark App as active after a successful verification
+	PacketSize int           // Maximum command frame size, 0 for the default
+	Timeout    time.Duration // Time allowed for each response, 0 for the default
+	Reporter   Reporter      // Receives progress events, may be nil
+
+	// Names parts and gives their flash geometry, nil for the built-in table
+	Parts *silicon.Database
+	// Devices accepted when the silicon ID or revision differs from the
+	// image, nil to require an exact match
+	Compat *silicon.Policy
+}
+
+// DefaultOptions returns the options used by the command line tool.
+func DefaultOptions() Options {
+	return Options{
+		Verify:     true,
+		CheckImage: true,
+		Restart:    true,
+		Retries:    3,
+		App:        -1,
+	}
+}
+
+// Result summarises a programming run.
+type Result struct {
+	Device          cybootloader_protocol.DeviceInfo
+	TotalRows       int
+	RowsProgrammed  int
+	Resyncs         int
+	Verified        bool
+	AppChecksum     byte
+	ImageChecksum   byte // Application checksum computed from the image
+	Metadata        *cybootloader_protocol.Metadata
+	AppStatusBefore []cybootloader_protocol.AppStatus
+	AppStatusAfter  []cybootloader_protocol.AppStatus
+	Duration        time.Duration
+	Cancelled       bool // Run stopped because its context was done
+}
+
+/* Time allowed to send Exit Bootloader after the run was cancelled. */
+const exitTimeout = 2 * time.Second
+
+// Runner is the programming workflow of one firmware format.
+type Runner interface {
+	Run(ctx context.Context) (*Result, error)
+	Restart(ctx context.Context) error
+}
+
+// NewForImage creates the workflow matching the format of image: a Programmer
+// for .cyacd files, a DFUProgrammer for .cyacd2 files.
+func NewForImage(image cyacdParse.Image, dev io.ReadWriter, opts Options) (Runner, error) {
+	switch img := image.(type) {
+	case *cyacdParse.Cyacd:
+		p, err := New(img, dev, opts)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case *cyacdParse.Cyacd2:
+		p, err := NewDFU(img, dev, opts)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case nil:
+		return nil, fmt.Errorf("firmware image cannot be nil")
+	}
+	return nil, fmt.Errorf("unsupported firmware format %q", image.Format())
+}
+
+// session holds the state shared by the workflows of every format.
+type session struct {
+	opts     Options
+	reporter Reporter
+
+	// entered is set once the device is in bootloader mode. idle is set when
+	// Run stopped on its context between two transactions, so the bootloader
+	// is not waiting for the rest of a command and can safely be told to exit.
+	entered bool
+	idle    bool
+}
+
+func newSession(opts Options) session {
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+
+	reporter := opts.Reporter
+	if reporter == nil {
+		reporter = nopReporter{}
+	}
+	if opts.Parts == nil {
+		opts.Parts = silicon.Builtin()
+	}
+
+	return session{opts: opts, reporter: reporter}
+}
+
+// configureConn applies the options shared by both protocols to the
+// connection of a host.
+func configureConn(conn *cybootloader_protocol.Conn, image cyacdParse.Image, opts Options) {
+	// frames must use the packet checksum the bootloader was built with
+	conn.SetChecksumType(image.ChecksumType())
+	if opts.PacketSize > 0 {
+		conn.SetPacketSize(opts.PacketSize)
+	}
+	if opts.Timeout > 0 {
+		conn.SetTimeout(opts.Timeout)
+	}
+}
+
+// Programmer programs a legacy .cyacd image into a device over a transport.
+// The caller owns the transport and closes it once Run returns.
+type Programmer struct {
+	session
+	image *cyacdParse.Cyacd
+	host  *cybootloader_protocol.Host
+}
+
+// New creates a Programmer for image talking to the bootloader over dev.
+func New(image *cyacdParse.Cyacd, dev io.ReadWriter, opts Options) (*Programmer, error) {
+	if image == nil {
+		return nil, fmt.Errorf("firmware image cannot be nil")
+	}
+	if dev == nil {
+		return nil, fmt.Errorf("transport cannot be nil")
+	}
+	if opts.Key != nil && len(opts.Key) != 6 {
+		return nil, fmt.Errorf("invalid size of key: must be 6 bytes, got %d", len(opts.Key))
+	}
+	if opts.App < -1 || opts.App >= cybootloader_protocol.MaxApps {
+		return nil, fmt.Errorf("app must be between 0 and %d, or -1 for a single app bootloader", cybootloader_protocol.MaxApps-1)
+	}
+	if opts.SetActive && opts.App < 0 {
+		return nil, fmt.Errorf("an app is required to set the active application")
+	}
+	host := cybootloader_protocol.NewHost(dev)
+	configureConn(host.Conn, image, opts)
+
+	return &Programmer{
+		session: newSession(opts),
+		image:   image,
+		host:    host,
+	}, nil
+}
+
+// Host returns the protocol session used by the Programmer.
+func (p *Programmer) Host() *cybootloader_protocol.Host {
+	return p.host
+}
+
+// Restart exits the bootloader without programming, starting the application.
+func (p *Programmer) Restart(ctx context.Context) error {
+	p.reporter.Report(Event{Type: EventBootloaderExit})
+	return stageError(StageExit, p.host.Exit(ctx))
+}
+
+// Run executes the programming workflow. On error the device is left in
+// bootloader mode so that programming can be attempted again.
+//
+// Run stops when ctx is done. If that happens between two transactions the
+// bootloader is idle, and Exit Bootloader is still sent when Restart is set;
+// if a transaction was interrupted the device is left as it is.
+func (p *Programmer) Run(ctx context.Context) (*Result, error) {
+	return p.session.execute(ctx, p.run, p.Restart)
+}
+
+// execute runs a workflow, and sends Exit Bootloader with restart when it was
+// cancelled while the bootloader was idle.
+func (s *session) execute(ctx context.Context, run func(context.Context, *Result) error, restart func(context.Context) error) (*Result, error) {
+	start := time.Now()
+	res := &Result{}
+	defer func() { res.Duration = time.Since(start) }()
+
+	s.entered, s.idle = false, false
+
+	err := run(ctx, res)
+	if err != nil && ctx.Err() != nil {
+		res.Cancelled = true
+		if s.entered && s.idle && s.opts.Restart {
+			exitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), exitTimeout)
+			defer cancel()
+			if exitErr := restart(exitCtx); exitErr != nil {
+				err = errors.Join(err, exitErr)
+			}
+		}
+	}
+
+	return res, err
+}
+
+// checkpoint is called before each transaction and reports whether ctx is done.
+func (s *session) checkpoint(ctx context.Context, stage Stage) error {
+	if err := ctx.Err(); err != nil {
+		s.idle = true
+		return stageError(stage, err)
+	}
+	return nil
+}
+
+// checkGeometry makes sure the rows of the image fit the flash of the part it
+// targets. Images for parts missing from the database are not checked.
+func (s *session) checkGeometry(image cyacdParse.Image) error {
+	part, ok := s.opts.Parts.Lookup(image.SiliconID(), uint8(image.SiliconRev()))
+	if !ok {
+		return nil
+	}
+	if err := part.CheckImage(image); err != nil {
+		return fmt.Errorf("%w: %w", ErrImageGeometry, err)
+	}
+	return nil
+}
+
+// checkDevice reports the device entered and makes sure it is the one the
+// image was built for, or one the compatibility policy accepts for it.
+func (s *session) checkDevice(image cyacdParse.Image, info cybootloader_protocol.DeviceInfo) error {
+	device := s.opts.Parts.Describe(info.SiliconID, info.SiliconRev)
+	s.reporter.Report(Event{Type: EventDeviceIdentified, Device: info, Part: device})
+
+	if image.SiliconID() == info.SiliconID && image.SiliconRev() == uint32(info.SiliconRev) {
+		return nil
+	}
+
+	if rule, ok := s.opts.Compat.Allow(image.SiliconID(), uint8(image.SiliconRev()), info.SiliconID, info.SiliconRev); ok {
+		s.reporter.Report(Event{Type: EventDeviceAccepted, Device: info, Part: device, Rule: rule.String()})
+		return nil
+	}
+	return fmt.Errorf("%w: file targets %s, device is %s",
+		ErrDeviceMismatch, s.opts.Parts.Describe(image.SiliconID(), uint8(image.SiliconRev())), device)
+}
+
+func (p *Programmer) run(ctx context.Context, res *Result) error {
+	if p.opts.CheckImage {
+		if err := p.image.VerifyChecksums(); err != nil {
+			return stageError(StageImage, fmt.Errorf("%w: %w", ErrRecordChecksum, err))
+		}
+	}
+	if err := p.checkGeometry(p.image); err != nil {
+		return stageError(StageImage, err)
+	}
+
+	if err := p.checkpoint(ctx, StageEnter); err != nil {
+		return err
+	}
+
+	if err := p.enter(ctx, res); err != nil {
+		return err
+	}
+
+	if p.opts.App >= 0 {
+		statuses, err := p.appStatus(ctx)
+		if err != nil {
+			return err
+		}
+		res.AppStatusBefore = statuses
+		if statuses[p.opts.App].Active {
+			return stageError(StageAppStatus, fmt.Errorf("%w: app %d", ErrAppActive, p.opts.App))
+		}
+	}
+
+	if p.opts.Metadata {
+		if err := p.readMetadata(ctx, res); err != nil {
+			return err
+		}
+	}
+
+	rows := p.image.ParseRowData()
+	res.TotalRows = len(rows)
+
+	if err := p.checkRanges(ctx, rows); err != nil {
+		return err
+	}
+
+	if !p.opts.DryRun {
+		if err := p.program(ctx, rows, res); err != nil {
+			return err
+		}
+
+		if p.opts.Verify {
+			if err := p.verify(ctx, res); err != nil {
+				return err
+			}
+		}
+
+		if p.opts.App >= 0 {
+			if p.opts.SetActive && res.Verified {
+				if err := p.checkpoint(ctx, StageActivate); err != nil {
+					return err
+				}
+				p.reporter.Report(Event{Type: EventAppActivate, App: p.opts.App})
+				if err := p.host.SetActiveApp(ctx, byte(p.opts.App)); err != nil {
+					return stageError(StageActivate, err)
+				}
+			}
+
+			statuses, err := p.appStatus(ctx)
+			if err != nil {
+				return err
+			}
+			res.AppStatusAfter = statuses
+		}
+	}
+
+	if p.opts.Restart {
+		if err := p.checkpoint(ctx, StageExit); err != nil {
+			return err
+		}
+		if err := p.Restart(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// enter starts the bootloader session and checks the device matches the image.
+func (p *Programmer) enter(ctx context.Context, res *Result) error {
+	p.reporter.Report(Event{Type: EventBootloaderEnter})
+
+	info, err := p.host.EnterBootloader(ctx, p.opts.Key)
+	if err != nil {
+		return stageError(StageEnter, err)
+	}
+	res.Device = info
+	p.entered = true
+
+	return stageError(StageEnter, p.checkDevice(p.image, info))
+}
+
+// appStatus reads the state of every application slot.
+func (p *Programmer) appStatus(ctx context.Context) ([]cybootloader_protocol.AppStatus, error) {
+	statuses := make([]cybootloader_protocol.AppStatus, cybootloader_protocol.MaxApps)
+	for i := range statuses {
+		if err := p.checkpoint(ctx, StageAppStatus); err != nil {
+			return nil, err
+		}
+		status, err := p.host.GetAppStatus(ctx, byte(i))
+		if err != nil {
+			return nil, stageError(StageAppStatus, err)
+		}
+		statuses[i] = status
+		p.reporter.Report(Event{Type: EventAppStatus, App: i, AppStatus: status})
+	}
+	return statuses, nil
+}
+
+// readMetadata reads the metadata of the application slot from the device and
+// reports it with the metadata of the image. A bootloader built without the
+// Get Metadata command rejects it, which is reported but not fatal.
+func (p *Programmer) readMetadata(ctx context.Context, res *Result) error {
+	if err := p.checkpoint(ctx, StageMetadata); err != nil {
+		return err
+	}
+
+	app := max(p.opts.App, 0)
+	md, err := p.host.GetMetadata(ctx, byte(app))
+	var blErr *cybootloader_protocol.BootloaderError
+	if errors.As(err, &blErr) {
+		p.reporter.Report(Event{Type: EventMetadata, App: app, Err: err})
+		return nil
+	}
+	if err != nil {
+		return stageError(StageMetadata, err)
+	}
+	res.Metadata = &md
+
+	ev := Event{Type: EventMetadata, App: app, Metadata: &md}
+	if imageMD, err := p.image.Metadata(); err == nil {
+		ev.ImageMetadata = &imageMD
+	}
+	p.reporter.Report(ev)
+	return nil
+}
+
+// checkRanges makes sure every row fits the flash range of its array.
+func (p *Programmer) checkRanges(ctx context.Context, rows []*cyacdParse.Row) error {
+	sizes := make(map[uint8]cybootloader_protocol.FlashSize)
+
+	for _, r := range rows {
+		size, ok := sizes[r.ArrayID()]
+		if !ok {
+			if err := p.checkpoint(ctx, StageFlashSize); err != nil {
+				return err
+			}
+			var err error
+			size, err = p.host.GetFlashSize(ctx, r.ArrayID())
+			if err != nil {
+				return stageError(StageFlashSize, err)
+			}
+			sizes[r.ArrayID()] = size
+		}
+
+		if r.RowNum() < size.StartRow || r.RowNum() > size.EndRow {
+			return stageError(StageFlashSize, fmt.Errorf("%w: array %d row %d, device rows %d-%d",
+				ErrRowOutOfRange, r.ArrayID(), r.RowNum(), size.StartRow, size.EndRow))
+		}
+	}
+
+	return nil
+}
+
+// program writes every row of the image.
+func (p *Programmer) program(ctx context.Context, rows []*cyacdParse.Row, res *Result) error {
+	p.reporter.Report(Event{Type: EventProgrammingStart, TotalRows: len(rows)})
+
+	for i, r := range rows {
+		if err := p.checkpoint(ctx, StageProgram); err != nil {
+			return err
+		}
+		if err := p.programRowWithRetry(ctx, r, res); err != nil {
+			return stageError(StageProgram, err)
+		}
+		res.RowsProgrammed++
+		p.reporter.Report(Event{Type: EventRowProgrammed, Row: r, RowIndex: i, TotalRows: len(rows)})
+	}
+
+	p.reporter.Report(Event{Type: EventProgrammingComplete, TotalRows: len(rows)})
+	return nil
+}
+
+// programRowWithRetry programs a row and, when the transfer fails with a
+// recoverable error, resynchronises with the bootloader and sends the whole
+// row again, up to Retries times.
+func (p *Programmer) programRowWithRetry(ctx context.Context, r *cyacdParse.Row, res *Result) error {
+	for attempt := 0; ; attempt++ {
+		err := p.programRow(ctx, r)
+		if err == nil || ctx.Err() != nil || attempt >= p.opts.Retries || !cybootloader_protocol.IsRecoverable(err) {
+			return err
+		}
+
+		res.Resyncs++
+		p.reporter.Report(Event{Type: EventProgrammingResync, Row: r, Attempt: attempt + 1, Err: err})
+
+		if err := p.host.Sync(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// programRow programs a row and checks the checksum reported by the device.
+func (p *Programmer) programRow(ctx context.Context, r *cyacdParse.Row) error {
+	if err := p.host.ProgramRow(ctx, r.ArrayID(), r.RowNum(), r.Data()); err != nil {
+		return err
+	}
+
+	checksum := r.DeviceChecksum()
+
+	checksumDevice, err := p.host.GetRowChecksum(ctx, r.ArrayID(), r.RowNum())
+	if err != nil {
+		return err
+	}
+
+	if checksum != checksumDevice {
+		return fmt.Errorf("%w: row %d expected 0x%02x, device reported 0x%02x", ErrRowChecksum, r.RowNum(), checksum, checksumDevice)
+	}
+
+	return nil
+}
+
+// verify asks the device to check the application checksum.
+func (p *Programmer) verify(ctx context.Context, res *Result) error {
+	if err := p.checkpoint(ctx, StageVerify); err != nil {
+		return err
+	}
+
+	checksum, err := p.host.VerifyAppChecksum(ctx)
+	if err != nil {
+		return stageError(StageVerify, err)
+	}
+	res.AppChecksum = checksum
+	res.ImageChecksum = p.image.AppChecksum()
+	res.Verified = checksum != 0
+
+	p.reporter.Report(Event{Type: EventVerificationComplete, AppChecksum: checksum, ImageChecksum: res.ImageChecksum})
+
+	if !res.Verified {
+		return stageError(StageVerify, ErrAppInvalid)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package flasher_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"bootloader-usb/cyacdParse"
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/flasher"
+	"bootloader-usb/simulator"
+)
+
+var testKey = []byte{0x0A, 0x1B, 0x2C, 0x3D, 0x4E, 0x5F}
+
+// testImage builds a .cyacd image of rows of 128 bytes for the CY8C4245AXI
+// of the CY8CKIT-049, after a bootloader of 32 rows. The last row holds
+// metadata recording the application length and checksum.
+func testImage(t *testing.T, checksumType cybootloader_protocol.ChecksumType, rows int) *cyacdParse.Cyacd {
+	t.Helper()
+
+	const rowSize = 128
+	layout := cyacdParse.Layout{
+		SiliconID:     0x04C81193,
+		SiliconRev:    0x11,
+		ChecksumType:  checksumType,
+		RowSize:       rowSize,
+		RowsPerArray:  256,
+		BootloaderEnd: 32 * rowSize,
+	}
+
+	data := make([]byte, rows*rowSize)
+	app := data[:len(data)-rowSize]
+	for i := range app {
+		app[i] = byte(i*13 + i/rowSize)
+	}
+	md := data[len(data)-cybootloader_protocol.MetadataRowSize:]
+	binary.LittleEndian.PutUint32(md[0x0B:], uint32(len(app)))
+	md[0x00] = cyacdParse.DataChecksum(app)
+
+	image, err := cyacdParse.FromBinary(data, layout.BootloaderEnd, layout, "test.cyacd")
+	if err != nil {
+		t.Fatalf("FromBinary: %v", err)
+	}
+	return image
+}
+
+// checkFlash makes sure every row of image was programmed into sim.
+func checkFlash(t *testing.T, sim *simulator.Target, image *cyacdParse.Cyacd) {
+	t.Helper()
+
+	for _, r := range image.ParseRowData() {
+		if got := sim.Row(r.ArrayID(), r.RowNum()); !bytes.Equal(got, r.Data()) {
+			t.Errorf("array %d row %d holds % X, want % X", r.ArrayID(), r.RowNum(), got, r.Data())
+		}
+	}
+}
+
+func TestProgram(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum cybootloader_protocol.ChecksumType
+	}{
+		{"sum", cybootloader_protocol.ChecksumSum},
+		{"crc16", cybootloader_protocol.ChecksumCRC16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := testImage(t, tt.checksum, 8)
+			sim := simulator.New(simulator.ConfigForImage(image, testKey))
+
+			opts := flasher.DefaultOptions()
+			opts.Key = testKey
+			p, err := flasher.New(image, sim, opts)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			res, err := p.Run(context.Background())
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if res.TotalRows != 8 || res.RowsProgrammed != 8 || res.Resyncs != 0 || !res.Verified {
+				t.Errorf("Result = %+v", res)
+			}
+			if res.Device.SiliconID != image.SiliconID() {
+				t.Errorf("device silicon ID = 0x%08X, want 0x%08X", res.Device.SiliconID, image.SiliconID())
+			}
+			if n := sim.RowsProgrammed(); n != 8 {
+				t.Errorf("device has %d rows programmed, want 8", n)
+			}
+			if !sim.Exited() {
+				t.Error("bootloader was not exited")
+			}
+			checkFlash(t, sim, image)
+		})
+	}
+}
+
+func TestProgramWithoutKey(t *testing.T) {
+	image := testImage(t, cybootloader_protocol.ChecksumCRC16, 2)
+	sim := simulator.New(simulator.ConfigForImage(image, nil))
+
+	p, err := flasher.New(image, sim, flasher.DefaultOptions())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	checkFlash(t, sim, image)
+}
+
+func TestProgramWrongKey(t *testing.T) {
+	image := testImage(t, cybootloader_protocol.ChecksumSum, 2)
+	sim := simulator.New(simulator.ConfigForImage(image, testKey))
+
+	opts := flasher.DefaultOptions()
+	opts.Key = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	p, err := flasher.New(image, sim, opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	_, err = p.Run(context.Background())
+	var ferr *flasher.Error
+	if !errors.As(err, &ferr) || ferr.Stage != flasher.StageEnter || !errors.Is(err, cybootloader_protocol.StatusErrKey) {
+		t.Errorf("Run error = %v, want CYRET_ERR_KEY on entering the bootloader", err)
+	}
+	if n := sim.RowsProgrammed(); n != 0 {
+		t.Errorf("device has %d rows programmed, want 0", n)
+	}
+}
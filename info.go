@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bootloader-usb/cyacdParse"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// imageInfo is the description of a firmware file printed by the info
+// subcommand. Fields that do not apply to the format of the file are left out.
+type imageInfo struct {
+	File         string `json:"file"`
+	Format       string `json:"format"`
+	SHA256       string `json:"sha256"`
+	SiliconID    string `json:"silicon_id"`
+	SiliconRev   string `json:"silicon_rev"`
+	Part         string `json:"part,omitempty"`
+	Family       string `json:"family,omitempty"`
+	ChecksumType string `json:"checksum_type"`
+	Rows         int    `json:"rows"`
+	PayloadBytes int    `json:"payload_bytes"`
+
+	// Application checksum computed from the file, or why it cannot be
+	AppChecksum      string `json:"app_checksum,omitempty"`
+	AppChecksumError string `json:"app_checksum_error,omitempty"`
+
+	// .cyacd files
+	Arrays           []cyacdParse.ArrayUsage `json:"arrays,omitempty"`
+	MetadataChecksum string                  `json:"metadata_checksum,omitempty"`
+	AppVersion       string                  `json:"app_version,omitempty"`
+	AppCustomID      string                  `json:"app_custom_id,omitempty"`
+
+	// .cyacd2 files
+	AppID        *uint8 `json:"app_id,omitempty"`
+	ProductID    string `json:"product_id,omitempty"`
+	AppStart     string `json:"app_start,omitempty"`
+	AppLength    string `json:"app_length,omitempty"`
+	FirstAddress string `json:"first_address,omitempty"`
+	EndAddress   string `json:"end_address,omitempty"`
+}
+
+// runInfo describes a firmware file without touching any device.
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	in := fs.String("in", "", "Path for the firmware file, optionally gzip compressed. - reads the file from stdin")
+	format := fs.String("format", "text", "Output format: text or json")
+	partsFile := fs.String("parts", "", "JSON file adding parts to the built-in silicon ID table")
+	fs.Parse(args)
+
+	if *in == "" {
+		fs.PrintDefaults()
+		return validationError("In is required.")
+	}
+	if *format != "text" && *format != "json" {
+		return wrapError(fmt.Errorf("unknown format %q", *format), "Invalid output format", ErrorCodeParamValidation)
+	}
+
+	var data []byte
+	var err error
+	name := *in
+	if *in == "-" {
+		name = "stdin"
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*in)
+	}
+	if err != nil {
+		return wrapError(err, "Error reading file", ErrorCodeParamValidation)
+	}
+
+	image, err := cyacdParse.LoadBytes(data, name)
+	if err != nil {
+		return wrapError(err, "Error parsing file", ErrorCodeParamValidation)
+	}
+
+	sum := sha256.Sum256(data)
+	info := describeImage(image)
+	parts, err := loadParts(*partsFile)
+	if err != nil {
+		return err
+	}
+	if part, ok := parts.Lookup(image.SiliconID(), uint8(image.SiliconRev())); ok {
+		info.Part = part.Name
+		info.Family = string(part.Family)
+	}
+	info.SHA256 = hex.EncodeToString(sum[:])
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(info)
+	} else {
+		err = printImageInfo(os.Stdout, info)
+	}
+	return wrapError(err, "Error writing file information", ErrorCodeParamValidation)
+}
+
+func describeImage(image cyacdParse.Image) imageInfo {
+	info := imageInfo{
+		File:         image.Path(),
+		Format:       string(image.Format()),
+		SiliconID:    fmt.Sprintf("0x%08X", image.SiliconID()),
+		SiliconRev:   fmt.Sprintf("0x%02X", image.SiliconRev()),
+		ChecksumType: image.ChecksumType().String(),
+	}
+
+	switch f := image.(type) {
+	case *cyacdParse.Cyacd:
+		info.Rows = len(f.ParseRowData())
+		info.PayloadBytes = f.PayloadSize()
+		info.Arrays = f.Arrays()
+		info.AppChecksum = fmt.Sprintf("0x%02X", f.AppChecksum())
+		if md, err := f.Metadata(); err == nil {
+			info.MetadataChecksum = fmt.Sprintf("0x%02X", md.Checksum)
+			info.AppVersion = md.AppVersion.String()
+			info.AppCustomID = fmt.Sprintf("0x%08X", md.CustomID)
+		}
+	case *cyacdParse.Cyacd2:
+		appID := f.AppID()
+		info.AppID = &appID
+		info.ProductID = fmt.Sprintf("0x%08X", f.ProductID())
+		if app := f.AppInfo(); app != nil {
+			info.AppStart = fmt.Sprintf("0x%08X", app.StartAddress)
+			info.AppLength = fmt.Sprintf("0x%08X", app.Length)
+		}
+		if sum, err := f.AppChecksum(); err == nil {
+			info.AppChecksum = fmt.Sprintf("0x%08X", sum)
+		} else {
+			info.AppChecksumError = err.Error()
+		}
+
+		rows := f.Rows()
+		info.Rows = len(rows)
+		info.PayloadBytes = f.PayloadSize()
+		if len(rows) > 0 {
+			first, end := rows[0].Address(), rows[0].Address()
+			for _, r := range rows {
+				first = min(first, r.Address())
+				end = max(end, r.Address()+uint32(len(r.Data())))
+			}
+			info.FirstAddress = fmt.Sprintf("0x%08X", first)
+			info.EndAddress = fmt.Sprintf("0x%08X", end)
+		}
+	}
+	return info
+}
+
+func printImageInfo(w io.Writer, info imageInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "File:\t%s\n", info.File)
+	fmt.Fprintf(tw, "Format:\t%s\n", info.Format)
+	fmt.Fprintf(tw, "SHA-256:\t%s\n", info.SHA256)
+	fmt.Fprintf(tw, "Silicon ID:\t%s\n", info.SiliconID)
+	fmt.Fprintf(tw, "Silicon rev:\t%s\n", info.SiliconRev)
+	if info.Part != "" {
+		fmt.Fprintf(tw, "Part:\t%s (%s)\n", info.Part, info.Family)
+	}
+	fmt.Fprintf(tw, "Checksum type:\t%s\n", info.ChecksumType)
+	if info.AppID != nil {
+		fmt.Fprintf(tw, "App ID:\t%d\n", *info.AppID)
+		fmt.Fprintf(tw, "Product ID:\t%s\n", info.ProductID)
+	}
+	if info.AppStart != "" {
+		fmt.Fprintf(tw, "App info:\tstart %s, length %s\n", info.AppStart, info.AppLength)
+	}
+	fmt.Fprintf(tw, "Rows:\t%d\n", info.Rows)
+	if info.Format == string(cyacdParse.FormatCyacd) {
+		fmt.Fprintf(tw, "Arrays:\t%d\n", len(info.Arrays))
+		for _, a := range info.Arrays {
+			ranges := make([]string, len(a.Ranges))
+			for i, r := range a.Ranges {
+				ranges[i] = r.String()
+			}
+			fmt.Fprintf(tw, "  Array %d:\t%d rows: %s\n", a.ArrayID, a.Rows, strings.Join(ranges, ", "))
+		}
+	}
+	if info.FirstAddress != "" {
+		fmt.Fprintf(tw, "Addresses:\t%s-%s\n", info.FirstAddress, info.EndAddress)
+	}
+	fmt.Fprintf(tw, "Payload bytes:\t%d\n", info.PayloadBytes)
+	if info.MetadataChecksum != "" {
+		fmt.Fprintf(tw, "App checksum:\t%s, metadata %s\n", info.AppChecksum, info.MetadataChecksum)
+	} else if info.AppChecksum != "" {
+		fmt.Fprintf(tw, "App checksum:\t%s\n", info.AppChecksum)
+	} else if info.AppChecksumError != "" {
+		fmt.Fprintf(tw, "App checksum:\tnot available, %s\n", info.AppChecksumError)
+	}
+	if info.AppVersion != "" {
+		fmt.Fprintf(tw, "App version:\t%s, custom ID %s\n", info.AppVersion, info.AppCustomID)
+	}
+	return tw.Flush()
+}
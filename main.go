@@ -3,8 +3,13 @@ package main
 import (
 	"bootloader-usb/cyacdParse"
 	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/flasher"
+	"bootloader-usb/silicon"
+	"bootloader-usb/simulator"
+	"bootloader-usb/transport"
 	"bootloader-usb/uart"
 	"bootloader-usb/usb"
+	"context"
 	"encoding/hex"
 	"errors"
 	"flag"
@@ -12,7 +17,9 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -20,8 +27,9 @@ const (
 	ModeSerial = "serial"
 	ModeUSB    = "usb"
 	ModeHID    = "hid"
+	ModeSim    = "sim"
+	ModeReplay = "replay"
 
-	PacketSize = 64
 	AppVersion = "1.0.0"
 
 	// Event type constants
@@ -29,17 +37,41 @@ const (
 	EventProcessComplete = "process.complete"
 
 	// Bootloader communication events
-	EventBootloaderEnter = "bootloader.enter"
-	EventBootloaderExit  = "bootloader.exit"
+	EventBootloaderEnter  = "bootloader.enter"
+	EventBootloaderExit   = "bootloader.exit"
+	EventDeviceIdentified = "device.identified"
+	EventDeviceAccepted   = "device.accepted"
+	EventDeviceSimulated  = "device.simulated"
 
 	// Programming events
 	EventProgrammingStart    = "programming.start"
 	EventProgrammingProgress = "programming.progress"
 	EventProgrammingComplete = "programming.complete"
+	EventProgrammingResync   = "programming.resync"
 
 	// Verification events
 	EventVerificationComplete = "verification.complete"
 
+	// Multi application events
+	EventAppStatus   = "app.status"
+	EventAppActivate = "app.activate"
+	EventAppMetadata = "app.metadata"
+
+	// Fault injection events
+	EventFaultInjected = "fault.injected"
+
+	// Frame capture events
+	EventFrame  = "transport.frame"
+	EventReplay = "transport.replay"
+
+	// Firmware file events
+	EventFileChecksum = "file.checksum"
+	EventFileTarget   = "file.target"
+	EventFilePolicy   = "file.policy"
+
+	// File editing events
+	EventPatchApplied = "patch.applied"
+
 	// Error events
 	EventError           = "error"
 	EventValidationError = "error.validation"
@@ -52,13 +84,78 @@ const (
 	ErrorCodeDeviceMismatch   = "ERR_DEVICE_MISMATCH"
 	ErrorCodeOutOfRange       = "ERR_OUT_OF_RANGE"
 	ErrorCodeChecksumMismatch = "ERR_CHECKSUM_MISMATCH"
+	ErrorCodePacketChecksum   = "ERR_PACKET_CHECKSUM"
+	ErrorCodeCancelled        = "ERR_CANCELLED"
+	ErrorCodeFileChecksum     = "ERR_FILE_CHECKSUM"
+
+	// Error codes reported by the bootloader itself
+	ErrorCodeBootloaderKey      = "ERR_BOOTLOADER_KEY"
+	ErrorCodeBootloaderVerify   = "ERR_BOOTLOADER_VERIFY"
+	ErrorCodeBootloaderLength   = "ERR_BOOTLOADER_LENGTH"
+	ErrorCodeBootloaderData     = "ERR_BOOTLOADER_DATA"
+	ErrorCodeBootloaderCommand  = "ERR_BOOTLOADER_COMMAND"
+	ErrorCodeBootloaderDevice   = "ERR_BOOTLOADER_DEVICE"
+	ErrorCodeBootloaderVersion  = "ERR_BOOTLOADER_VERSION"
+	ErrorCodeBootloaderChecksum = "ERR_BOOTLOADER_CHECKSUM"
+	ErrorCodeBootloaderArray    = "ERR_BOOTLOADER_ARRAY"
+	ErrorCodeBootloaderRow      = "ERR_BOOTLOADER_ROW"
+	ErrorCodeBootloaderProtect  = "ERR_BOOTLOADER_PROTECT"
+	ErrorCodeBootloaderApp      = "ERR_BOOTLOADER_APP"
+	ErrorCodeBootloaderActive   = "ERR_BOOTLOADER_ACTIVE"
+	ErrorCodeBootloaderUnknown  = "ERR_BOOTLOADER_UNKNOWN"
 )
 
+// bootloaderErrorCodes maps the status reported by the bootloader to the
+// error code logged by this tool.
+var bootloaderErrorCodes = map[cybootloader_protocol.Status]string{
+	cybootloader_protocol.StatusErrKey:      ErrorCodeBootloaderKey,
+	cybootloader_protocol.StatusErrVerify:   ErrorCodeBootloaderVerify,
+	cybootloader_protocol.StatusErrLength:   ErrorCodeBootloaderLength,
+	cybootloader_protocol.StatusErrData:     ErrorCodeBootloaderData,
+	cybootloader_protocol.StatusErrCmd:      ErrorCodeBootloaderCommand,
+	cybootloader_protocol.StatusErrDevice:   ErrorCodeBootloaderDevice,
+	cybootloader_protocol.StatusErrVersion:  ErrorCodeBootloaderVersion,
+	cybootloader_protocol.StatusErrChecksum: ErrorCodeBootloaderChecksum,
+	cybootloader_protocol.StatusErrArray:    ErrorCodeBootloaderArray,
+	cybootloader_protocol.StatusErrRow:      ErrorCodeBootloaderRow,
+	cybootloader_protocol.StatusErrProtect:  ErrorCodeBootloaderProtect,
+	cybootloader_protocol.StatusErrApp:      ErrorCodeBootloaderApp,
+	cybootloader_protocol.StatusErrActive:   ErrorCodeBootloaderActive,
+	cybootloader_protocol.StatusErrUnknown:  ErrorCodeBootloaderUnknown,
+}
+
+// flasherErrorCodes maps the errors detected by the programming workflow to
+// the error code logged by this tool. The first entry matching an error
+// applies, so that an error wrapping several sentinels always gets the same
+// code.
+var flasherErrorCodes = []struct {
+	err  error
+	code string
+}{
+	{flasher.ErrDeviceMismatch, ErrorCodeDeviceMismatch},
+	{flasher.ErrRowOutOfRange, ErrorCodeOutOfRange},
+	{flasher.ErrRowChecksum, ErrorCodeChecksumMismatch},
+	{flasher.ErrAppInvalid, ErrorCodeChecksumMismatch},
+	{flasher.ErrAppActive, ErrorCodeBootloaderActive},
+	{flasher.ErrRecordChecksum, ErrorCodeFileChecksum},
+}
+
+// stageErrorCodes maps the failed step of the programming workflow to the
+// error code logged when the error has no more specific code.
+var stageErrorCodes = map[flasher.Stage]string{
+	flasher.StageImage:     ErrorCodeParamValidation,
+	flasher.StageEnter:     ErrorCodeCommunication,
+	flasher.StageAppStatus: ErrorCodeCommunication,
+	flasher.StageFlashSize: ErrorCodeCommunication,
+	flasher.StageProgram:   ErrorCodeProgramming,
+	flasher.StageMetadata:  ErrorCodeProgramming,
+	flasher.StageVerify:    ErrorCodeChecksumMismatch,
+	flasher.StageActivate:  ErrorCodeProgramming,
+	flasher.StageExit:      ErrorCodeCommunication,
+}
+
 var (
-	peripheral  io.ReadWriteCloser
-	readBuf     []byte
-	globalError bool
-	processID   string
+	processID string
 )
 
 func init() {
@@ -97,17 +194,69 @@ func logEvent(level slog.Level, eventType string, message string, attrs ...any)
 	}
 }
 
+// subcommands are the file tools run as "bootloader-usb <command> [flags]".
+// Without a subcommand the tool programs a device.
+var subcommands = map[string]func(args []string) error{
+	"patch":   runPatch,
+	"convert": runConvert,
+	"export":  runExport,
+	"info":    runInfo,
+}
+
 func main() {
+	run, args := runProgram, os.Args[1:]
+	if len(os.Args) > 1 {
+		if sub, ok := subcommands[os.Args[1]]; ok {
+			run, args = sub, os.Args[2:]
+		}
+	}
+
+	// the process only exits here, once the deferred cleanups have run
+	if err := run(args); err != nil {
+		logError(err)
+		os.Exit(1)
+	}
+}
+
+// runProgram programs a device with a firmware file.
+func runProgram(args []string) (err error) {
 	startTime := time.Now()
 
-	filePath := flag.String("path", "", "Path for the .cyacd file")
+	filePath := flag.String("path", "", "Path for the .cyacd or .cyacd2 file, optionally gzip compressed. - reads the file from stdin")
 	serial := flag.String("serial", "", "Serial for the device. Required for USB and HID communication")
 	port := flag.String("port", "", "Port for the communication. Example: /dev/ttyACM0. Only required for serial communication")
-	mode := flag.String("mode", "", "Mode of communication: usb, serial, or hid")
-	key := flag.String("key", "", "Bootloader key")
+	mode := flag.String("mode", "", "Mode of communication: usb, serial, hid, sim (in-memory simulated device), or replay (play back a capture)")
+	key := flag.String("key", "", "Bootloader key, 6 bytes in hex. Required for .cyacd files")
 	restart := flag.Bool("restart", false, "Restart the device after programming")
+	app := flag.Int("app", -1, "Application slot to program on a multi app bootloader (0 or 1). -1 for a single app bootloader")
+	setActive := flag.Bool("set-active", false, "Mark the programmed application as active after a successful verification. Requires -app")
+	verify := flag.Bool("verify", true, "Verify the application checksum after programming")
+	checkRecords := flag.Bool("check-records", true, "Refuse to program a file whose records fail their checksum")
+	dryRun := flag.Bool("dry-run", false, "Check the device and the file without programming")
+	metadata := flag.Bool("metadata", false, "Read the application metadata of the device with Get Metadata and report its version next to the version of the file")
+	retries := flag.Int("retries", 3, "Number of times a row is retried after resynchronising with the bootloader")
+	timeout := flag.Duration("timeout", 0, "Maximum duration of the whole process, e.g. 2m. 0 for no limit")
+	record := flag.String("record", "", "Record every frame exchanged with the device to this capture file")
+	replay := flag.String("replay", "", "Capture file played back by the replay mode")
+	partsFile := flag.String("parts", "", "JSON file adding parts to the built-in silicon ID table")
+	compatFile := flag.String("compat", "", "JSON compatibility policy listing the devices accepted for the file. Defaults to <path>.compat.json when it exists")
+	var accept []silicon.Pattern
+	flag.Func("accept", "Accept a device whose silicon differs from the file, as ID:REV with * as wildcard, e.g. 0x04A61193:*. May be repeated", func(s string) error {
+		p, err := silicon.ParsePattern(s)
+		if err != nil {
+			return err
+		}
+		accept = append(accept, p)
+		return nil
+	})
+	frameLog := flag.Bool("frame-log", false, "Log a hex dump of every frame exchanged with the device")
 
-	flag.Parse()
+	// testing only, not listed in the usage
+	fault := flag.String("fault", "", "Fault injection schedule, e.g. action=bitflip,cmd=ProgramRow,nth=3")
+	faultSeed := flag.Int64("fault-seed", 1, "Seed for random fault injection")
+
+	flag.Usage = printUsage
+	flag.CommandLine.Parse(args)
 
 	// Log application start with version and configuration
 	logEvent(slog.LevelInfo, EventProcessStart, "Bootloader USB process started",
@@ -116,261 +265,445 @@ func main() {
 		"file", *filePath)
 
 	defer func(s time.Time) {
-		elapsedTime := time.Since(s)
-		logEvent(slog.LevelInfo, EventProcessComplete, "Process completed", "duration", elapsedTime.String())
+		if err == nil {
+			elapsedTime := time.Since(s)
+			logEvent(slog.LevelInfo, EventProcessComplete, "Process completed", "duration", elapsedTime.String())
+		}
 	}(startTime)
 
-	defer func() {
-		if globalError {
-			logEvent(slog.LevelError, EventError, "There was an error during the programming of the device",
-				"error_code", ErrorCodeProgramming)
-			os.Exit(1)
+	if err := validateParams(*mode, *filePath, *port, *serial); err != nil {
+		return err
+	}
+	if err := validateReplayParams(*mode, *replay); err != nil {
+		return err
+	}
+	if err := validateAppParams(*app, *setActive); err != nil {
+		return err
+	}
+
+	schedule, err := transport.ParseSchedule(*fault)
+	if err != nil {
+		return wrapError(err, "Error parsing fault schedule", ErrorCodeParamValidation)
+	}
+
+	// parse the file
+	image, err := loadImage(*filePath)
+	if err != nil {
+		return wrapError(err, "Error parsing file", ErrorCodeParamValidation)
+	}
+	logRecordChecksums(image)
+
+	// parse the key, which only the legacy protocol uses
+	if err := validateKey(image, *key); err != nil {
+		return err
+	}
+	var bootloaderKeyHex []byte
+	if *key != "" {
+		bootloaderKeyHex, err = hex.DecodeString(*key)
+		if err != nil {
+			return wrapError(err, "Error parsing key", ErrorCodeParamValidation)
 		}
-	}()
+	}
 
-	validateParams(*mode, *filePath, *port, *key, *serial)
+	parts, err := loadParts(*partsFile)
+	if err != nil {
+		return err
+	}
+	logFileTarget(parts, image)
+	compat, err := loadCompatPolicy(*compatFile, *filePath, accept)
+	if err != nil {
+		return err
+	}
 
-	// parse the key
-	bootloaderKeyHex, err := hex.DecodeString(*key)
-	checkError(err, "Error parsing key", ErrorCodeParamValidation)
+	// Ctrl-C stops the programming after the current transaction
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
 
-	// parse the file
-	f, err := cyacdParse.NewCyacd(*filePath)
-	checkError(err, "Error parsing file", ErrorCodeParamValidation)
+	opts := flasher.DefaultOptions()
+	opts.Key = bootloaderKeyHex
+	opts.Verify = *verify
+	opts.CheckImage = *checkRecords
+	opts.DryRun = *dryRun
+	opts.Metadata = *metadata
+	opts.Retries = *retries
+	opts.App = *app
+	opts.SetActive = *setActive
+	opts.Reporter = &logReporter{}
+	opts.Parts = parts
+	opts.Compat = compat
 
 	// initialize the communication method
-	switch strings.ToLower(*mode) {
-	case ModeSerial:
-		devSerial, err := uart.NewDevice(*port)
-		checkError(err, "Error creating device", ErrorCodeDeviceNotFound)
-		peripheral = io.ReadWriteCloser(devSerial)
-		break
-	case ModeUSB:
-		devUSB, err := usb.FindDevice(*serial)
-		checkError(err, "Error finding device", ErrorCodeDeviceNotFound)
+	var peripheral io.ReadWriteCloser
+	switch *mode {
+	case ModeSim:
+		cfg := simulatorConfig(image, bootloaderKeyHex)
+		logEvent(slog.LevelInfo, EventDeviceSimulated, "Using simulated device", "device", cfg.String())
+		peripheral = simulator.New(cfg)
+	case ModeReplay:
+		peripheral, err = openReplay(*replay)
+	default:
+		peripheral, err = openPeripheral(ctx, *mode, *port, *serial)
+	}
+	if err != nil {
+		return err
+	}
 
-		if devUSB == nil {
-			logEvent(slog.LevelError, EventError, "Device not found",
-				"error_code", ErrorCodeDeviceNotFound)
-			os.Exit(1)
-		} else {
-			err = devUSB.Init()
-			checkError(err, "Error initializing USB device", ErrorCodeDeviceNotFound)
-			peripheral = io.ReadWriteCloser(devUSB)
+	if len(schedule) > 0 {
+		injector := transport.NewFaultInjector(peripheral, schedule, *faultSeed)
+		injector.OnInject(func(inj transport.Injection) {
+			logEvent(slog.LevelWarn, EventFaultInjected, "Injected transport fault", "fault", inj.String())
+		})
+		peripheral = injector
+	}
+
+	if *record != "" || *frameLog {
+		var captureFile io.Writer = io.Discard
+		if *record != "" {
+			file, err := os.Create(*record)
+			if err != nil {
+				peripheral.Close()
+				return wrapError(err, "Error creating capture file", ErrorCodeParamValidation)
+			}
+			defer file.Close()
+			captureFile = file
 		}
-		break
-	case ModeHID:
-		devHID, err := usb.FindHIDDevice(*serial)
-		checkError(err, "Error finding HID device", ErrorCodeDeviceNotFound)
 
-		if devHID == nil {
-			logEvent(slog.LevelError, EventError, "HID device not found",
-				"error_code", ErrorCodeDeviceNotFound)
-			os.Exit(1)
-		} else {
-			err = devHID.Init()
-			checkError(err, "Error initializing HID device", ErrorCodeDeviceNotFound)
-			peripheral = io.ReadWriteCloser(devHID)
+		recorder := transport.NewRecorder(peripheral, captureFile)
+		if *frameLog {
+			recorder.OnFrame(func(rec transport.Record) {
+				logEvent(slog.LevelDebug, EventFrame, "Frame", "frame", rec.String())
+			})
 		}
-		break
+		peripheral = recorder
 	}
 
-	if *restart {
-		frame := cybootloader_protocol.CreateExitBootloaderCmd()
-		writePeripheral(frame)
-		return
+	// the peripheral is closed on every path, a failure to close it only
+	// matters when everything else succeeded
+	defer func() {
+		if closeErr := peripheral.Close(); err == nil {
+			err = wrapError(closeErr, "Error closing peripheral", ErrorCodeCommunication)
+		}
+	}()
+
+	// the workflow follows the format of the file
+	programmer, err := flasher.NewForImage(image, peripheral, opts)
+	if err != nil {
+		return wrapError(err, "Error creating programmer", ErrorCodeParamValidation)
 	}
 
-	frame, err := cybootloader_protocol.CreateEnterBootloaderCmd(bootloaderKeyHex)
-	checkError(err, "Error creating frame", ErrorCodeCommunication)
+	if *restart {
+		return wrapError(programmer.Restart(ctx), "Error writing frame", ErrorCodeCommunication)
+	}
 
-	logEvent(slog.LevelInfo, EventBootloaderEnter, "Enter bootloader", "phase", "initialization")
+	result, err := programmer.Run(ctx)
+	if result.Cancelled {
+		return wrapError(err, "Programming cancelled", ErrorCodeCancelled)
+	}
+	if err != nil {
+		return wrapError(err, "Error programming device", ErrorCodeProgramming)
+	}
 
-	transactionPeripheral(frame)
-	val, err := cybootloader_protocol.ParseEnterBootloaderCmdResult(readBuf)
-	checkError(err, "Error parsing frame", ErrorCodeCommunication)
+	if *dryRun {
+		logEvent(slog.LevelInfo, EventProcessComplete, "Dry run completed, device and file are compatible",
+			"status", "success",
+			"phase", "completion",
+			"total_rows", result.TotalRows)
+	} else if result.Verified {
+		logEvent(slog.LevelInfo, EventProcessComplete, "Device was successfully programmed",
+			"status", "success",
+			"phase", "completion",
+			"rows", result.RowsProgrammed,
+			"resyncs", result.Resyncs)
+	}
+	return nil
+}
 
-	if val != nil {
-		if f.SiliconID() != val["siliconID"] || f.SiliconRev() != val["siliconRev"] {
-			checkError(errors.New("[ERROR] The expected device does not match the detected device"), "Device mismatch error", ErrorCodeDeviceMismatch)
-		} else {
-			var start, end uint16
+// loadImage parses the firmware file, or stdin when path is "-".
+func loadImage(path string) (cyacdParse.Image, error) {
+	if path == "-" {
+		return cyacdParse.LoadReader(os.Stdin, "stdin")
+	}
+	return cyacdParse.Load(path)
+}
 
-			err, start, end = cybootloader_protocol.GetFlashSize(peripheral)
-			if err != nil {
-				checkError(errors.New("[ERROR] Error reading Flash size"), "Error reading Flash size", ErrorCodeCommunication)
-			}
-			rows := f.ParseRowData()
-			totalRows := len(rows)
-			var lastReportedProgress int = 0
-
-			logEvent(slog.LevelInfo, EventProgrammingStart, "Starting programming process",
-				"phase", "programming",
-				"progress", 0,
-				"total_rows", totalRows)
-
-			for i, r := range rows {
-				progress := float64(i+1) / float64(totalRows)
-				currentProgressPercent := int(progress * 100)
-
-				// Report progress at 10% intervals
-				if currentProgressPercent/10 > lastReportedProgress/10 {
-					lastReportedProgress = currentProgressPercent
-					logEvent(slog.LevelInfo, EventProgrammingProgress, "Programming progress",
-						"phase", "programming",
-						"progress", currentProgressPercent,
-						"current_row", i+1,
-						"total_rows", totalRows)
-				}
-
-				if r.RowNum() < start || r.RowNum() > end {
-					checkError(errors.New("[ERROR] The row number is out of range"), "Row number out of range error", ErrorCodeOutOfRange)
-				}
-				result := true
-				offset := uint16(0)
-				for result && (r.Size()-offset+7) > PacketSize {
-					subBufSize := uint16(PacketSize - 7)
-
-					frame = cybootloader_protocol.CreateSendDataCmd(r.Data()[offset : offset+subBufSize])
-					transactionPeripheral(frame)
-
-					result = cybootloader_protocol.ParseSendDataCmdResult(readBuf)
-					offset += subBufSize
-				}
-
-				if result {
-					subBufSize := r.Size() - offset
-
-					frame = cybootloader_protocol.CreateProgramRowCmd(r.Data()[offset:offset+subBufSize], r.ArrayID(), r.RowNum())
-					transactionPeripheral(frame)
-
-					if cybootloader_protocol.ParseProgramRowCmdResult(readBuf) {
-						// log.Info("Row flashed")
-						checksum := r.Checksum() + r.ArrayID() + byte(r.RowNum()>>8) + byte(r.RowNum()) + byte(r.Size()) + byte(r.Size()>>8)
-
-						frame = cybootloader_protocol.CreateGetRowChecksumCmd(r.ArrayID(), r.RowNum())
-						transactionPeripheral(frame)
-
-						checksumUSB, err := cybootloader_protocol.ParseGetRowChecksumCmdResult(readBuf)
-						checkError(err, "Error parsing frame", ErrorCodeCommunication)
-
-						if checksum != checksumUSB {
-							checkError(errors.New("[ERROR] The checksum does not match the expected value"), "Checksum mismatch error", ErrorCodeChecksumMismatch)
-						}
-
-						// log.Info("Row Checksum passed")
-					}
-				} else {
-					checkError(errors.New("[ERROR] There was an error during the programming of the device"), "Programming error", ErrorCodeProgramming)
-				}
-			}
+// logRecordChecksums logs a warning for every corrupted record of the file.
+func logRecordChecksums(f cyacdParse.Image) {
+	var errs cyacdParse.ParseErrors
+	if errors.As(f.VerifyChecksums(), &errs) {
+		for _, e := range errs {
+			logEvent(slog.LevelWarn, EventFileChecksum, "Corrupted record in file",
+				"file", e.File,
+				"line", e.Line,
+				"reason", e.Reason)
+		}
+	}
+}
 
-			logEvent(slog.LevelInfo, EventProgrammingComplete, "Programming completed", "phase", "verification")
+// openPeripheral finds and opens the device for the selected communication mode.
+func openPeripheral(ctx context.Context, mode, port, serial string) (io.ReadWriteCloser, error) {
+	// bound the device search even when the process has no deadline
+	ctx, cancel := context.WithTimeout(ctx, usb.DefaultFindTimeout)
+	defer cancel()
 
-			frame = cybootloader_protocol.CreateVerifyAppChecksumCmd()
-			transactionPeripheral(frame)
-			checksumApp, _ := cybootloader_protocol.ParseVerifyAppChecksumCmdResult(readBuf)
+	switch strings.ToLower(mode) {
+	case ModeSerial:
+		devSerial, err := uart.NewDevice(port)
+		if err != nil {
+			return nil, wrapError(err, "Error creating device", ErrorCodeDeviceNotFound)
+		}
+		return devSerial, nil
+	case ModeUSB:
+		devUSB, err := usb.FindDeviceContext(ctx, serial)
+		if err != nil {
+			return nil, wrapError(err, "Error finding device", ErrorCodeDeviceNotFound)
+		}
+		if devUSB == nil {
+			return nil, &commandError{event: EventError, message: "Device not found", code: ErrorCodeDeviceNotFound}
+		}
+		if err := devUSB.Init(); err != nil {
+			return nil, wrapError(err, "Error initializing USB device", ErrorCodeDeviceNotFound)
+		}
+		return devUSB, nil
+	case ModeHID:
+		devHID, err := usb.FindHIDDeviceContext(ctx, serial)
+		if err != nil {
+			return nil, wrapError(err, "Error finding HID device", ErrorCodeDeviceNotFound)
+		}
+		if devHID == nil {
+			return nil, &commandError{event: EventError, message: "HID device not found", code: ErrorCodeDeviceNotFound}
+		}
+		if err := devHID.Init(); err != nil {
+			return nil, wrapError(err, "Error initializing HID device", ErrorCodeDeviceNotFound)
+		}
+		return devHID, nil
+	}
+	return nil, nil
+}
 
-			logEvent(slog.LevelInfo, EventVerificationComplete, "Application checksum",
-				"checksum", fmt.Sprintf("%x", checksumApp),
-				"phase", "verification")
+// loadParts returns the built-in silicon ID table, extended by the JSON file
+// at path if any.
+func loadParts(path string) (*silicon.Database, error) {
+	parts := silicon.Builtin()
+	if path != "" {
+		if err := parts.LoadFile(path); err != nil {
+			return nil, wrapError(err, "Error loading parts file", ErrorCodeParamValidation)
+		}
+	}
+	return parts, nil
+}
 
-			if checksumApp != 0 {
-				logEvent(slog.LevelInfo, EventProcessComplete, "Device was successfully programmed",
-					"status", "success",
-					"phase", "completion")
-			}
+// loadCompatPolicy returns the compatibility policy of the firmware file: the
+// policy file given, or the one next to the firmware file, followed by a rule
+// for every -accept flag.
+func loadCompatPolicy(path, firmwarePath string, accept []silicon.Pattern) (*silicon.Policy, error) {
+	if path == "" && firmwarePath != "-" {
+		if _, err := os.Stat(firmwarePath + ".compat.json"); err == nil {
+			path = firmwarePath + ".compat.json"
+		}
+	}
 
+	compat := &silicon.Policy{}
+	if path != "" {
+		var err error
+		compat, err = silicon.LoadPolicyFile(path)
+		if err != nil {
+			return nil, wrapError(err, "Error loading compatibility policy", ErrorCodeParamValidation)
 		}
+		logEvent(slog.LevelInfo, EventFilePolicy, "Compatibility policy loaded", "policy", path, "rules", len(compat.Rules))
 	}
+	for _, p := range accept {
+		compat.Add(silicon.Rule{Name: "-accept " + p.String(), File: silicon.AnyDevice, Device: p})
+	}
+	return compat, nil
+}
 
-	logEvent(slog.LevelInfo, EventBootloaderExit, "Exit bootloader. Auto reset", "phase", "completion")
-	writePeripheral(cybootloader_protocol.CreateExitBootloaderCmd())
+// logFileTarget logs the part the firmware file was built for.
+func logFileTarget(parts *silicon.Database, image cyacdParse.Image) {
+	attrs := []any{"part", parts.Describe(image.SiliconID(), uint8(image.SiliconRev()))}
+	if part, ok := parts.Lookup(image.SiliconID(), uint8(image.SiliconRev())); ok {
+		attrs = append(attrs, "family", part.Family)
+	}
+	logEvent(slog.LevelInfo, EventFileTarget, "Firmware file target", attrs...)
+}
 
-	err = peripheral.Close()
-	checkError(err, "Error closing peripheral", ErrorCodeCommunication)
+// simulatorConfig describes a simulated device matching the firmware file.
+func simulatorConfig(image cyacdParse.Image, key []byte) simulator.Config {
+	if img, ok := image.(*cyacdParse.Cyacd2); ok {
+		return simulator.ConfigForDFUImage(img)
+	}
+	return simulator.ConfigForImage(image.(*cyacdParse.Cyacd), key)
 }
 
-func validateParams(mode, filePath, port, key, serial string) {
-	if filePath == "" {
-		logEvent(slog.LevelError, EventValidationError, "File path is required.",
-			"error_code", ErrorCodeParamValidation)
-		flag.PrintDefaults()
-		os.Exit(1)
+// openReplay loads a capture and plays it back as a device.
+func openReplay(path string) (io.ReadWriteCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, wrapError(err, "Error opening capture file", ErrorCodeParamValidation)
 	}
+	defer file.Close()
 
-	if key == "" {
-		logEvent(slog.LevelError, EventValidationError, "Bootloader key is required.",
-			"error_code", ErrorCodeParamValidation)
-		flag.PrintDefaults()
-		os.Exit(1)
+	records, err := transport.LoadCapture(file)
+	if err != nil {
+		return nil, wrapError(err, "Error reading capture file", ErrorCodeParamValidation)
+	}
+
+	logEvent(slog.LevelInfo, EventReplay, "Replaying capture", "capture", path, "records", len(records))
+	return transport.NewReplay(records), nil
+}
+
+// hiddenFlags are accepted on the command line but left out of the usage.
+var hiddenFlags = map[string]bool{
+	"fault":      true,
+	"fault-seed": true,
+}
+
+// printUsage prints the defaults of every flag that is not hidden.
+func printUsage() {
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(flag.CommandLine.Output())
+	fmt.Fprintf(visible.Output(), "Usage of %s:\n", os.Args[0])
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+}
+
+func validateParams(mode, filePath, port, serial string) error {
+	if filePath == "" {
+		printUsage()
+		return validationError("File path is required.")
 	}
 
 	if mode == "" {
-		logEvent(slog.LevelError, EventValidationError, "Mode is required.",
-			"error_code", ErrorCodeParamValidation)
-		flag.PrintDefaults()
-		os.Exit(1)
-	} else if mode != ModeSerial && mode != ModeUSB && mode != ModeHID {
-		logEvent(slog.LevelError, EventValidationError, "Mode must be serial, usb, or hid.",
-			"error_code", ErrorCodeParamValidation)
-		flag.PrintDefaults()
-		os.Exit(1)
+		printUsage()
+		return validationError("Mode is required.")
+	} else if mode != ModeSerial && mode != ModeUSB && mode != ModeHID && mode != ModeSim && mode != ModeReplay {
+		printUsage()
+		return validationError("Mode must be serial, usb, hid, sim, or replay.")
 	} else {
 		if mode == ModeSerial && port == "" {
-			logEvent(slog.LevelError, EventValidationError, "Port is required for serial mode.",
-				"error_code", ErrorCodeParamValidation)
-			flag.PrintDefaults()
-			os.Exit(1)
+			printUsage()
+			return validationError("Port is required for serial mode.")
 		}
 		if (mode == ModeUSB || mode == ModeHID) && serial == "" {
-			logEvent(slog.LevelError, EventValidationError, "Serial is required for usb and hid modes.",
-				"error_code", ErrorCodeParamValidation)
-			flag.PrintDefaults()
-			os.Exit(1)
+			printUsage()
+			return validationError("Serial is required for usb and hid modes.")
 		}
 	}
+	return nil
 }
 
-func checkError(err error, message string, errorCode ...string) {
-	if err != nil {
-		globalError = true
-		code := ErrorCodeProgramming
-		if len(errorCode) > 0 {
-			code = errorCode[0]
-		}
-		logEvent(slog.LevelError, EventError, message,
-			"error", err.Error(),
-			"error_code", code)
-		os.Exit(1)
+// validateKey requires a bootloader key for .cyacd files. The DFU protocol of
+// .cyacd2 files has none.
+func validateKey(image cyacdParse.Image, key string) error {
+	if key == "" && image.Format() == cyacdParse.FormatCyacd {
+		printUsage()
+		return validationError("Bootloader key is required for .cyacd files.")
 	}
+	return nil
 }
 
-func readPeripheral() {
-	readBuf = make([]byte, PacketSize)
-	_, err := peripheral.Read(readBuf)
-	// log.Printf("Read %d bytes", n)
-	if err != nil {
-		if err.Error() == "read operation timed out" || err.Error() == "timeout" {
-			checkError(err, "Communication timeout: device is unresponsive or not in bootloader mode", ErrorCodeCommunication)
-		} else {
-			checkError(err, "Error reading frame", ErrorCodeCommunication)
-		}
+func validateReplayParams(mode, replay string) error {
+	if mode == ModeReplay && replay == "" {
+		printUsage()
+		return validationError("Capture file is required for replay mode.")
 	}
+	return nil
 }
 
-func writePeripheral(frame []byte) {
-	_, err := peripheral.Write(frame)
-	// log.Printf("Write %d bytes", n)
-	checkError(err, "Error writing frame", ErrorCodeCommunication)
+func validateAppParams(app int, setActive bool) error {
+	if app < -1 || app >= cybootloader_protocol.MaxApps {
+		printUsage()
+		return validationError(fmt.Sprintf("App must be between 0 and %d, or -1 for a single app bootloader.", cybootloader_protocol.MaxApps-1))
+	}
 
-	return
+	if setActive && app < 0 {
+		printUsage()
+		return validationError("App is required to set the active application.")
+	}
+	return nil
+}
+
+// commandError is the failure ending the process, logged by main with its
+// message and error code before exiting.
+type commandError struct {
+	event   string
+	message string
+	code    string
+	err     error // nil for invalid parameters
+}
+
+func (e *commandError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return e.message + ": " + e.err.Error()
 }
 
-func transactionPeripheral(frame []byte) {
-	// send frame
-	writePeripheral(frame)
-	time.Sleep(time.Millisecond)
-	// read response
-	readPeripheral()
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// wrapError returns nil when err is nil, or err with the message to log. The
+// error code is code unless errorCodeFor finds a more specific one.
+func wrapError(err error, message, code string) error {
+	if err == nil {
+		return nil
+	}
+	return &commandError{event: EventError, message: message, code: errorCodeFor(err, code), err: err}
+}
+
+// validationError reports invalid parameters.
+func validationError(message string) error {
+	return &commandError{event: EventValidationError, message: message, code: ErrorCodeParamValidation}
+}
+
+// logError logs the error ending the process.
+func logError(err error) {
+	var cmdErr *commandError
+	if !errors.As(err, &cmdErr) {
+		cmdErr = &commandError{event: EventError, message: "Error", code: errorCodeFor(err, ErrorCodeProgramming), err: err}
+	}
+	var attrs []any
+	if cmdErr.err != nil {
+		attrs = append(attrs, "error", cmdErr.err.Error())
+	}
+	attrs = append(attrs, "error_code", cmdErr.code)
+	logEvent(slog.LevelError, cmdErr.event, cmdErr.message, attrs...)
+}
+
+// errorCodeFor returns the error code matching the status reported by the
+// bootloader, a corrupted response or the failed programming step, or
+// fallback for any other error.
+func errorCodeFor(err error, fallback string) string {
+	for _, e := range flasherErrorCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	var blErr *cybootloader_protocol.BootloaderError
+	if errors.As(err, &blErr) {
+		if code, ok := bootloaderErrorCodes[blErr.Status]; ok {
+			return code
+		}
+		return ErrorCodeBootloaderUnknown
+	}
+	if errors.Is(err, cybootloader_protocol.ErrChecksum) {
+		return ErrorCodePacketChecksum
+	}
+	var flErr *flasher.Error
+	if errors.As(err, &flErr) {
+		if code, ok := stageErrorCodes[flErr.Stage]; ok {
+			return code
+		}
+	}
+	return fallback
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bootloader-usb/cyacdParse"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// patchSpec is the JSON document read by the patch subcommand, for example:
+//
+//	{"patches": [
+//	  {"array": 0, "row": 255, "offset": 0, "text": "SN-000123"},
+//	  {"array": 0, "row": 255, "offset": 16, "data": "DEADBEEF"}
+//	]}
+type patchSpec struct {
+	Patches []rowPatch `json:"patches"`
+}
+
+// rowPatch overwrites part of a row with hex encoded data or ASCII text.
+type rowPatch struct {
+	Array  uint8  `json:"array"`
+	Row    uint16 `json:"row"`
+	Offset int    `json:"offset"`
+	Data   string `json:"data,omitempty"`
+	Text   string `json:"text,omitempty"`
+}
+
+func (p rowPatch) bytes() ([]byte, error) {
+	switch {
+	case p.Data != "" && p.Text != "":
+		return nil, fmt.Errorf("array %d row %d: data and text cannot be used together", p.Array, p.Row)
+	case p.Text != "":
+		return []byte(p.Text), nil
+	case p.Data != "":
+		b, err := hex.DecodeString(p.Data)
+		if err != nil {
+			return nil, fmt.Errorf("array %d row %d: invalid data: %w", p.Array, p.Row, err)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("array %d row %d: data or text is required", p.Array, p.Row)
+}
+
+// runPatch applies a JSON patch spec to a .cyacd file and writes the result,
+// so that per unit images can be produced before flashing.
+func runPatch(args []string) error {
+	fs := flag.NewFlagSet("patch", flag.ExitOnError)
+	in := fs.String("in", "", "Path for the .cyacd file to patch, optionally gzip compressed. - reads the file from stdin")
+	specPath := fs.String("spec", "", "Path for the JSON patch spec")
+	out := fs.String("out", "", "Path for the patched .cyacd file")
+	fs.Parse(args)
+
+	if *in == "" || *specPath == "" || *out == "" {
+		fs.PrintDefaults()
+		return validationError("In, spec and out are required.")
+	}
+
+	logEvent(slog.LevelInfo, EventProcessStart, "Patching file", "command", "patch", "file", *in, "spec", *specPath)
+
+	image, err := loadImage(*in)
+	if err != nil {
+		return wrapError(err, "Error parsing file", ErrorCodeParamValidation)
+	}
+	f, ok := image.(*cyacdParse.Cyacd)
+	if !ok {
+		return wrapError(fmt.Errorf("%s files cannot be patched", image.Format()), "Unsupported firmware format", ErrorCodeParamValidation)
+	}
+
+	specData, err := os.ReadFile(*specPath)
+	if err != nil {
+		return wrapError(err, "Error reading patch spec", ErrorCodeParamValidation)
+	}
+	var spec patchSpec
+	err = json.Unmarshal(specData, &spec)
+	if err != nil {
+		return wrapError(err, "Error parsing patch spec", ErrorCodeParamValidation)
+	}
+
+	mdBefore, mdErr := f.Metadata()
+
+	for _, p := range spec.Patches {
+		b, err := p.bytes()
+		if err != nil {
+			return wrapError(err, "Invalid patch", ErrorCodeParamValidation)
+		}
+
+		err = f.PatchRow(p.Array, p.Row, p.Offset, b)
+		if err != nil {
+			return wrapError(err, "Error patching row", ErrorCodeParamValidation)
+		}
+
+		logEvent(slog.LevelInfo, EventPatchApplied, "Row patched",
+			"array_id", p.Array,
+			"row", p.Row,
+			"offset", p.Offset,
+			"size", len(b))
+	}
+
+	// PatchRow keeps a matching metadata checksum in step, a stale one is
+	// reported as the bootloader would reject the application
+	if mdErr == nil {
+		if md, _ := f.Metadata(); md.Checksum != mdBefore.Checksum {
+			logEvent(slog.LevelInfo, EventFileChecksum, "Application checksum of the metadata updated",
+				"checksum", fmt.Sprintf("%x", md.Checksum),
+				"previous_checksum", fmt.Sprintf("%x", mdBefore.Checksum))
+		}
+		if err := f.VerifyAppChecksum(); err != nil {
+			logEvent(slog.LevelWarn, EventFileChecksum, "Application checksum of the metadata does not match the patched file",
+				"error", err.Error())
+		}
+	}
+
+	err = os.WriteFile(*out, f.Bytes(), 0o644)
+	if err != nil {
+		return wrapError(err, "Error writing patched file", ErrorCodeParamValidation)
+	}
+
+	logEvent(slog.LevelInfo, EventProcessComplete, "Patched file written",
+		"status", "success",
+		"file", *out,
+		"patches", len(spec.Patches))
+	return nil
+}
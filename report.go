@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bootloader-usb/flasher"
+	"fmt"
+	"log/slog"
+)
+
+// logReporter turns the progress events of the programmer into the JSON log
+// events of the command line tool.
+type logReporter struct {
+	lastReportedProgress int
+}
+
+func (l *logReporter) Report(ev flasher.Event) {
+	switch ev.Type {
+	case flasher.EventBootloaderEnter:
+		logEvent(slog.LevelInfo, EventBootloaderEnter, "Enter bootloader", "phase", "initialization")
+	case flasher.EventDeviceIdentified:
+		logEvent(slog.LevelInfo, EventDeviceIdentified, "Device identified",
+			"part", ev.Part,
+			"bootloader_version", fmt.Sprintf("0x%06X", ev.Device.BootloaderVersion),
+			"phase", "initialization")
+	case flasher.EventDeviceAccepted:
+		logEvent(slog.LevelWarn, EventDeviceAccepted, "Device differs from the file, accepted by compatibility rule",
+			"part", ev.Part,
+			"rule", ev.Rule,
+			"phase", "initialization")
+	case flasher.EventAppStatus:
+		logEvent(slog.LevelInfo, EventAppStatus, "Application status",
+			"app", ev.App,
+			"valid", ev.AppStatus.Valid,
+			"active", ev.AppStatus.Active)
+	case flasher.EventProgrammingStart:
+		l.lastReportedProgress = 0
+		logEvent(slog.LevelInfo, EventProgrammingStart, "Starting programming process",
+			"phase", "programming",
+			"progress", 0,
+			"total_rows", ev.TotalRows)
+	case flasher.EventRowProgrammed:
+		currentProgressPercent := int(float64(ev.RowIndex+1) / float64(ev.TotalRows) * 100)
+
+		// Report progress at 10% intervals
+		if currentProgressPercent/10 > l.lastReportedProgress/10 {
+			l.lastReportedProgress = currentProgressPercent
+			logEvent(slog.LevelInfo, EventProgrammingProgress, "Programming progress",
+				"phase", "programming",
+				"progress", currentProgressPercent,
+				"current_row", ev.RowIndex+1,
+				"total_rows", ev.TotalRows)
+		}
+	case flasher.EventProgrammingResync:
+		attrs := []any{"phase", "programming"}
+		if ev.Row != nil {
+			attrs = append(attrs, "array_id", ev.Row.ArrayID(), "row", ev.Row.RowNum())
+		} else {
+			attrs = append(attrs, "address", fmt.Sprintf("0x%08X", ev.Address))
+		}
+		attrs = append(attrs, "attempt", ev.Attempt, "error", ev.Err.Error())
+		logEvent(slog.LevelWarn, EventProgrammingResync, "Resynchronising with bootloader", attrs...)
+	case flasher.EventProgrammingComplete:
+		logEvent(slog.LevelInfo, EventProgrammingComplete, "Programming completed", "phase", "verification")
+	case flasher.EventVerificationComplete:
+		logEvent(slog.LevelInfo, EventVerificationComplete, "Application checksum",
+			"checksum", fmt.Sprintf("%x", ev.AppChecksum),
+			"image_checksum", fmt.Sprintf("%x", ev.ImageChecksum),
+			"phase", "verification")
+	case flasher.EventMetadata:
+		if ev.Err != nil {
+			logEvent(slog.LevelWarn, EventAppMetadata, "Device did not return its metadata",
+				"app", ev.App,
+				"error", ev.Err.Error())
+			break
+		}
+		fileVersion := "unknown"
+		attrs := []any{
+			"app", ev.App,
+			"device_version", ev.Metadata.AppVersion.String(),
+			"device_app_id", ev.Metadata.AppID,
+			"device_custom_id", fmt.Sprintf("0x%08X", ev.Metadata.CustomID),
+			"device_verified", ev.Metadata.Verified,
+			"device_active", ev.Metadata.Active,
+		}
+		if ev.ImageMetadata != nil {
+			fileVersion = ev.ImageMetadata.AppVersion.String()
+			attrs = append(attrs,
+				"file_version", fileVersion,
+				"file_app_id", ev.ImageMetadata.AppID,
+				"file_custom_id", fmt.Sprintf("0x%08X", ev.ImageMetadata.CustomID))
+		}
+		logEvent(slog.LevelInfo, EventAppMetadata,
+			fmt.Sprintf("Device runs %s, file is %s", ev.Metadata.AppVersion, fileVersion), attrs...)
+	case flasher.EventAppActivate:
+		logEvent(slog.LevelInfo, EventAppActivate, "Setting active application",
+			"app", ev.App,
+			"phase", "completion")
+	case flasher.EventBootloaderExit:
+		logEvent(slog.LevelInfo, EventBootloaderExit, "Exit bootloader. Auto reset", "phase", "completion")
+	}
+}
@@ -0,0 +1,14 @@
+package silicon
+
+// builtinParts is the table returned by Builtin. Parts missing from it can be
+// described in a JSON file loaded with Database.LoadFile.
+var builtinParts = []Part{
+	// CY8CKIT-030 development kit
+	{Name: "CY8C3866AXI-040", Family: FamilyPSoC3, SiliconID: 0x1E028069, Rev: AnyRev, RowSize: 256, Arrays: 1, FlashSize: 64 * 1024, ECC: true},
+	// CY8CKIT-049-42xx prototyping kit
+	{Name: "CY8C4245AXI-483", Family: FamilyPSoC4, SiliconID: 0x04C81193, Rev: AnyRev, RowSize: 128, Arrays: 1, FlashSize: 32 * 1024},
+	// CY8CKIT-059 prototyping kit
+	{Name: "CY8C5888LTI-LP097", Family: FamilyPSoC5LP, SiliconID: 0x2E133069, Rev: AnyRev, RowSize: 256, Arrays: 4, FlashSize: 256 * 1024, ECC: true},
+	// CY8CKIT-062-BLE pioneer kit
+	{Name: "CY8C6347BZI-BLD53", Family: FamilyPSoC6, SiliconID: 0xE2072100, Rev: AnyRev, RowSize: 512, Arrays: 1, FlashSize: 1024 * 1024, FlashBase: 0x10000000},
+}
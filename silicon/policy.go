@@ -0,0 +1,168 @@
+package silicon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Pattern matches silicon IDs and revisions. Its text form is "ID:REV", where
+// either part may be "*" to match any value, e.g. "0x04A61193:*". An ID alone
+// matches every revision of the silicon.
+type Pattern struct {
+	SiliconID uint32
+	AnyID     bool
+	Rev       int // Silicon revision, AnyRev to match every revision
+}
+
+// AnyDevice matches every silicon ID and revision.
+var AnyDevice = Pattern{AnyID: true, Rev: AnyRev}
+
+// ParsePattern reads the text form of a Pattern.
+func ParsePattern(s string) (Pattern, error) {
+	id, rev, hasRev := strings.Cut(strings.TrimSpace(s), ":")
+
+	p := AnyDevice
+	if id != "*" {
+		v, err := strconv.ParseUint(id, 0, 32)
+		if err != nil {
+			return Pattern{}, fmt.Errorf("invalid silicon ID %q in %q", id, s)
+		}
+		p.SiliconID = uint32(v)
+		p.AnyID = false
+	}
+	if hasRev && rev != "*" {
+		v, err := strconv.ParseUint(rev, 0, 8)
+		if err != nil {
+			return Pattern{}, fmt.Errorf("invalid silicon revision %q in %q", rev, s)
+		}
+		p.Rev = int(v)
+	}
+	return p, nil
+}
+
+// Match reports whether the silicon ID and revision match the pattern.
+func (p Pattern) Match(siliconID uint32, rev uint8) bool {
+	return (p.AnyID || p.SiliconID == siliconID) && (p.Rev == AnyRev || p.Rev == int(rev))
+}
+
+func (p Pattern) String() string {
+	id, rev := "*", "*"
+	if !p.AnyID {
+		id = fmt.Sprintf("0x%08X", p.SiliconID)
+	}
+	if p.Rev != AnyRev {
+		rev = fmt.Sprintf("0x%02X", p.Rev)
+	}
+	return id + ":" + rev
+}
+
+func (p *Pattern) UnmarshalText(b []byte) error {
+	v, err := ParsePattern(string(b))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+func (p Pattern) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// Rule accepts the devices matching Device for the images built for the
+// silicon matching File.
+type Rule struct {
+	Name   string
+	File   Pattern
+	Device Pattern
+}
+
+func (r Rule) String() string {
+	s := fmt.Sprintf("file %s device %s", r.File, r.Device)
+	if r.Name != "" {
+		s = r.Name + " (" + s + ")"
+	}
+	return s
+}
+
+// Policy lists the devices accepted for an image whose silicon ID or revision
+// differs from the device. A nil Policy accepts no other device.
+type Policy struct {
+	Rules []Rule
+}
+
+// Add appends a rule to the policy.
+func (p *Policy) Add(r Rule) {
+	p.Rules = append(p.Rules, r)
+}
+
+// Allow returns the first rule accepting a device for an image.
+func (p *Policy) Allow(fileID uint32, fileRev uint8, deviceID uint32, deviceRev uint8) (Rule, bool) {
+	if p == nil {
+		return Rule{}, false
+	}
+	for _, r := range p.Rules {
+		if r.File.Match(fileID, fileRev) && r.Device.Match(deviceID, deviceRev) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// policyFile is the JSON document read by LoadPolicy, for example:
+//
+//	{"rules": [
+//	  {"name": "any revision", "file": "0x04A61193:*", "device": "0x04A61193:*"},
+//	  {"name": "sibling", "device": "0x04A81193:0x11"}
+//	]}
+//
+// A rule without file applies to every image.
+type policyFile struct {
+	Rules []struct {
+		Name   string   `json:"name"`
+		File   *Pattern `json:"file"`
+		Device *Pattern `json:"device"`
+	} `json:"rules"`
+}
+
+// LoadPolicy reads a compatibility policy from a JSON document.
+func LoadPolicy(r io.Reader) (*Policy, error) {
+	var f policyFile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	for i, e := range f.Rules {
+		if e.Device == nil {
+			return nil, fmt.Errorf("rule %d: device is required", i)
+		}
+		rule := Rule{Name: e.Name, File: AnyDevice, Device: *e.Device}
+		if e.File != nil {
+			rule.File = *e.File
+		}
+		p.Add(rule)
+	}
+	return p, nil
+}
+
+// LoadPolicyFile reads a compatibility policy from a JSON file.
+func LoadPolicyFile(path string) (*Policy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	p, err := LoadPolicy(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,96 @@
+package silicon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Pattern
+		wantErr bool
+	}{
+		{in: "0x04A61193:0x11", want: Pattern{SiliconID: 0x04A61193, Rev: 0x11}},
+		{in: "0x04A61193:*", want: Pattern{SiliconID: 0x04A61193, Rev: AnyRev}},
+		{in: "0x04A61193", want: Pattern{SiliconID: 0x04A61193, Rev: AnyRev}},
+		{in: "*:17", want: Pattern{AnyID: true, Rev: 17}},
+		{in: "*", want: AnyDevice},
+		{in: "0x04A61193:0x100", wantErr: true},
+		{in: "PSoC:*", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			p, err := ParsePattern(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParsePattern(%q) = %v, want an error", tt.in, p)
+				}
+				return
+			}
+			if err != nil || p != tt.want {
+				t.Errorf("ParsePattern(%q) = %+v, %v, want %+v", tt.in, p, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyAllow(t *testing.T) {
+	policy, err := LoadPolicy(strings.NewReader(`{"rules": [
+		{"name": "any revision", "file": "0x04A61193:*", "device": "0x04A61193:*"},
+		{"name": "sibling", "device": "0x04A81193:0x11"}
+	]}`))
+	if err != nil {
+		t.Fatalf("LoadPolicy: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		fileID    uint32
+		fileRev   uint8
+		deviceID  uint32
+		deviceRev uint8
+		want      string
+		ok        bool
+	}{
+		{"other revision", 0x04A61193, 0x11, 0x04A61193, 0x12, "any revision", true},
+		{"sibling from any file", 0x04C81193, 0x11, 0x04A81193, 0x11, "sibling", true},
+		{"sibling other revision", 0x04A61193, 0x11, 0x04A81193, 0x12, "", false},
+		{"other part", 0x04A61193, 0x11, 0x04C81193, 0x11, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := policy.Allow(tt.fileID, tt.fileRev, tt.deviceID, tt.deviceRev)
+			if ok != tt.ok || r.Name != tt.want {
+				t.Errorf("Allow = %q, %v, want %q, %v", r.Name, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNilPolicyAllowsNothing(t *testing.T) {
+	var policy *Policy
+	if r, ok := policy.Allow(0x04A61193, 0x11, 0x04A61193, 0x11); ok {
+		t.Errorf("nil policy allowed %v", r)
+	}
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{"missing device", `{"rules": [{"file": "*"}]}`, "device is required"},
+		{"bad pattern", `{"rules": [{"device": "0x04A61193:rev"}]}`, "invalid silicon revision"},
+		{"unknown field", `{"rules": [{"device": "*", "part": "x"}]}`, "unknown field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadPolicy(strings.NewReader(tt.json))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadPolicy error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+// Package silicon maps the silicon ID and revision reported by a bootloader to
+// the part it identifies, with the flash geometry used to check firmware
+// images before programming. The built-in table only lists the parts of the
+// PSoC 3, PSoC 4, PSoC 5LP and PSoC 6 kits; other parts are described in a JSON
+// file, which can also override the built-in entries. A Policy lists the
+// devices accepted for images built for another revision or a compatible part.
+package silicon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"bootloader-usb/cyacdParse"
+)
+
+// Family is the PSoC family of a part. Parts loaded from a file may name any
+// family; the constants are the families of the built-in table.
+type Family string
+
+const (
+	FamilyPSoC3   Family = "PSoC 3"
+	FamilyPSoC4   Family = "PSoC 4"
+	FamilyPSoC5LP Family = "PSoC 5LP"
+	FamilyPSoC6   Family = "PSoC 6"
+)
+
+// AnyRev is the Rev of a part matching every silicon revision.
+const AnyRev = -1
+
+// Part describes a device and the geometry of its flash.
+type Part struct {
+	Name      string
+	Family    Family
+	SiliconID uint32
+	Rev       int    // Silicon revision, AnyRev to match every revision
+	RowSize   int    // Size of a flash row in bytes, without ECC
+	Arrays    int    // Number of flash arrays
+	FlashSize int    // Size of the flash in bytes, without ECC; 0 if unknown
+	FlashBase uint32 // Address of the flash in .cyacd2 images
+	ECC       bool   // Rows carry ECC bytes that may hold configuration data
+}
+
+func (p Part) String() string {
+	return p.Name
+}
+
+// RowSizes returns the row sizes an image for the part may use: the row size,
+// and on parts with ECC the row size with its ECC bytes, one per 8 data bytes.
+func (p Part) RowSizes() []int {
+	if p.ECC {
+		return []int{p.RowSize, p.RowSize + p.RowSize/8}
+	}
+	return []int{p.RowSize}
+}
+
+// RowsPerArray returns the number of rows of each flash array, or 0 if the
+// flash size, row size or number of arrays is unknown.
+func (p Part) RowsPerArray() int {
+	if p.FlashSize == 0 || p.RowSize == 0 || p.Arrays == 0 {
+		return 0
+	}
+	return p.FlashSize / p.Arrays / p.RowSize
+}
+
+// CheckImage makes sure the rows of image fit the flash geometry of the part.
+// Rows of .cyacd images are checked against the arrays and rows of the flash,
+// rows of .cyacd2 images against its address range.
+func (p Part) CheckImage(image cyacdParse.Image) error {
+	switch img := image.(type) {
+	case *cyacdParse.Cyacd:
+		rows := p.RowsPerArray()
+		for _, r := range img.ParseRowData() {
+			if !p.validRowSize(int(r.Size())) {
+				return fmt.Errorf("array %d row %d holds %d bytes, %s rows hold %s", r.ArrayID(), r.RowNum(), r.Size(), p.Name, p.rowSizesText())
+			}
+			if p.Arrays > 0 && int(r.ArrayID()) >= p.Arrays {
+				return fmt.Errorf("array %d row %d is beyond the %d flash arrays of %s", r.ArrayID(), r.RowNum(), p.Arrays, p.Name)
+			}
+			if rows > 0 && int(r.RowNum()) >= rows {
+				return fmt.Errorf("array %d row %d is beyond the %d rows of the flash arrays of %s", r.ArrayID(), r.RowNum(), rows, p.Name)
+			}
+		}
+	case *cyacdParse.Cyacd2:
+		start, end := uint64(p.FlashBase), uint64(p.FlashBase)+uint64(p.FlashSize)
+		for _, r := range img.Rows() {
+			if !p.validRowSize(len(r.Data())) {
+				return fmt.Errorf("row at 0x%08X holds %d bytes, %s rows hold %s", r.Address(), len(r.Data()), p.Name, p.rowSizesText())
+			}
+			if p.FlashSize > 0 && (uint64(r.Address()) < start || uint64(r.Address())+uint64(len(r.Data())) > end) {
+				return fmt.Errorf("row at 0x%08X is outside the flash of %s, 0x%08X to 0x%08X", r.Address(), p.Name, start, end-1)
+			}
+		}
+	}
+	return nil
+}
+
+func (p Part) validRowSize(size int) bool {
+	if p.RowSize == 0 {
+		return true
+	}
+	for _, s := range p.RowSizes() {
+		if size == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Part) rowSizesText() string {
+	sizes := p.RowSizes()
+	if len(sizes) == 2 {
+		return fmt.Sprintf("%d or %d bytes with ECC", sizes[0], sizes[1])
+	}
+	return fmt.Sprintf("%d bytes", sizes[0])
+}
+
+// Database is a set of parts looked up by silicon ID and revision.
+type Database struct {
+	parts []Part
+}
+
+// Builtin returns a new database holding the built-in table.
+func Builtin() *Database {
+	db := &Database{}
+	for _, p := range builtinParts {
+		db.Add(p)
+	}
+	return db
+}
+
+// Add adds a part, replacing the part with the same silicon ID and revision.
+func (db *Database) Add(p Part) {
+	for i := range db.parts {
+		if db.parts[i].SiliconID == p.SiliconID && db.parts[i].Rev == p.Rev {
+			db.parts[i] = p
+			return
+		}
+	}
+	db.parts = append(db.parts, p)
+}
+
+// Lookup returns the part with the silicon ID and revision. A part listed for
+// the exact revision takes precedence over one matching every revision.
+func (db *Database) Lookup(siliconID uint32, rev uint8) (Part, bool) {
+	var found *Part
+	for i := range db.parts {
+		p := &db.parts[i]
+		if p.SiliconID != siliconID {
+			continue
+		}
+		if p.Rev == int(rev) {
+			return *p, true
+		}
+		if p.Rev == AnyRev {
+			found = p
+		}
+	}
+	if found == nil {
+		return Part{}, false
+	}
+	return *found, true
+}
+
+// Describe names the part with the silicon ID and revision for logs and
+// errors, e.g. "CY8C4245AXI-483 (0x04C81193 rev 0x11)". Unknown parts are
+// described by the numbers alone.
+func (db *Database) Describe(siliconID uint32, rev uint8) string {
+	if p, ok := db.Lookup(siliconID, rev); ok {
+		return fmt.Sprintf("%s (0x%08X rev 0x%02X)", p.Name, siliconID, rev)
+	}
+	return fmt.Sprintf("0x%08X rev 0x%02X", siliconID, rev)
+}
+
+// partsFile is the JSON document read by Load, for example:
+//
+//	{"parts": [
+//	  {"name": "CY8C4245AXI-483", "family": "PSoC 4", "silicon_id": "0x04C81193",
+//	   "rev": "0x11", "row_size": 128, "arrays": 1, "flash_size": 32768, "ecc": false},
+//	  {"name": "CY8C6347BZI-BLD53", "family": "PSoC 6", "silicon_id": "0xE2072100",
+//	   "row_size": 512, "arrays": 1, "flash_size": 1048576, "flash_base": "0x10000000"}
+//	]}
+//
+// Numbers written as strings may be in decimal or in hex with a 0x prefix. A
+// part without rev matches every revision.
+type partsFile struct {
+	Parts []partEntry `json:"parts"`
+}
+
+type partEntry struct {
+	Name      string `json:"name"`
+	Family    Family `json:"family"`
+	SiliconID string `json:"silicon_id"`
+	Rev       string `json:"rev,omitempty"`
+	RowSize   int    `json:"row_size"`
+	Arrays    int    `json:"arrays"`
+	FlashSize int    `json:"flash_size,omitempty"`
+	FlashBase string `json:"flash_base,omitempty"`
+	ECC       bool   `json:"ecc"`
+}
+
+// Load adds the parts of a JSON document to the database, replacing the
+// built-in parts with the same silicon ID and revision.
+func (db *Database) Load(r io.Reader) error {
+	var f partsFile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return err
+	}
+
+	parts := make([]Part, 0, len(f.Parts))
+	for i, e := range f.Parts {
+		if e.Name == "" {
+			return fmt.Errorf("part %d: name is required", i)
+		}
+		id, err := strconv.ParseUint(e.SiliconID, 0, 32)
+		if err != nil {
+			return fmt.Errorf("part %s: invalid silicon ID %q", e.Name, e.SiliconID)
+		}
+		rev := AnyRev
+		if e.Rev != "" {
+			v, err := strconv.ParseUint(e.Rev, 0, 8)
+			if err != nil {
+				return fmt.Errorf("part %s: invalid silicon revision %q", e.Name, e.Rev)
+			}
+			rev = int(v)
+		}
+		if e.RowSize < 0 || e.Arrays < 0 || e.FlashSize < 0 {
+			return fmt.Errorf("part %s: row size, arrays and flash size cannot be negative", e.Name)
+		}
+		var base uint64
+		if e.FlashBase != "" {
+			base, err = strconv.ParseUint(e.FlashBase, 0, 32)
+			if err != nil {
+				return fmt.Errorf("part %s: invalid flash base %q", e.Name, e.FlashBase)
+			}
+		}
+		if base+uint64(e.FlashSize) > 1<<32 {
+			return fmt.Errorf("part %s: flash ends beyond the 32 bit address space", e.Name)
+		}
+
+		parts = append(parts, Part{
+			Name:      e.Name,
+			Family:    e.Family,
+			SiliconID: uint32(id),
+			Rev:       rev,
+			RowSize:   e.RowSize,
+			Arrays:    e.Arrays,
+			FlashSize: e.FlashSize,
+			FlashBase: uint32(base),
+			ECC:       e.ECC,
+		})
+	}
+
+	// the file is applied only once every entry is valid
+	for _, p := range parts {
+		db.Add(p)
+	}
+	return nil
+}
+
+// LoadFile adds the parts of a JSON file to the database.
+func (db *Database) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := db.Load(file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package silicon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"bootloader-usb/cyacdParse"
+)
+
+func TestLookup(t *testing.T) {
+	db := Builtin()
+	db.Add(Part{Name: "rev 0x12", SiliconID: 0x04C81193, Rev: 0x12, RowSize: 128})
+
+	tests := []struct {
+		name      string
+		siliconID uint32
+		rev       uint8
+		want      string
+		ok        bool
+	}{
+		{"any revision", 0x04C81193, 0x11, "CY8C4245AXI-483", true},
+		{"exact revision first", 0x04C81193, 0x12, "rev 0x12", true},
+		{"PSoC 3", 0x1E028069, 0x00, "CY8C3866AXI-040", true},
+		{"PSoC 5LP", 0x2E133069, 0x00, "CY8C5888LTI-LP097", true},
+		{"PSoC 6", 0xE2072100, 0x11, "CY8C6347BZI-BLD53", true},
+		{"unknown", 0x12345678, 0x11, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := db.Lookup(tt.siliconID, tt.rev)
+			if ok != tt.ok || p.Name != tt.want {
+				t.Errorf("Lookup(0x%08X, 0x%02X) = %q, %v, want %q, %v", tt.siliconID, tt.rev, p.Name, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestBuiltinGeometry(t *testing.T) {
+	for _, p := range builtinParts {
+		if p.RowSize == 0 || p.Arrays == 0 || p.FlashSize == 0 || p.FlashSize%(p.Arrays*p.RowSize) != 0 {
+			t.Errorf("%s: flash of %d bytes is not a whole number of %d byte rows in %d arrays", p.Name, p.FlashSize, p.RowSize, p.Arrays)
+		}
+	}
+
+	db := Builtin()
+	for _, tt := range []struct {
+		siliconID uint32
+		rows      int
+	}{
+		{0x1E028069, 256},
+		{0x04C81193, 256},
+		{0x2E133069, 256},
+		{0xE2072100, 2048},
+	} {
+		if p, _ := db.Lookup(tt.siliconID, 0); p.RowsPerArray() != tt.rows {
+			t.Errorf("%s has %d rows per array, want %d", p.Name, p.RowsPerArray(), tt.rows)
+		}
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	psoc4 := Part{Name: "PSoC 4", RowSize: 128, Arrays: 1, FlashSize: 32 * 1024}
+	psoc5 := Part{Name: "PSoC 5LP", RowSize: 256, Arrays: 4, FlashSize: 256 * 1024, ECC: true}
+	psoc6 := Part{Name: "PSoC 6", RowSize: 512, Arrays: 1, FlashSize: 1024 * 1024, FlashBase: 0x10000000}
+
+	// cyacd builds a .cyacd image with one row
+	cyacd := func(arrayID uint8, row uint16, size int) cyacdParse.Image {
+		line := []byte{arrayID, byte(row >> 8), byte(row), byte(size >> 8), byte(size)}
+		line = append(line, make([]byte, size)...)
+		var sum byte
+		for _, b := range line {
+			sum += b
+		}
+		line = append(line, -sum)
+		return loadImage(t, fmt.Sprintf("04C8119300\n:%X\n", line), "test.cyacd")
+	}
+	// cyacd2 builds a .cyacd2 image with one row
+	cyacd2 := func(address uint32, size int) cyacdParse.Image {
+		row := binary.LittleEndian.AppendUint32(nil, address)
+		row = append(row, make([]byte, size)...)
+		return loadImage(t, fmt.Sprintf("01E207210011000101020304\n:%X\n", row), "test.cyacd2")
+	}
+
+	tests := []struct {
+		name    string
+		part    Part
+		image   cyacdParse.Image
+		wantErr string
+	}{
+		{"cyacd fits", psoc4, cyacd(0, 255, 128), ""},
+		{"cyacd row size", psoc4, cyacd(0, 16, 256), "rows hold 128 bytes"},
+		{"cyacd array", psoc4, cyacd(1, 16, 128), "beyond the 1 flash arrays"},
+		{"cyacd row", psoc4, cyacd(0, 256, 128), "beyond the 256 rows"},
+		{"cyacd ECC row", psoc5, cyacd(3, 255, 288), ""},
+		{"cyacd2 fits", psoc6, cyacd2(0x100FFE00, 512), ""},
+		{"cyacd2 row size", psoc6, cyacd2(0x10000000, 128), "rows hold 512 bytes"},
+		{"cyacd2 before the flash", psoc6, cyacd2(0x0FFFFE00, 512), "outside the flash"},
+		{"cyacd2 past the flash", psoc6, cyacd2(0x10100000, 512), "outside the flash"},
+		{"cyacd2 unknown flash size", Part{Name: "PSoC 6", RowSize: 512}, cyacd2(0x0FFFFE00, 512), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.part.CheckImage(tt.image)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckImage: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("CheckImage error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func loadImage(t *testing.T, file, name string) cyacdParse.Image {
+	t.Helper()
+
+	image, err := cyacdParse.LoadBytes([]byte(file), name)
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	return image
+}
+
+func TestAddReplaces(t *testing.T) {
+	db := Builtin()
+	db.Add(Part{Name: "custom", SiliconID: 0x04C81193, Rev: AnyRev, RowSize: 256})
+
+	p, ok := db.Lookup(0x04C81193, 0x11)
+	if !ok || p.Name != "custom" || p.RowSize != 256 {
+		t.Errorf("Lookup = %+v, %v, want the replacing part", p, ok)
+	}
+	if n := len(db.parts); n != len(builtinParts) {
+		t.Errorf("database holds %d parts, want %d", n, len(builtinParts))
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{
+			name: "hex and decimal",
+			json: `{"parts": [
+				{"name": "A", "family": "PSoC 4", "silicon_id": "0x04A61193", "rev": "0x11", "row_size": 128, "arrays": 1},
+				{"name": "B", "family": "PSoC 4", "silicon_id": "78008723", "row_size": 128},
+				{"name": "C", "family": "PSoC 6", "silicon_id": "0xE2072100", "row_size": 512, "arrays": 1, "flash_size": 1048576, "flash_base": "0x10000000"}
+			]}`,
+		},
+		{
+			name:    "unknown field",
+			json:    `{"parts": [{"name": "A", "silicon_id": "0x04A61193", "rows": 128}]}`,
+			wantErr: "unknown field",
+		},
+		{
+			name:    "missing name",
+			json:    `{"parts": [{"silicon_id": "0x04A61193"}]}`,
+			wantErr: "name is required",
+		},
+		{
+			name:    "invalid silicon ID",
+			json:    `{"parts": [{"name": "A", "silicon_id": "0x1234567890"}]}`,
+			wantErr: "invalid silicon ID",
+		},
+		{
+			name:    "invalid revision",
+			json:    `{"parts": [{"name": "A", "silicon_id": "0x04A61193", "rev": "0x100"}]}`,
+			wantErr: "invalid silicon revision",
+		},
+		{
+			name:    "negative row size",
+			json:    `{"parts": [{"name": "A", "silicon_id": "0x04A61193", "row_size": -1}]}`,
+			wantErr: "cannot be negative",
+		},
+		{
+			name:    "invalid flash base",
+			json:    `{"parts": [{"name": "A", "silicon_id": "0x04A61193", "flash_base": "flash"}]}`,
+			wantErr: "invalid flash base",
+		},
+		{
+			name:    "flash beyond 4 GB",
+			json:    `{"parts": [{"name": "A", "silicon_id": "0x04A61193", "flash_size": 4096, "flash_base": "0xFFFFF800"}]}`,
+			wantErr: "beyond the 32 bit address space",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := Builtin()
+			err := db.Load(strings.NewReader(tt.json))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load error = %v, want %q", err, tt.wantErr)
+				}
+				if n := len(db.parts); n != len(builtinParts) {
+					t.Errorf("failed Load left %d parts, want %d", n, len(builtinParts))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+
+			a, ok := db.Lookup(0x04A61193, 0x11)
+			if !ok || a.Name != "A" || a.Family != FamilyPSoC4 || a.RowSize != 128 || a.Arrays != 1 {
+				t.Errorf("part A = %+v, %v", a, ok)
+			}
+			if _, ok := db.Lookup(0x04A61193, 0x12); ok {
+				t.Errorf("part A matches revision 0x12")
+			}
+			if b, ok := db.Lookup(78008723, 0x42); !ok || b.Name != "B" || b.Rev != AnyRev {
+				t.Errorf("part B = %+v, %v", b, ok)
+			}
+			if c, ok := db.Lookup(0xE2072100, 0x11); !ok || c.Name != "C" || c.FlashSize != 1<<20 || c.FlashBase != 0x10000000 {
+				t.Errorf("part C = %+v, %v", c, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package simulator
+
+import (
+	"bytes"
+	"sort"
+
+	"bootloader-usb/cyacdParse"
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/dfu_protocol"
+)
+
+// appMetadata is the location of an application recorded by Set Application
+// Metadata.
+type appMetadata struct {
+	start  uint32
+	length uint32
+}
+
+// ConfigForDFUImage returns a Config for a DFU device matching a .cyacd2
+// image: same silicon ID, revision, checksum type and product ID.
+func ConfigForDFUImage(image *cyacdParse.Cyacd2) Config {
+	return Config{
+		SiliconID:         image.SiliconID(),
+		SiliconRev:        uint8(image.SiliconRev()),
+		BootloaderVersion: 0x040000,
+		ChecksumType:      image.ChecksumType(),
+		DFU:               true,
+		ProductID:         image.ProductID(),
+	}
+}
+
+// Data returns a copy of the contents of a programmed DFU row, or nil.
+func (t *Target) Data(address uint32) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data, ok := t.memory[address]
+	if !ok {
+		return nil
+	}
+	return bytes.Clone(data)
+}
+
+// executeDFU runs a DFU command with a valid frame.
+func (t *Target) executeDFU(cmd byte, data []byte) {
+	if cmd == dfu_protocol.CmdEnterDFU {
+		t.enterDFU(data)
+		return
+	}
+
+	// All other commands are ignored until Enter DFU is received
+	if !t.entered {
+		return
+	}
+
+	switch cmd {
+	case dfu_protocol.CmdSendData:
+		t.pending = append(t.pending, data...)
+		t.respond(cybootloader_protocol.StatusSuccess, nil)
+	case dfu_protocol.CmdSendDataWithoutResponse:
+		t.pending = append(t.pending, data...)
+	case dfu_protocol.CmdProgramData:
+		t.programData(data)
+	case dfu_protocol.CmdVerifyData:
+		t.verifyData(data)
+	case dfu_protocol.CmdEraseData:
+		t.eraseData(data)
+	case dfu_protocol.CmdSetAppMetadata:
+		t.setAppMetadata(data)
+	case dfu_protocol.CmdGetMetadata:
+		t.getMetadata(data)
+	case dfu_protocol.CmdSetEIV:
+		t.eiv = bytes.Clone(data)
+		t.respond(cybootloader_protocol.StatusSuccess, nil)
+	case dfu_protocol.CmdVerifyApp:
+		t.verifyApp(data)
+	case dfu_protocol.CmdSync:
+		// Discard buffered data, no response
+		t.pending = nil
+	case dfu_protocol.CmdExitDFU:
+		// The device resets, no response
+		t.entered = false
+		t.exited = true
+		t.pending = nil
+	default:
+		t.respond(cybootloader_protocol.StatusErrCmd, nil)
+	}
+}
+
+func (t *Target) enterDFU(data []byte) {
+	if len(data) != 0 && len(data) != 4 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+	if len(data) == 4 && t.cfg.ProductID != 0 && le32(data) != t.cfg.ProductID {
+		t.respond(cybootloader_protocol.StatusErrDevice, nil)
+		return
+	}
+
+	t.entered = true
+	t.exited = false
+	t.pending = nil
+
+	id, ver := t.cfg.SiliconID, t.cfg.BootloaderVersion
+	t.respond(cybootloader_protocol.StatusSuccess, []byte{
+		byte(id), byte(id >> 8), byte(id >> 16), byte(id >> 24),
+		t.cfg.SiliconRev,
+		byte(ver), byte(ver >> 8), byte(ver >> 16),
+	})
+}
+
+// rowCommand splits a Program Data or Verify Data payload into the address
+// and the whole row, including the data buffered by Send Data, and checks the
+// row against its CRC-32C.
+func (t *Target) rowCommand(data []byte) (uint32, []byte, bool) {
+	defer func() { t.pending = nil }()
+
+	if len(data) < dfu_protocol.RowHeaderSize {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return 0, nil, false
+	}
+
+	address, crc := le32(data), le32(data[4:])
+	row := append(t.pending, data[dfu_protocol.RowHeaderSize:]...)
+
+	if dfu_protocol.RowChecksum(row) != crc {
+		t.respond(cybootloader_protocol.StatusErrChecksum, nil)
+		return 0, nil, false
+	}
+
+	return address, row, true
+}
+
+func (t *Target) programData(data []byte) {
+	address, row, ok := t.rowCommand(data)
+	if !ok {
+		return
+	}
+
+	t.memory[address] = row
+	t.respond(cybootloader_protocol.StatusSuccess, nil)
+}
+
+func (t *Target) verifyData(data []byte) {
+	address, row, ok := t.rowCommand(data)
+	if !ok {
+		return
+	}
+
+	if !bytes.Equal(t.memory[address], row) {
+		t.respond(cybootloader_protocol.StatusErrVerify, nil)
+		return
+	}
+	t.respond(cybootloader_protocol.StatusSuccess, nil)
+}
+
+func (t *Target) eraseData(data []byte) {
+	if len(data) != 4 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+
+	delete(t.memory, le32(data))
+	t.respond(cybootloader_protocol.StatusSuccess, nil)
+}
+
+func (t *Target) setAppMetadata(data []byte) {
+	if len(data) != 9 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+
+	t.metadata[data[0]] = appMetadata{start: le32(data[1:]), length: le32(data[5:])}
+	t.respond(cybootloader_protocol.StatusSuccess, nil)
+}
+
+// getMetadata returns the metadata bytes between two offsets, inclusive. The
+// metadata holds the start address and length of each application in turn.
+func (t *Target) getMetadata(data []byte) {
+	if len(data) != 4 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+
+	var table []byte
+	for app := 0; app < cybootloader_protocol.MaxApps; app++ {
+		m := t.metadata[byte(app)]
+		table = append(table, byte(m.start), byte(m.start>>8), byte(m.start>>16), byte(m.start>>24))
+		table = append(table, byte(m.length), byte(m.length>>8), byte(m.length>>16), byte(m.length>>24))
+	}
+
+	from, to := int(data[0])|int(data[1])<<8, int(data[2])|int(data[3])<<8
+	if from > to || to >= len(table) {
+		t.respond(cybootloader_protocol.StatusErrData, nil)
+		return
+	}
+	t.respond(cybootloader_protocol.StatusSuccess, table[from:to+1])
+}
+
+// verifyApp reports an application as valid when its metadata is set and its
+// whole range is covered by programmed rows.
+func (t *Target) verifyApp(data []byte) {
+	if len(data) != 1 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+
+	m, ok := t.metadata[data[0]]
+	valid := byte(0)
+	if ok && m.length > 0 && t.covered(m.start, m.start+m.length) {
+		valid = 1
+	}
+	t.respond(cybootloader_protocol.StatusSuccess, []byte{valid})
+}
+
+// covered reports whether programmed rows span [start, end) without gaps.
+func (t *Target) covered(start, end uint32) bool {
+	addresses := make([]uint32, 0, len(t.memory))
+	for a := range t.memory {
+		addresses = append(addresses, a)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+
+	next := start
+	for _, a := range addresses {
+		if a > next {
+			break
+		}
+		if rowEnd := a + uint32(len(t.memory[a])); rowEnd > next {
+			next = rowEnd
+		}
+	}
+	return next >= end
+}
+
+func le32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
@@ -0,0 +1,538 @@
+// Package simulator emulates a Cypress bootloader target in memory, so the
+// programming flow can be exercised without hardware.
+package simulator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"bootloader-usb/cyacdParse"
+	"bootloader-usb/cybootloader_protocol"
+)
+
+// ErrReadTimeout is returned by Read when the target has no response pending,
+// as a real device would time out. It wraps cybootloader_protocol.ErrTimeout.
+var ErrReadTimeout = fmt.Errorf("%w: no response pending", cybootloader_protocol.ErrTimeout)
+
+// ErrClosed is returned when using a closed Target.
+var ErrClosed = errors.New("device is closed")
+
+// Array is a flash array of the simulated device.
+type Array struct {
+	ID       uint8
+	StartRow uint16
+	EndRow   uint16
+}
+
+// Config describes the simulated device.
+type Config struct {
+	SiliconID         uint32
+	SiliconRev        uint8
+	BootloaderVersion uint32
+	Key               []byte // Expected 6 byte key, nil if the bootloader has none
+	ChecksumType      cybootloader_protocol.ChecksumType
+	Arrays            []Array
+	RowSize           int // Expected row size in bytes, 0 to accept any size
+	MultiApp          bool
+	ActiveApp         int    // Active application slot when MultiApp is set
+	DFU               bool   // Speak the ModusToolbox DFU protocol instead of the legacy one
+	ProductID         uint32 // Product ID expected by Enter DFU, 0 to accept any
+}
+
+// ConfigForImage returns a Config for a device matching a firmware image: same
+// silicon ID, revision and checksum type, with every array used by the image
+// spanning rows 0 to the highest row of the image.
+func ConfigForImage(image *cyacdParse.Cyacd, key []byte) Config {
+	cfg := Config{
+		SiliconID:         image.SiliconID(),
+		SiliconRev:        uint8(image.SiliconRev()),
+		BootloaderVersion: 0x010000,
+		Key:               key,
+		ChecksumType:      image.ChecksumType(),
+	}
+
+	arrays := make(map[uint8]int)
+	for _, r := range image.ParseRowData() {
+		if cfg.RowSize == 0 {
+			cfg.RowSize = int(r.Size())
+		}
+		i, ok := arrays[r.ArrayID()]
+		if !ok {
+			i = len(cfg.Arrays)
+			arrays[r.ArrayID()] = i
+			cfg.Arrays = append(cfg.Arrays, Array{ID: r.ArrayID()})
+		}
+		if r.RowNum() > cfg.Arrays[i].EndRow {
+			cfg.Arrays[i].EndRow = r.RowNum()
+		}
+	}
+
+	return cfg
+}
+
+// Target is an emulated bootloader implementing io.ReadWriteCloser. Frames
+// written to it are decoded and answered like the real firmware would; the
+// responses are returned by Read.
+type Target struct {
+	mu     sync.Mutex
+	cfg    Config
+	closed bool
+
+	in  []byte // received bytes not yet decoded
+	out []byte // response bytes not yet read
+
+	entered bool
+	exited  bool
+	pending []byte // data received with Send Data for the next row
+	flash   map[uint8]map[uint16][]byte
+	apps    [cybootloader_protocol.MaxApps]cybootloader_protocol.AppStatus
+
+	// DFU state
+	memory   map[uint32][]byte
+	metadata map[byte]appMetadata
+	eiv      []byte
+
+	commands map[byte]int
+}
+
+// New creates a simulated device.
+func New(cfg Config) *Target {
+	t := &Target{
+		cfg:      cfg,
+		flash:    make(map[uint8]map[uint16][]byte),
+		memory:   make(map[uint32][]byte),
+		metadata: make(map[byte]appMetadata),
+		commands: make(map[byte]int),
+	}
+	if cfg.MultiApp && cfg.ActiveApp >= 0 && cfg.ActiveApp < len(t.apps) {
+		t.apps[cfg.ActiveApp] = cybootloader_protocol.AppStatus{Valid: true, Active: true}
+	}
+	return t
+}
+
+// Write feeds bytes to the simulated device. Every complete frame is
+// processed immediately.
+func (t *Target) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return 0, ErrClosed
+	}
+
+	t.in = append(t.in, b...)
+	for t.decode() {
+	}
+
+	return len(b), nil
+}
+
+// Read returns pending response bytes, or ErrReadTimeout if there are none.
+func (t *Target) Read(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return 0, ErrClosed
+	}
+	if len(t.out) == 0 {
+		return 0, ErrReadTimeout
+	}
+
+	n := copy(b, t.out)
+	t.out = t.out[n:]
+	return n, nil
+}
+
+// Close closes the simulated device.
+func (t *Target) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	return nil
+}
+
+// Row returns a copy of the contents of a programmed row, or nil.
+func (t *Target) Row(arrayID uint8, row uint16) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data, ok := t.flash[arrayID][row]
+	if !ok {
+		return nil
+	}
+	return bytes.Clone(data)
+}
+
+// RowsProgrammed returns the number of rows holding data.
+func (t *Target) RowsProgrammed() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := len(t.memory)
+	for _, rows := range t.flash {
+		n += len(rows)
+	}
+	return n
+}
+
+// Exited reports whether the host sent Exit Bootloader.
+func (t *Target) Exited() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.exited
+}
+
+// CommandCount returns how many frames with the given command identifier were
+// received.
+func (t *Target) CommandCount(cmd byte) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.commands[cmd]
+}
+
+// decode processes the first complete frame of the input buffer. It returns
+// false when more bytes are needed.
+func (t *Target) decode() bool {
+	start := bytes.IndexByte(t.in, cybootloader_protocol.CmdStart)
+	if start < 0 {
+		t.in = t.in[:0]
+		return false
+	}
+	t.in = t.in[start:]
+
+	if len(t.in) < 4 {
+		return false
+	}
+
+	size := int(t.in[2]) | int(t.in[3])<<8
+	frameSize := cybootloader_protocol.BaseCmdSize + size
+	if size > cybootloader_protocol.MaxFrameDataSize {
+		t.in = t.in[1:]
+		return true
+	}
+	if len(t.in) < frameSize {
+		return false
+	}
+
+	frame := t.in[:frameSize]
+	t.in = t.in[frameSize:]
+
+	if frame[frameSize-1] != cybootloader_protocol.CmdStop {
+		t.respond(cybootloader_protocol.StatusErrData, nil)
+		return true
+	}
+
+	expected := t.cfg.ChecksumType.Compute(frame[:4+size])
+	received := uint16(frame[4+size]) | uint16(frame[5+size])<<8
+	if expected != received {
+		t.respond(cybootloader_protocol.StatusErrChecksum, nil)
+		return true
+	}
+
+	t.commands[frame[1]]++
+	if t.cfg.DFU {
+		t.executeDFU(frame[1], frame[4:4+size])
+	} else {
+		t.execute(frame[1], frame[4:4+size])
+	}
+	return true
+}
+
+// execute runs a command with a valid frame.
+func (t *Target) execute(cmd byte, data []byte) {
+	if cmd == cybootloader_protocol.CmdEnterBootloader {
+		t.enter(data)
+		return
+	}
+
+	// All other commands are ignored until Enter Bootloader is received
+	if !t.entered {
+		return
+	}
+
+	switch cmd {
+	case cybootloader_protocol.CmdGetFlashSize:
+		t.getFlashSize(data)
+	case cybootloader_protocol.CmdSendData:
+		t.pending = append(t.pending, data...)
+		t.respond(cybootloader_protocol.StatusSuccess, nil)
+	case cybootloader_protocol.CmdProgramRow:
+		t.programRow(data)
+	case cybootloader_protocol.CmdEraseRow:
+		t.eraseRow(data)
+	case cybootloader_protocol.CmdGetRowChecksum:
+		t.getRowChecksum(data)
+	case cybootloader_protocol.CmdVerifyChecksum:
+		t.verifyChecksum()
+	case cybootloader_protocol.CMD_GET_APP_STATUS:
+		t.getAppStatus(data)
+	case cybootloader_protocol.CMD_SET_ACTIVE_APP:
+		t.setActiveApp(data)
+	case cybootloader_protocol.CMD_SYNC:
+		// Discard buffered data, no response
+		t.pending = nil
+	case cybootloader_protocol.CmdGetMetadata:
+		t.getAppMetadata(data)
+	case cybootloader_protocol.CmdExitBootloader:
+		// The device resets, no response
+		t.entered = false
+		t.exited = true
+		t.pending = nil
+	default:
+		t.respond(cybootloader_protocol.StatusErrCmd, nil)
+	}
+}
+
+func (t *Target) enter(data []byte) {
+	if t.cfg.Key != nil && !bytes.Equal(data, t.cfg.Key) {
+		t.respond(cybootloader_protocol.StatusErrKey, nil)
+		return
+	}
+	if t.cfg.Key == nil && len(data) != 0 && len(data) != 6 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+
+	t.entered = true
+	t.exited = false
+	t.pending = nil
+
+	id, ver := t.cfg.SiliconID, t.cfg.BootloaderVersion
+	t.respond(cybootloader_protocol.StatusSuccess, []byte{
+		byte(id), byte(id >> 8), byte(id >> 16), byte(id >> 24),
+		t.cfg.SiliconRev,
+		byte(ver), byte(ver >> 8), byte(ver >> 16),
+	})
+}
+
+func (t *Target) array(id uint8) (Array, bool) {
+	for _, a := range t.cfg.Arrays {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return Array{}, false
+}
+
+// checkRow validates the array ID and row number at the start of data.
+func (t *Target) checkRow(data []byte) (uint8, uint16, bool) {
+	if len(data) < 3 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return 0, 0, false
+	}
+
+	arrayID, row := data[0], uint16(data[1])|uint16(data[2])<<8
+	a, ok := t.array(arrayID)
+	if !ok {
+		t.respond(cybootloader_protocol.StatusErrArray, nil)
+		return 0, 0, false
+	}
+	if row < a.StartRow || row > a.EndRow {
+		t.respond(cybootloader_protocol.StatusErrRow, nil)
+		return 0, 0, false
+	}
+
+	return arrayID, row, true
+}
+
+func (t *Target) getFlashSize(data []byte) {
+	if len(data) != 1 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+
+	a, ok := t.array(data[0])
+	if !ok {
+		t.respond(cybootloader_protocol.StatusErrArray, nil)
+		return
+	}
+
+	t.respond(cybootloader_protocol.StatusSuccess, []byte{
+		byte(a.StartRow), byte(a.StartRow >> 8),
+		byte(a.EndRow), byte(a.EndRow >> 8),
+	})
+}
+
+func (t *Target) programRow(data []byte) {
+	arrayID, row, ok := t.checkRow(data)
+	if !ok {
+		t.pending = nil
+		return
+	}
+
+	rowData := append(t.pending, data[3:]...)
+	t.pending = nil
+
+	if t.cfg.RowSize > 0 && len(rowData) != t.cfg.RowSize {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+
+	if t.flash[arrayID] == nil {
+		t.flash[arrayID] = make(map[uint16][]byte)
+	}
+	t.flash[arrayID][row] = rowData
+
+	t.respond(cybootloader_protocol.StatusSuccess, nil)
+}
+
+func (t *Target) eraseRow(data []byte) {
+	if len(data) != 3 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+
+	arrayID, row, ok := t.checkRow(data)
+	if !ok {
+		return
+	}
+
+	delete(t.flash[arrayID], row)
+
+	t.respond(cybootloader_protocol.StatusSuccess, nil)
+}
+
+func (t *Target) getRowChecksum(data []byte) {
+	if len(data) != 3 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+
+	arrayID, row, ok := t.checkRow(data)
+	if !ok {
+		return
+	}
+
+	// Two's complement of the sum of the row bytes, like the firmware
+	var sum byte
+	for _, b := range t.flash[arrayID][row] {
+		sum += b
+	}
+	t.respond(cybootloader_protocol.StatusSuccess, []byte{1 + ^sum})
+}
+
+// verifyChecksum reports the application as valid once rows were programmed.
+// The simulator does not check the application against its metadata, so every
+// programmed image is considered consistent.
+func (t *Target) verifyChecksum() {
+	valid := byte(0)
+	if len(t.flash) > 0 {
+		valid = 1
+
+		// On a multi app bootloader the slot that was just written is the
+		// inactive one
+		for i := range t.apps {
+			if t.cfg.MultiApp && !t.apps[i].Active {
+				t.apps[i].Valid = true
+			}
+		}
+	}
+	t.respond(cybootloader_protocol.StatusSuccess, []byte{valid})
+}
+
+// metadataRow locates the row holding the metadata of an application: the
+// last row of flash, or the row before it for application 1 of a multi app
+// bootloader.
+func (t *Target) metadataRow(app int) (uint8, uint16, bool) {
+	if len(t.cfg.Arrays) == 0 {
+		return 0, 0, false
+	}
+
+	last := t.cfg.Arrays[0]
+	for _, a := range t.cfg.Arrays {
+		if a.ID > last.ID {
+			last = a
+		}
+	}
+	return last.ID, last.EndRow - uint16(app), true
+}
+
+// readMetadata returns the MetadataSize bytes of metadata of an application.
+// Rows never programmed read as zeros.
+func (t *Target) readMetadata(app int) []byte {
+	row := make([]byte, cybootloader_protocol.MetadataRowSize)
+	if arrayID, rowNum, ok := t.metadataRow(app); ok {
+		if programmed, ok := t.flash[arrayID][rowNum]; ok && len(programmed) >= len(row) {
+			row = programmed
+		}
+	}
+	offset := len(row) - cybootloader_protocol.MetadataRowSize
+	return row[offset : offset+cybootloader_protocol.MetadataSize]
+}
+
+// getAppMetadata answers Get Metadata with the metadata of an application.
+func (t *Target) getAppMetadata(data []byte) {
+	if len(data) != 1 {
+		t.respond(cybootloader_protocol.StatusErrLength, nil)
+		return
+	}
+	app := int(data[0])
+	if app > 0 && (!t.cfg.MultiApp || app >= cybootloader_protocol.MaxApps) || len(t.cfg.Arrays) == 0 {
+		t.respond(cybootloader_protocol.StatusErrApp, nil)
+		return
+	}
+
+	t.respond(cybootloader_protocol.StatusSuccess, t.readMetadata(app))
+}
+
+func (t *Target) getAppStatus(data []byte) {
+	if !t.cfg.MultiApp {
+		t.respond(cybootloader_protocol.StatusErrCmd, nil)
+		return
+	}
+	if len(data) != 1 || int(data[0]) >= len(t.apps) {
+		t.respond(cybootloader_protocol.StatusErrApp, nil)
+		return
+	}
+
+	status := t.apps[data[0]]
+	t.respond(cybootloader_protocol.StatusSuccess, []byte{boolByte(status.Valid), boolByte(status.Active)})
+}
+
+func (t *Target) setActiveApp(data []byte) {
+	if !t.cfg.MultiApp {
+		t.respond(cybootloader_protocol.StatusErrCmd, nil)
+		return
+	}
+	if len(data) != 1 || int(data[0]) >= len(t.apps) || !t.apps[data[0]].Valid {
+		t.respond(cybootloader_protocol.StatusErrApp, nil)
+		return
+	}
+
+	for i := range t.apps {
+		t.apps[i].Active = i == int(data[0])
+	}
+	t.respond(cybootloader_protocol.StatusSuccess, nil)
+}
+
+// respond queues a response frame.
+func (t *Target) respond(status cybootloader_protocol.Status, data []byte) {
+	frame := make([]byte, 0, cybootloader_protocol.BaseCmdSize+len(data))
+	frame = append(frame, cybootloader_protocol.CmdStart, byte(status), byte(len(data)), byte(len(data)>>8))
+	frame = append(frame, data...)
+	frame = append(frame, 0, 0, cybootloader_protocol.CmdStop)
+	cybootloader_protocol.UpdateFrameChecksum(frame, t.cfg.ChecksumType)
+
+	t.out = append(t.out, frame...)
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// String describes the simulated device, for logs.
+func (c Config) String() string {
+	if c.DFU {
+		return fmt.Sprintf("DFU silicon 0x%08x rev 0x%02x, product 0x%08x, checksum %s", c.SiliconID, c.SiliconRev, c.ProductID, c.ChecksumType)
+	}
+	return fmt.Sprintf("silicon 0x%08x rev 0x%02x, %d arrays, checksum %s", c.SiliconID, c.SiliconRev, len(c.Arrays), c.ChecksumType)
+}
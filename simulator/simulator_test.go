@@ -0,0 +1,306 @@
+package simulator_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"bootloader-usb/cyacdParse"
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/simulator"
+)
+
+var testKey = []byte{0x0A, 0x1B, 0x2C, 0x3D, 0x4E, 0x5F}
+
+func testConfig() simulator.Config {
+	return simulator.Config{
+		SiliconID:         0x04C81193,
+		SiliconRev:        0x11,
+		BootloaderVersion: 0x010203,
+		Key:               testKey,
+		ChecksumType:      cybootloader_protocol.ChecksumSum,
+		Arrays:            []simulator.Array{{ID: 0, StartRow: 16, EndRow: 255}, {ID: 1, StartRow: 0, EndRow: 255}},
+		RowSize:           128,
+	}
+}
+
+// enter starts a bootloader session with a simulated device.
+func enter(t *testing.T, cfg simulator.Config) (*cybootloader_protocol.Host, *simulator.Target) {
+	t.Helper()
+
+	sim := simulator.New(cfg)
+	h := cybootloader_protocol.NewHost(sim)
+	h.SetChecksumType(cfg.ChecksumType)
+
+	if _, err := h.EnterBootloader(context.Background(), cfg.Key); err != nil {
+		t.Fatalf("EnterBootloader: %v", err)
+	}
+	return h, sim
+}
+
+func testRow(size int, seed byte) []byte {
+	row := make([]byte, size)
+	for i := range row {
+		row[i] = byte(i*3) + seed
+	}
+	return row
+}
+
+func TestEnterBootloader(t *testing.T) {
+	ctx := context.Background()
+	for _, checksumType := range []cybootloader_protocol.ChecksumType{cybootloader_protocol.ChecksumSum, cybootloader_protocol.ChecksumCRC16} {
+		t.Run(checksumType.String(), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ChecksumType = checksumType
+			h := cybootloader_protocol.NewHost(simulator.New(cfg))
+			h.SetChecksumType(checksumType)
+
+			if _, err := h.EnterBootloader(ctx, []byte{0, 0, 0, 0, 0, 0}); !errors.Is(err, cybootloader_protocol.StatusErrKey) {
+				t.Errorf("EnterBootloader with a wrong key: %v, want CYRET_ERR_KEY", err)
+			}
+
+			info, err := h.EnterBootloader(ctx, testKey)
+			if err != nil {
+				t.Fatalf("EnterBootloader: %v", err)
+			}
+			want := cybootloader_protocol.DeviceInfo{SiliconID: 0x04C81193, SiliconRev: 0x11, BootloaderVersion: 0x010203}
+			if info != want {
+				t.Errorf("EnterBootloader = %+v, want %+v", info, want)
+			}
+		})
+	}
+}
+
+func TestCommandsIgnoredBeforeEnter(t *testing.T) {
+	cfg := testConfig()
+	sim := simulator.New(cfg)
+
+	if _, err := sim.Write(cybootloader_protocol.CreateGetFlashSizeArrayCmd(0, cfg.ChecksumType)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	_, err := sim.Read(make([]byte, 64))
+	if !errors.Is(err, simulator.ErrReadTimeout) || !cybootloader_protocol.IsTimeout(err) {
+		t.Errorf("Read = %v, want a timeout", err)
+	}
+}
+
+func TestBadFrameChecksum(t *testing.T) {
+	_, sim := enter(t, testConfig())
+
+	frame := cybootloader_protocol.CreateGetFlashSizeArrayCmd(0, cybootloader_protocol.ChecksumSum)
+	frame[len(frame)-2] ^= 0xFF
+	if _, err := sim.Write(frame); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	r := make([]byte, 64)
+	n, err := sim.Read(r)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	_, err = cybootloader_protocol.CheckResponse(cybootloader_protocol.CmdGetFlashSize, r[:n], 0, cybootloader_protocol.ChecksumSum)
+	if !errors.Is(err, cybootloader_protocol.StatusErrChecksum) {
+		t.Errorf("response = %v, want CYRET_ERR_CHECKSUM", err)
+	}
+}
+
+func TestGetFlashSize(t *testing.T) {
+	ctx := context.Background()
+	h, _ := enter(t, testConfig())
+
+	size, err := h.GetFlashSize(ctx, 0)
+	if err != nil {
+		t.Fatalf("GetFlashSize: %v", err)
+	}
+	if size != (cybootloader_protocol.FlashSize{StartRow: 16, EndRow: 255}) {
+		t.Errorf("GetFlashSize = %+v", size)
+	}
+	if _, err := h.GetFlashSize(ctx, 2); !errors.Is(err, cybootloader_protocol.StatusErrArray) {
+		t.Errorf("GetFlashSize of a missing array: %v, want CYRET_ERR_ARRAY", err)
+	}
+}
+
+func TestProgramRow(t *testing.T) {
+	ctx := context.Background()
+	h, sim := enter(t, testConfig())
+
+	row := testRow(128, 1)
+	if err := h.ProgramRow(ctx, 1, 42, row); err != nil {
+		t.Fatalf("ProgramRow: %v", err)
+	}
+	if got := sim.Row(1, 42); !bytes.Equal(got, row) {
+		t.Errorf("row holds % X, want % X", got, row)
+	}
+	if n := sim.RowsProgrammed(); n != 1 {
+		t.Errorf("RowsProgrammed = %d, want 1", n)
+	}
+
+	var sum byte
+	for _, b := range row {
+		sum += b
+	}
+	if ck, err := h.GetRowChecksum(ctx, 1, 42); err != nil || ck != -sum {
+		t.Errorf("GetRowChecksum = 0x%02X, %v, want 0x%02X", ck, err, -sum)
+	}
+
+	if err := h.EraseRow(ctx, 1, 42); err != nil {
+		t.Fatalf("EraseRow: %v", err)
+	}
+	if got := sim.Row(1, 42); got != nil {
+		t.Errorf("erased row holds % X", got)
+	}
+}
+
+func TestProgramRowErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		arrayID byte
+		row     uint16
+		size    int
+		want    cybootloader_protocol.Status
+	}{
+		{"missing array", 2, 16, 128, cybootloader_protocol.StatusErrArray},
+		{"bootloader row", 0, 15, 128, cybootloader_protocol.StatusErrRow},
+		{"past the array", 0, 256, 128, cybootloader_protocol.StatusErrRow},
+		{"short row", 0, 16, 127, cybootloader_protocol.StatusErrLength},
+		{"long row", 0, 16, 129, cybootloader_protocol.StatusErrLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, sim := enter(t, testConfig())
+
+			err := h.ProgramRow(context.Background(), tt.arrayID, tt.row, testRow(tt.size, 1))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("ProgramRow: %v, want %v", err, tt.want)
+			}
+			if n := sim.RowsProgrammed(); n != 0 {
+				t.Errorf("RowsProgrammed = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestSyncDiscardsData(t *testing.T) {
+	ctx := context.Background()
+	h, sim := enter(t, testConfig())
+
+	if err := h.SendData(ctx, []byte{0xEE, 0xEE, 0xEE}); err != nil {
+		t.Fatalf("SendData: %v", err)
+	}
+	if err := h.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	row := testRow(128, 1)
+	if err := h.ProgramRow(ctx, 0, 16, row); err != nil {
+		t.Fatalf("ProgramRow after Sync: %v", err)
+	}
+	if got := sim.Row(0, 16); !bytes.Equal(got, row) {
+		t.Errorf("row holds % X, want % X", got, row)
+	}
+}
+
+func TestMultiApp(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig()
+	cfg.MultiApp = true
+	cfg.ActiveApp = 0
+	h, _ := enter(t, cfg)
+
+	if status, err := h.GetAppStatus(ctx, 0); err != nil || status != (cybootloader_protocol.AppStatus{Valid: true, Active: true}) {
+		t.Errorf("GetAppStatus(0) = %+v, %v", status, err)
+	}
+	if err := h.SetActiveApp(ctx, 1); !errors.Is(err, cybootloader_protocol.StatusErrApp) {
+		t.Errorf("SetActiveApp of an invalid app: %v, want CYRET_ERR_APP", err)
+	}
+
+	if err := h.ProgramRow(ctx, 0, 16, testRow(128, 1)); err != nil {
+		t.Fatalf("ProgramRow: %v", err)
+	}
+	if valid, err := h.VerifyAppChecksum(ctx); err != nil || valid == 0 {
+		t.Fatalf("VerifyAppChecksum = %d, %v", valid, err)
+	}
+	if err := h.SetActiveApp(ctx, 1); err != nil {
+		t.Fatalf("SetActiveApp: %v", err)
+	}
+	if status, err := h.GetAppStatus(ctx, 0); err != nil || status != (cybootloader_protocol.AppStatus{Valid: true}) {
+		t.Errorf("GetAppStatus(0) after switching = %+v, %v", status, err)
+	}
+	if status, err := h.GetAppStatus(ctx, 1); err != nil || status != (cybootloader_protocol.AppStatus{Valid: true, Active: true}) {
+		t.Errorf("GetAppStatus(1) after switching = %+v, %v", status, err)
+	}
+}
+
+func TestSingleAppRejectsAppCommands(t *testing.T) {
+	h, _ := enter(t, testConfig())
+	if _, err := h.GetAppStatus(context.Background(), 0); !errors.Is(err, cybootloader_protocol.StatusErrCmd) {
+		t.Errorf("GetAppStatus: %v, want CYRET_ERR_CMD", err)
+	}
+}
+
+func TestGetMetadata(t *testing.T) {
+	ctx := context.Background()
+	h, _ := enter(t, testConfig())
+
+	// The metadata sits at the end of the last row of the last array
+	row := make([]byte, 128)
+	md := row[128-cybootloader_protocol.MetadataRowSize:]
+	md[0x00] = 0x5A
+	copy(md[0x0B:], []byte{0x00, 0x02, 0x00, 0x00})
+	copy(md[0x15:], []byte{0x03, 0x01})
+	if err := h.ProgramRow(ctx, 1, 255, row); err != nil {
+		t.Fatalf("ProgramRow: %v", err)
+	}
+
+	got, err := h.GetMetadata(ctx, 0)
+	if err != nil {
+		t.Fatalf("GetMetadata: %v", err)
+	}
+	if got.Checksum != 0x5A || got.Length != 0x200 || got.AppVersion != 0x0103 {
+		t.Errorf("GetMetadata = %+v", got)
+	}
+	if _, err := h.GetMetadata(ctx, 1); !errors.Is(err, cybootloader_protocol.StatusErrApp) {
+		t.Errorf("GetMetadata of app 1 on a single app bootloader: %v, want CYRET_ERR_APP", err)
+	}
+}
+
+func TestExitAndClose(t *testing.T) {
+	h, sim := enter(t, testConfig())
+
+	if err := h.Exit(context.Background()); err != nil {
+		t.Fatalf("Exit: %v", err)
+	}
+	if !sim.Exited() {
+		t.Error("device did not leave the bootloader")
+	}
+
+	if err := sim.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := sim.Write([]byte{cybootloader_protocol.CmdStart}); !errors.Is(err, simulator.ErrClosed) {
+		t.Errorf("Write after Close: %v, want ErrClosed", err)
+	}
+	if _, err := sim.Read(make([]byte, 1)); !errors.Is(err, simulator.ErrClosed) {
+		t.Errorf("Read after Close: %v, want ErrClosed", err)
+	}
+}
+
+func TestConfigForImage(t *testing.T) {
+	image, err := cyacdParse.ParseCyacdBytes([]byte("04C8119311\r\n"+
+		":000020000401020304D2\r\n"+
+		":0000210004AABBCCDDCD\r\n"+
+		":0100000004102030405B\r\n"), "test.cyacd")
+	if err != nil {
+		t.Fatalf("ParseCyacdBytes: %v", err)
+	}
+
+	cfg := simulator.ConfigForImage(image, testKey)
+	if cfg.SiliconID != 0x04C81193 || cfg.SiliconRev != 0x11 || cfg.RowSize != 4 ||
+		cfg.ChecksumType != cybootloader_protocol.ChecksumSum || !bytes.Equal(cfg.Key, testKey) {
+		t.Errorf("ConfigForImage = %v, row size %d", cfg, cfg.RowSize)
+	}
+	want := []simulator.Array{{ID: 0, EndRow: 0x21}, {ID: 1, EndRow: 0}}
+	if len(cfg.Arrays) != len(want) || cfg.Arrays[0] != want[0] || cfg.Arrays[1] != want[1] {
+		t.Errorf("arrays = %+v, want %+v", cfg.Arrays, want)
+	}
+}
@@ -0,0 +1,391 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/dfu_protocol"
+)
+
+// ErrInjectedTimeout is returned by Read when a response was dropped. It wraps
+// cybootloader_protocol.ErrTimeout, so the host handles it as a read timeout.
+var ErrInjectedTimeout = fmt.Errorf("%w: response dropped by fault injector", cybootloader_protocol.ErrTimeout)
+
+// Action is the fault applied to a frame.
+type Action string
+
+const (
+	ActionDrop      Action = "drop"      // The frame is never delivered
+	ActionDuplicate Action = "duplicate" // The frame is delivered twice
+	ActionTruncate  Action = "truncate"  // Only the first Bytes bytes are delivered
+	ActionDelay     Action = "delay"     // The frame is delivered after Delay
+	ActionBitFlip   Action = "bitflip"   // Bytes random bits of the frame are inverted
+)
+
+// Direction selects whether a rule applies to commands sent to the device or
+// to the responses read back.
+type Direction string
+
+const (
+	DirWrite Direction = "write"
+	DirRead  Direction = "read"
+)
+
+// Rule describes when and how to corrupt a frame. A rule matches frames in
+// its direction whose command (for responses, the command being answered) is
+// Cmd, or any command if Cmd is zero. It fires on the Nth match, or, when Nth
+// is zero, on each match with the given Probability (every match if zero).
+type Rule struct {
+	Action      Action
+	Direction   Direction
+	Cmd         byte
+	Nth         int
+	Probability float64
+	Delay       time.Duration
+	Bytes       int
+}
+
+// Schedule is an ordered list of rules. The first rule that fires for a frame
+// is applied.
+type Schedule []Rule
+
+// Injection records a fault that was applied.
+type Injection struct {
+	Rule  Rule
+	Cmd   byte
+	Count int // Occurrence of the matching frame that triggered the rule
+}
+
+func (i Injection) String() string {
+	return fmt.Sprintf("%s %s of command 0x%02X (match #%d)", i.Rule.Action, i.Rule.Direction, i.Cmd, i.Count)
+}
+
+// commandNames are the command names accepted in a schedule specification.
+var commandNames = map[string]byte{
+	"verifychecksum":  cybootloader_protocol.CmdVerifyChecksum,
+	"getflashsize":    cybootloader_protocol.CmdGetFlashSize,
+	"getappstatus":    cybootloader_protocol.CMD_GET_APP_STATUS,
+	"eraserow":        cybootloader_protocol.CmdEraseRow,
+	"sync":            cybootloader_protocol.CMD_SYNC,
+	"setactiveapp":    cybootloader_protocol.CMD_SET_ACTIVE_APP,
+	"senddata":        cybootloader_protocol.CmdSendData,
+	"enterbootloader": cybootloader_protocol.CmdEnterBootloader,
+	"programrow":      cybootloader_protocol.CmdProgramRow,
+	"getrowchecksum":  cybootloader_protocol.CmdGetRowChecksum,
+	"exitbootloader":  cybootloader_protocol.CmdExitBootloader,
+	"getmetadata":     cybootloader_protocol.CmdGetMetadata, // same identifier in DFU
+
+	// ModusToolbox DFU
+	"verifyapp":               dfu_protocol.CmdVerifyApp,
+	"enterdfu":                dfu_protocol.CmdEnterDFU,
+	"exitdfu":                 dfu_protocol.CmdExitDFU,
+	"erasedata":               dfu_protocol.CmdEraseData,
+	"senddatawithoutresponse": dfu_protocol.CmdSendDataWithoutResponse,
+	"programdata":             dfu_protocol.CmdProgramData,
+	"verifydata":              dfu_protocol.CmdVerifyData,
+	"setappmetadata":          dfu_protocol.CmdSetAppMetadata,
+	"seteiv":                  dfu_protocol.CmdSetEIV,
+}
+
+// ParseSchedule parses a schedule specification: rules separated by ';', each
+// a comma separated list of key=value pairs. Keys are action (drop,
+// duplicate, truncate, delay, bitflip), dir (read, write; default read), cmd
+// (command name such as ProgramRow, or a number such as 0x39; default any),
+// nth, p (probability), delay (duration) and bytes. For example, to corrupt
+// the 3rd Program Row response:
+//
+//	action=bitflip,cmd=ProgramRow,nth=3
+func ParseSchedule(spec string) (Schedule, error) {
+	var schedule Schedule
+
+	for _, ruleSpec := range strings.Split(spec, ";") {
+		ruleSpec = strings.TrimSpace(ruleSpec)
+		if ruleSpec == "" {
+			continue
+		}
+
+		rule := Rule{Direction: DirRead, Bytes: 1}
+		for _, field := range strings.Split(ruleSpec, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid fault rule %q: expected key=value, got %q", ruleSpec, field)
+			}
+			if err := rule.set(strings.ToLower(key), value); err != nil {
+				return nil, fmt.Errorf("invalid fault rule %q: %w", ruleSpec, err)
+			}
+		}
+
+		switch rule.Action {
+		case ActionDrop, ActionDuplicate, ActionTruncate, ActionDelay, ActionBitFlip:
+		case "":
+			return nil, fmt.Errorf("invalid fault rule %q: missing action", ruleSpec)
+		default:
+			return nil, fmt.Errorf("invalid fault rule %q: unknown action %q", ruleSpec, rule.Action)
+		}
+
+		schedule = append(schedule, rule)
+	}
+
+	return schedule, nil
+}
+
+func (r *Rule) set(key, value string) error {
+	var err error
+
+	switch key {
+	case "action":
+		r.Action = Action(strings.ToLower(value))
+	case "dir":
+		r.Direction = Direction(strings.ToLower(value))
+		if r.Direction != DirRead && r.Direction != DirWrite {
+			return fmt.Errorf("unknown direction %q", value)
+		}
+	case "cmd":
+		if id, ok := commandNames[strings.ToLower(value)]; ok {
+			r.Cmd = id
+			return nil
+		}
+		var n uint64
+		n, err = strconv.ParseUint(value, 0, 8)
+		r.Cmd = byte(n)
+	case "nth":
+		r.Nth, err = strconv.Atoi(value)
+	case "p":
+		r.Probability, err = strconv.ParseFloat(value, 64)
+	case "delay":
+		r.Delay, err = time.ParseDuration(value)
+	case "bytes":
+		r.Bytes, err = strconv.Atoi(value)
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return nil
+}
+
+// FaultInjector wraps a peripheral and corrupts the frames going through it
+// according to a Schedule. Randomness comes from a seeded source, so a run can
+// be reproduced exactly.
+//
+// Each Write is expected to carry one complete command, as written by
+// cybootloader_protocol.Host. Response faults apply to the first read that
+// returns data after the command was written.
+type FaultInjector struct {
+	mu       sync.Mutex
+	dev      io.ReadWriteCloser
+	schedule Schedule
+	rng      *rand.Rand
+	counts   []int
+	onInject func(Injection)
+
+	injections []Injection
+	lastCmd    byte
+	response   *Rule  // fault to apply to the response of lastCmd
+	queued     []byte // duplicated response bytes still to be returned
+}
+
+// NewFaultInjector wraps dev with the given schedule and random seed.
+func NewFaultInjector(dev io.ReadWriteCloser, schedule Schedule, seed int64) *FaultInjector {
+	return &FaultInjector{
+		dev:      dev,
+		schedule: schedule,
+		rng:      rand.New(rand.NewSource(seed)),
+		counts:   make([]int, len(schedule)),
+	}
+}
+
+// OnInject registers a function called every time a fault is applied.
+func (f *FaultInjector) OnInject(fn func(Injection)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.onInject = fn
+}
+
+// Injections returns the faults applied so far.
+func (f *FaultInjector) Injections() []Injection {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Injection(nil), f.injections...)
+}
+
+// match returns the rule firing for a frame, if any.
+func (f *FaultInjector) match(dir Direction, cmd byte) *Rule {
+	for i := range f.schedule {
+		rule := &f.schedule[i]
+		if rule.Direction != dir || (rule.Cmd != 0 && rule.Cmd != cmd) {
+			continue
+		}
+
+		f.counts[i]++
+		fire := false
+		switch {
+		case rule.Nth > 0:
+			fire = f.counts[i] == rule.Nth
+		case rule.Probability > 0:
+			fire = f.rng.Float64() < rule.Probability
+		default:
+			fire = true
+		}
+
+		if fire {
+			inj := Injection{Rule: *rule, Cmd: cmd, Count: f.counts[i]}
+			f.injections = append(f.injections, inj)
+			if f.onInject != nil {
+				f.onInject(inj)
+			}
+			return rule
+		}
+	}
+	return nil
+}
+
+// corrupt applies a truncate or bit flip rule to a copy of b.
+func (f *FaultInjector) corrupt(rule *Rule, b []byte) []byte {
+	out := append([]byte(nil), b...)
+
+	switch rule.Action {
+	case ActionTruncate:
+		if rule.Bytes < len(out) {
+			out = out[:rule.Bytes]
+		}
+	case ActionBitFlip:
+		if len(out) > 0 {
+			for i := 0; i < max(rule.Bytes, 1); i++ {
+				pos := f.rng.Intn(len(out))
+				out[pos] ^= 1 << uint(f.rng.Intn(8))
+			}
+		}
+	}
+	return out
+}
+
+// Write forwards a command to the device, applying any write fault.
+func (f *FaultInjector) Write(b []byte) (int, error) {
+	return f.WriteContext(context.Background(), b)
+}
+
+// WriteContext is Write bounded by ctx when the device supports it.
+func (f *FaultInjector) WriteContext(ctx context.Context, b []byte) (int, error) {
+	f.mu.Lock()
+
+	var cmd byte
+	if len(b) > 1 {
+		cmd = b[1]
+	}
+	f.lastCmd = cmd
+	f.response = f.match(DirRead, cmd)
+	f.queued = nil
+	rule := f.match(DirWrite, cmd)
+
+	f.mu.Unlock()
+
+	if rule == nil {
+		return writeContext(ctx, f.dev, b)
+	}
+
+	switch rule.Action {
+	case ActionDrop:
+		return len(b), nil
+	case ActionDelay:
+		if err := sleepContext(ctx, rule.Delay); err != nil {
+			return 0, err
+		}
+		return writeContext(ctx, f.dev, b)
+	case ActionDuplicate:
+		if _, err := writeContext(ctx, f.dev, b); err != nil {
+			return 0, err
+		}
+		return writeContext(ctx, f.dev, b)
+	default:
+		f.mu.Lock()
+		out := f.corrupt(rule, b)
+		f.mu.Unlock()
+		if _, err := writeContext(ctx, f.dev, out); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+}
+
+// Read returns data from the device, applying the fault selected for the
+// response of the last command.
+func (f *FaultInjector) Read(b []byte) (int, error) {
+	return f.ReadContext(context.Background(), b)
+}
+
+// ReadContext is Read bounded by ctx when the device supports it.
+func (f *FaultInjector) ReadContext(ctx context.Context, b []byte) (int, error) {
+	f.mu.Lock()
+	if len(f.queued) > 0 {
+		n := copy(b, f.queued)
+		f.queued = f.queued[n:]
+		f.mu.Unlock()
+		return n, nil
+	}
+	f.mu.Unlock()
+
+	n, err := readContext(ctx, f.dev, b)
+	if n == 0 {
+		return n, err
+	}
+
+	f.mu.Lock()
+	rule := f.response
+	f.response = nil
+	f.mu.Unlock()
+
+	if rule == nil {
+		return n, err
+	}
+
+	switch rule.Action {
+	case ActionDrop:
+		return 0, ErrInjectedTimeout
+	case ActionDelay:
+		// A response delayed past ctx is lost
+		if err := sleepContext(ctx, rule.Delay); err != nil {
+			return 0, err
+		}
+		return n, err
+	case ActionDuplicate:
+		f.mu.Lock()
+		f.queued = append([]byte(nil), b[:n]...)
+		f.mu.Unlock()
+		return n, err
+	default:
+		f.mu.Lock()
+		out := f.corrupt(rule, b[:n])
+		f.mu.Unlock()
+		return copy(b, out), err
+	}
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Close closes the wrapped device.
+func (f *FaultInjector) Close() error {
+	return f.dev.Close()
+}
@@ -0,0 +1,249 @@
+package transport_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/dfu_protocol"
+	"bootloader-usb/simulator"
+	"bootloader-usb/transport"
+)
+
+// newSimulator returns a simulated device that has entered bootloader mode.
+func newSimulator(t *testing.T) *simulator.Target {
+	t.Helper()
+
+	sim := simulator.New(simulator.Config{
+		SiliconID:    0x04C81193,
+		ChecksumType: cybootloader_protocol.ChecksumSum,
+		Arrays:       []simulator.Array{{ID: 0, StartRow: 16, EndRow: 255}},
+		RowSize:      128,
+	})
+	if _, err := cybootloader_protocol.NewHost(sim).EnterBootloader(context.Background(), nil); err != nil {
+		t.Fatalf("EnterBootloader: %v", err)
+	}
+	return sim
+}
+
+func newInjector(t *testing.T, spec string, seed int64) (*transport.FaultInjector, *simulator.Target) {
+	t.Helper()
+
+	schedule, err := transport.ParseSchedule(spec)
+	if err != nil {
+		t.Fatalf("ParseSchedule(%q): %v", spec, err)
+	}
+	sim := newSimulator(t)
+	return transport.NewFaultInjector(sim, schedule, seed), sim
+}
+
+var getFlashSize = cybootloader_protocol.CreateGetFlashSizeArrayCmd(0, cybootloader_protocol.ChecksumSum)
+
+// flashSizeResponse is the response of the simulated device to getFlashSize.
+var flashSizeResponse = []byte{0x01, 0x00, 0x04, 0x00, 0x10, 0x00, 0xFF, 0x00, 0xEC, 0xFE, 0x17}
+
+// transact writes getFlashSize and returns the bytes read back.
+func transact(t *testing.T, f *transport.FaultInjector) ([]byte, error) {
+	t.Helper()
+
+	if _, err := f.Write(getFlashSize); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	b := make([]byte, 64)
+	n, err := f.Read(b)
+	return b[:n], err
+}
+
+func TestParseSchedule(t *testing.T) {
+	schedule, err := transport.ParseSchedule("action=bitflip,cmd=ProgramRow,nth=3; action=delay,dir=write,cmd=0x31,delay=20ms,p=0.5;action=truncate,cmd=VerifyData,bytes=4")
+	if err != nil {
+		t.Fatalf("ParseSchedule: %v", err)
+	}
+
+	want := transport.Schedule{
+		{Action: transport.ActionBitFlip, Direction: transport.DirRead, Cmd: cybootloader_protocol.CmdProgramRow, Nth: 3, Bytes: 1},
+		{Action: transport.ActionDelay, Direction: transport.DirWrite, Cmd: 0x31, Probability: 0.5, Delay: 20 * time.Millisecond, Bytes: 1},
+		{Action: transport.ActionTruncate, Direction: transport.DirRead, Cmd: dfu_protocol.CmdVerifyData, Bytes: 4},
+	}
+	if len(schedule) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(schedule), len(want))
+	}
+	for i := range want {
+		if schedule[i] != want[i] {
+			t.Errorf("rule %d = %+v, want %+v", i, schedule[i], want[i])
+		}
+	}
+
+	if schedule, err := transport.ParseSchedule(" ; "); err != nil || len(schedule) != 0 {
+		t.Errorf("ParseSchedule of an empty spec = %v, %v", schedule, err)
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"cmd=ProgramRow",
+		"action=explode",
+		"action=drop,dir=sideways",
+		"action=drop,cmd=0x100",
+		"action=drop,cmd=NoSuchCommand",
+		"action=drop,nth=third",
+		"action=delay,delay=soon",
+		"action=drop,color=red",
+		"action=drop,nth",
+	} {
+		if _, err := transport.ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestNoFault(t *testing.T) {
+	f, _ := newInjector(t, "action=drop,cmd=ProgramRow", 1)
+
+	r, err := transact(t, f)
+	if err != nil || !bytes.Equal(r, flashSizeResponse) {
+		t.Errorf("response = % X, %v, want % X", r, err, flashSizeResponse)
+	}
+	if len(f.Injections()) != 0 {
+		t.Errorf("Injections = %v", f.Injections())
+	}
+}
+
+func TestWriteFaults(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		f, sim := newInjector(t, "action=drop,dir=write,cmd=GetFlashSize", 1)
+
+		if _, err := transact(t, f); !cybootloader_protocol.IsTimeout(err) {
+			t.Errorf("read after a dropped command: %v, want a timeout", err)
+		}
+		if n := sim.CommandCount(cybootloader_protocol.CmdGetFlashSize); n != 0 {
+			t.Errorf("device received %d commands, want 0", n)
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		f, sim := newInjector(t, "action=duplicate,dir=write", 1)
+
+		if _, err := transact(t, f); err != nil {
+			t.Fatalf("transact: %v", err)
+		}
+		if n := sim.CommandCount(cybootloader_protocol.CmdGetFlashSize); n != 2 {
+			t.Errorf("device received %d commands, want 2", n)
+		}
+	})
+
+	t.Run("bitflip", func(t *testing.T) {
+		f, sim := newInjector(t, "action=bitflip,dir=write,bytes=1", 1)
+
+		// Depending on the bit, the device rejects the frame or waits for
+		// more bytes
+		if r, _ := transact(t, f); bytes.Equal(r, flashSizeResponse) {
+			t.Errorf("corrupted command answered normally")
+		}
+		if n := sim.CommandCount(cybootloader_protocol.CmdGetFlashSize); n != 0 {
+			t.Errorf("device executed %d commands, want 0", n)
+		}
+	})
+
+	t.Run("delay cancelled", func(t *testing.T) {
+		f, sim := newInjector(t, "action=delay,dir=write,delay=1h", 1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := f.WriteContext(ctx, getFlashSize); !errors.Is(err, context.Canceled) {
+			t.Errorf("WriteContext = %v, want context.Canceled", err)
+		}
+		if n := sim.CommandCount(cybootloader_protocol.CmdGetFlashSize); n != 0 {
+			t.Errorf("device received %d commands, want 0", n)
+		}
+	})
+}
+
+func TestReadFaults(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		f, _ := newInjector(t, "action=drop,cmd=GetFlashSize", 1)
+
+		_, err := transact(t, f)
+		if !errors.Is(err, transport.ErrInjectedTimeout) || !cybootloader_protocol.IsTimeout(err) {
+			t.Errorf("Read = %v, want ErrInjectedTimeout", err)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		f, _ := newInjector(t, "action=truncate,bytes=4", 1)
+
+		r, err := transact(t, f)
+		if err != nil || !bytes.Equal(r, flashSizeResponse[:4]) {
+			t.Errorf("Read = % X, %v, want % X", r, err, flashSizeResponse[:4])
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		f, _ := newInjector(t, "action=duplicate", 1)
+
+		if r, err := transact(t, f); err != nil || !bytes.Equal(r, flashSizeResponse) {
+			t.Fatalf("Read = % X, %v", r, err)
+		}
+		b := make([]byte, 64)
+		n, err := f.Read(b)
+		if err != nil || !bytes.Equal(b[:n], flashSizeResponse) {
+			t.Errorf("second Read = % X, %v, want the response again", b[:n], err)
+		}
+	})
+
+	t.Run("delay cancelled", func(t *testing.T) {
+		f, _ := newInjector(t, "action=delay,delay=1h", 1)
+
+		if _, err := f.Write(getFlashSize); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := f.ReadContext(ctx, make([]byte, 64)); !errors.Is(err, context.Canceled) {
+			t.Errorf("ReadContext = %v, want context.Canceled", err)
+		}
+	})
+}
+
+func TestBitFlipIsSeeded(t *testing.T) {
+	flipped := func(seed int64) []byte {
+		f, _ := newInjector(t, "action=bitflip,bytes=3", seed)
+		r, err := transact(t, f)
+		if err != nil {
+			t.Fatalf("transact: %v", err)
+		}
+		if len(r) != len(flashSizeResponse) || bytes.Equal(r, flashSizeResponse) {
+			t.Fatalf("response = % X, want a corrupted copy of % X", r, flashSizeResponse)
+		}
+		return r
+	}
+
+	if a, b := flipped(7), flipped(7); !bytes.Equal(a, b) {
+		t.Errorf("same seed flipped % X and % X", a, b)
+	}
+}
+
+func TestNthMatch(t *testing.T) {
+	f, _ := newInjector(t, "action=drop,cmd=GetFlashSize,nth=2", 1)
+
+	var got []transport.Injection
+	f.OnInject(func(inj transport.Injection) { got = append(got, inj) })
+
+	for i := 1; i <= 3; i++ {
+		_, err := transact(t, f)
+		if dropped := cybootloader_protocol.IsTimeout(err); dropped != (i == 2) {
+			t.Errorf("transaction %d: %v", i, err)
+		}
+	}
+
+	injections := f.Injections()
+	if len(injections) != 1 || injections[0].Count != 2 || injections[0].Cmd != cybootloader_protocol.CmdGetFlashSize {
+		t.Errorf("Injections = %v", injections)
+	}
+	if len(got) != 1 || got[0].Count != 2 {
+		t.Errorf("OnInject saw %v", got)
+	}
+}
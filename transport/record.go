@@ -0,0 +1,199 @@
+package transport
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+// ErrorKind classifies a recorded error, so that a replay returns an error the
+// host handles the same way.
+type ErrorKind string
+
+const (
+	KindTimeout ErrorKind = "timeout" // Wraps cybootloader_protocol.ErrTimeout
+	KindEOF     ErrorKind = "eof"     // io.EOF
+	KindOther   ErrorKind = "other"
+)
+
+func errorKind(err error) ErrorKind {
+	switch {
+	case cybootloader_protocol.IsTimeout(err):
+		return KindTimeout
+	case errors.Is(err, io.EOF):
+		return KindEOF
+	default:
+		return KindOther
+	}
+}
+
+// Record is one transfer in a capture: a command written to the device or
+// data read back from it. A read that failed is recorded with its error and
+// no data.
+type Record struct {
+	Time   time.Time     `json:"time"`
+	Offset time.Duration `json:"offset"` // Time since the first record
+	Dir    Direction     `json:"dir"`
+	Data   HexBytes      `json:"data,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	Kind   ErrorKind     `json:"kind,omitempty"`
+}
+
+// Err rebuilds the recorded error, nil if the transfer succeeded. It keeps the
+// recorded message and matches the sentinel of its kind with errors.Is.
+// Records without a kind, from older captures, are of KindOther.
+func (r Record) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+	switch r.Kind {
+	case KindTimeout:
+		return &recordedError{msg: r.Error, kind: cybootloader_protocol.ErrTimeout}
+	case KindEOF:
+		return &recordedError{msg: r.Error, kind: io.EOF}
+	default:
+		return errors.New(r.Error)
+	}
+}
+
+// recordedError is a replayed error of a known kind.
+type recordedError struct {
+	msg  string
+	kind error
+}
+
+func (e *recordedError) Error() string {
+	return e.msg
+}
+
+func (e *recordedError) Unwrap() error {
+	return e.kind
+}
+
+// String formats the record for a debug log.
+func (r Record) String() string {
+	if r.Error != "" {
+		return fmt.Sprintf("%s +%s error: %s", r.Dir, r.Offset, r.Error)
+	}
+	return fmt.Sprintf("%s +%s % X", r.Dir, r.Offset, []byte(r.Data))
+}
+
+// HexBytes is a byte slice stored as a hex string in a capture file.
+type HexBytes []byte
+
+func (h HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+func (h *HexBytes) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid frame data: %w", err)
+	}
+	*h = b
+	return nil
+}
+
+// Recorder wraps a peripheral and writes every transfer to a capture, one
+// JSON record per line. Records are written as they happen, so a capture is
+// complete up to the last transfer even if the process exits abruptly.
+type Recorder struct {
+	mu      sync.Mutex
+	dev     io.ReadWriteCloser
+	enc     *json.Encoder
+	start   time.Time
+	onFrame func(Record)
+	err     error
+}
+
+// NewRecorder wraps dev and writes the capture to w. The caller owns w.
+func NewRecorder(dev io.ReadWriteCloser, w io.Writer) *Recorder {
+	return &Recorder{
+		dev: dev,
+		enc: json.NewEncoder(w),
+	}
+}
+
+// OnFrame registers a function called with every record, for debug logging.
+func (r *Recorder) OnFrame(fn func(Record)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onFrame = fn
+}
+
+// Err returns the first error writing the capture, if any. Capture errors do
+// not interrupt the traffic with the device.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+func (r *Recorder) record(dir Direction, b []byte, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.start.IsZero() {
+		r.start = now
+	}
+
+	rec := Record{
+		Time:   now,
+		Offset: now.Sub(r.start),
+		Dir:    dir,
+		Data:   append(HexBytes(nil), b...),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+		rec.Kind = errorKind(err)
+	}
+
+	if encErr := r.enc.Encode(rec); encErr != nil && r.err == nil {
+		r.err = fmt.Errorf("writing capture: %w", encErr)
+	}
+	if r.onFrame != nil {
+		r.onFrame(rec)
+	}
+}
+
+// Write sends b to the device and records it.
+func (r *Recorder) Write(b []byte) (int, error) {
+	return r.WriteContext(context.Background(), b)
+}
+
+// WriteContext is Write bounded by ctx when the device supports it.
+func (r *Recorder) WriteContext(ctx context.Context, b []byte) (int, error) {
+	n, err := writeContext(ctx, r.dev, b)
+	r.record(DirWrite, b, err)
+	return n, err
+}
+
+// Read reads from the device and records the data. Reads returning neither
+// data nor an error, and end of stream, are not recorded.
+func (r *Recorder) Read(b []byte) (int, error) {
+	return r.ReadContext(context.Background(), b)
+}
+
+// ReadContext is Read bounded by ctx when the device supports it.
+func (r *Recorder) ReadContext(ctx context.Context, b []byte) (int, error) {
+	n, err := readContext(ctx, r.dev, b)
+	if n > 0 || (err != nil && err != io.EOF) {
+		r.record(DirRead, b[:n], err)
+	}
+	return n, err
+}
+
+// Close closes the wrapped device.
+func (r *Recorder) Close() error {
+	return r.dev.Close()
+}
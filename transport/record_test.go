@@ -0,0 +1,209 @@
+package transport_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"bootloader-usb/cybootloader_protocol"
+	"bootloader-usb/transport"
+)
+
+// session runs a short bootloader session and returns the flash size and the
+// checksum of a programmed row.
+func session(dev io.ReadWriter) (cybootloader_protocol.FlashSize, byte, error) {
+	ctx := context.Background()
+	h := cybootloader_protocol.NewHost(dev)
+
+	size, err := h.GetFlashSize(ctx, 0)
+	if err != nil {
+		return size, 0, err
+	}
+	if err := h.ProgramRow(ctx, 0, 16, bytes.Repeat([]byte{0x5A}, 128)); err != nil {
+		return size, 0, err
+	}
+	ck, err := h.GetRowChecksum(ctx, 0, 16)
+	return size, ck, err
+}
+
+// capture records a session with a simulated device.
+func capture(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	rec := transport.NewRecorder(newSimulator(t), &buf)
+
+	var frames int
+	rec.OnFrame(func(transport.Record) { frames++ })
+
+	if _, _, err := session(rec); err != nil {
+		t.Fatalf("recorded session: %v", err)
+	}
+	if err := rec.Err(); err != nil {
+		t.Fatalf("Recorder.Err: %v", err)
+	}
+	if frames == 0 {
+		t.Fatal("OnFrame was never called")
+	}
+	return buf.Bytes()
+}
+
+func TestRecordReplay(t *testing.T) {
+	records, err := transport.LoadCapture(bytes.NewReader(capture(t)))
+	if err != nil {
+		t.Fatalf("LoadCapture: %v", err)
+	}
+
+	// Get Flash Size, two Send Data, Program Row and Get Row Checksum, each
+	// written then answered
+	if len(records) != 10 {
+		t.Fatalf("got %d records, want 10", len(records))
+	}
+	for i, rec := range records {
+		wantDir := transport.DirWrite
+		if i%2 == 1 {
+			wantDir = transport.DirRead
+		}
+		if rec.Dir != wantDir || len(rec.Data) == 0 || rec.Err() != nil {
+			t.Errorf("record %d = %v", i, rec)
+		}
+	}
+
+	replay := transport.NewReplay(records)
+	size, ck, err := session(replay)
+	if err != nil {
+		t.Fatalf("replayed session: %v", err)
+	}
+	if size != (cybootloader_protocol.FlashSize{StartRow: 16, EndRow: 255}) || ck != 0x00 {
+		t.Errorf("replayed session = %+v, checksum 0x%02X", size, ck)
+	}
+	if n := replay.Remaining(); n != 0 {
+		t.Errorf("Remaining = %d, want 0", n)
+	}
+
+	if _, err := replay.Write([]byte{0x01}); !errors.Is(err, transport.ErrReplayEnd) {
+		t.Errorf("Write past the capture: %v, want ErrReplayEnd", err)
+	}
+	if _, err := replay.Read(make([]byte, 64)); !errors.Is(err, transport.ErrReplayTimeout) || !cybootloader_protocol.IsTimeout(err) {
+		t.Errorf("Read past the capture: %v, want ErrReplayTimeout", err)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	records, err := transport.LoadCapture(bytes.NewReader(capture(t)))
+	if err != nil {
+		t.Fatalf("LoadCapture: %v", err)
+	}
+
+	replay := transport.NewReplay(records)
+	other := cybootloader_protocol.CreateGetFlashSizeArrayCmd(1, cybootloader_protocol.ChecksumSum)
+	_, err = replay.Write(other)
+
+	var mismatch *transport.MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Write = %v, want a MismatchError", err)
+	}
+	if mismatch.Index != 0 || !bytes.Equal(mismatch.Expected, records[0].Data) || !bytes.Equal(mismatch.Got, other) {
+		t.Errorf("MismatchError = %+v", mismatch)
+	}
+}
+
+func TestReplaySplitsReads(t *testing.T) {
+	replay := transport.NewReplay([]transport.Record{
+		{Dir: transport.DirWrite, Data: []byte{0x01, 0x02}},
+		{Dir: transport.DirRead, Data: []byte{0x11, 0x22, 0x33}},
+		{Dir: transport.DirRead, Error: "read timed out", Kind: transport.KindTimeout},
+	})
+
+	if _, err := replay.Write([]byte{0x01, 0x02}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	b := make([]byte, 2)
+	if n, err := replay.Read(b); err != nil || !bytes.Equal(b[:n], []byte{0x11, 0x22}) {
+		t.Errorf("first Read = % X, %v", b[:n], err)
+	}
+	if n, err := replay.Read(b); err != nil || !bytes.Equal(b[:n], []byte{0x33}) {
+		t.Errorf("second Read = % X, %v", b[:n], err)
+	}
+	if _, err := replay.Read(b); !cybootloader_protocol.IsTimeout(err) || err.Error() != "read timed out" {
+		t.Errorf("third Read = %v, want the recorded timeout", err)
+	}
+
+	if err := replay.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := replay.Read(b); !errors.Is(err, transport.ErrReplayClosed) {
+		t.Errorf("Read after Close: %v, want ErrReplayClosed", err)
+	}
+}
+
+func TestRecordTimeout(t *testing.T) {
+	var buf bytes.Buffer
+	rec := transport.NewRecorder(newSimulator(t), &buf)
+
+	// The simulator times out when no response is pending
+	if _, err := rec.Read(make([]byte, 64)); !cybootloader_protocol.IsTimeout(err) {
+		t.Fatalf("Read = %v, want a timeout", err)
+	}
+
+	records, err := transport.LoadCapture(&buf)
+	if err != nil {
+		t.Fatalf("LoadCapture: %v", err)
+	}
+	if len(records) != 1 || records[0].Dir != transport.DirRead || records[0].Kind != transport.KindTimeout {
+		t.Fatalf("records = %v", records)
+	}
+	if err := records[0].Err(); !cybootloader_protocol.IsTimeout(err) {
+		t.Errorf("Err = %v, want a timeout", err)
+	}
+}
+
+func TestRecordErr(t *testing.T) {
+	tests := []struct {
+		name    string
+		rec     transport.Record
+		timeout bool
+		eof     bool
+	}{
+		{"success", transport.Record{}, false, false},
+		{"timeout", transport.Record{Error: "timed out", Kind: transport.KindTimeout}, true, false},
+		{"eof", transport.Record{Error: "EOF", Kind: transport.KindEOF}, false, true},
+		{"other", transport.Record{Error: "device unplugged", Kind: transport.KindOther}, false, false},
+		{"no kind", transport.Record{Error: "timed out"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rec.Err()
+			if (err == nil) != (tt.rec.Error == "") {
+				t.Fatalf("Err = %v", err)
+			}
+			if err != nil && err.Error() != tt.rec.Error {
+				t.Errorf("message = %q, want %q", err.Error(), tt.rec.Error)
+			}
+			if cybootloader_protocol.IsTimeout(err) != tt.timeout || errors.Is(err, io.EOF) != tt.eof {
+				t.Errorf("Err = %v: timeout %v, EOF %v", err, cybootloader_protocol.IsTimeout(err), errors.Is(err, io.EOF))
+			}
+		})
+	}
+}
+
+func TestLoadCaptureErrors(t *testing.T) {
+	for _, capture := range []string{
+		`{"dir":"write","data":"0138"` + "\n",
+		`{"dir":"sideways","data":"0138"}` + "\n",
+		`{"dir":"write","data":"zz"}` + "\n",
+	} {
+		if _, err := transport.LoadCapture(strings.NewReader(capture)); err == nil {
+			t.Errorf("LoadCapture(%q) succeeded", capture)
+		}
+	}
+
+	records, err := transport.LoadCapture(strings.NewReader("\n" + `{"dir":"write","data":"0138"}` + "\n\n"))
+	if err != nil || len(records) != 1 || !bytes.Equal(records[0].Data, []byte{0x01, 0x38}) {
+		t.Errorf("LoadCapture with blank lines = %v, %v", records, err)
+	}
+}
@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+var (
+	// ErrReplayTimeout is returned by Read when the capture has no data for the
+	// last command. It wraps cybootloader_protocol.ErrTimeout.
+	ErrReplayTimeout = fmt.Errorf("%w: no data in capture", cybootloader_protocol.ErrTimeout)
+	// ErrReplayEnd is returned by Write once every command of the capture has
+	// been replayed.
+	ErrReplayEnd = errors.New("end of capture")
+	// ErrReplayClosed is returned after the replay was closed.
+	ErrReplayClosed = errors.New("replay closed")
+)
+
+// MismatchError is returned by Write when the command differs from the one
+// in the capture, meaning the host no longer behaves as when it was recorded.
+type MismatchError struct {
+	Index    int // Index of the expected record in the capture
+	Expected []byte
+	Got      []byte
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("command differs from capture record %d: expected % X, got % X", e.Index, e.Expected, e.Got)
+}
+
+// LoadCapture reads the records written by a Recorder.
+func LoadCapture(r io.Reader) ([]Record, error) {
+	var records []Record
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("capture line %d: %w", line, err)
+		}
+		if rec.Dir != DirRead && rec.Dir != DirWrite {
+			return nil, fmt.Errorf("capture line %d: unknown direction %q", line, rec.Dir)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading capture: %w", err)
+	}
+
+	return records, nil
+}
+
+// Replay is a fake device playing back a capture. Every command written must
+// match the next command of the capture, and the reads recorded after it are
+// returned in order, including recorded read errors. Timing is not
+// reproduced.
+type Replay struct {
+	mu      sync.Mutex
+	records []Record
+	next    int
+	closed  bool
+}
+
+// NewReplay creates a fake device for the given records.
+func NewReplay(records []Record) *Replay {
+	return &Replay{records: records}
+}
+
+// Remaining returns the number of records not replayed yet.
+func (p *Replay) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.records) - p.next
+}
+
+// Write checks b against the next command of the capture.
+func (p *Replay) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, ErrReplayClosed
+	}
+
+	// responses the host did not read are skipped
+	for p.next < len(p.records) && p.records[p.next].Dir == DirRead {
+		p.next++
+	}
+	if p.next >= len(p.records) {
+		return 0, ErrReplayEnd
+	}
+
+	rec := p.records[p.next]
+	if !bytes.Equal(rec.Data, b) {
+		return 0, &MismatchError{Index: p.next, Expected: rec.Data, Got: append([]byte(nil), b...)}
+	}
+	p.next++
+
+	if err := rec.Err(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the next recorded read following the last command.
+func (p *Replay) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, ErrReplayClosed
+	}
+
+	if p.next >= len(p.records) || p.records[p.next].Dir != DirRead {
+		return 0, ErrReplayTimeout
+	}
+
+	rec := &p.records[p.next]
+	n := copy(b, rec.Data)
+	if n < len(rec.Data) {
+		// keep the rest for the next read
+		rec.Data = rec.Data[n:]
+		return n, nil
+	}
+	p.next++
+
+	return n, rec.Err()
+}
+
+// Close stops the replay.
+func (p *Replay) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	return nil
+}
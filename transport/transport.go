@@ -0,0 +1,29 @@
+// Package transport provides wrappers around bootloader peripherals: fault
+// injection for robustness testing, and capture and replay of the traffic.
+//
+// The wrappers keep the context support of the wrapped device, so that a
+// cancelled programming run still interrupts a pending read.
+package transport
+
+import (
+	"context"
+	"io"
+
+	"bootloader-usb/cybootloader_protocol"
+)
+
+// readContext reads from dev, bounded by ctx when dev supports it.
+func readContext(ctx context.Context, dev io.Reader, b []byte) (int, error) {
+	if cr, ok := dev.(cybootloader_protocol.ContextReader); ok {
+		return cr.ReadContext(ctx, b)
+	}
+	return dev.Read(b)
+}
+
+// writeContext writes to dev, bounded by ctx when dev supports it.
+func writeContext(ctx context.Context, dev io.Writer, b []byte) (int, error) {
+	if cw, ok := dev.(cybootloader_protocol.ContextWriter); ok {
+		return cw.WriteContext(ctx, b)
+	}
+	return dev.Write(b)
+}
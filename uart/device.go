@@ -1,6 +1,7 @@
 package uart
 
 import (
+	"context"
 	"github.com/tarm/serial"
 	"time"
 )
@@ -12,8 +13,8 @@ type Device struct {
 func NewDevice(port string) (*Device, error) {
 	dev, err := serial.OpenPort(
 		&serial.Config{
-			Name: port,
-			Baud: 115200,
+			Name:        port,
+			Baud:        115200,
 			ReadTimeout: time.Millisecond * 1000,
 		},
 	)
@@ -32,6 +33,23 @@ func (d *Device) Read(buf []byte) (int, error) {
 	return d.dev.Read(buf)
 }
 
+// ReadContext reads from the port unless ctx is already done. A read blocks
+// for at most the port read timeout.
+func (d *Device) ReadContext(ctx context.Context, buf []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return d.dev.Read(buf)
+}
+
 func (d *Device) Write(buf []byte) (int, error) {
 	return d.dev.Write(buf)
 }
+
+// WriteContext writes to the port unless ctx is already done.
+func (d *Device) WriteContext(ctx context.Context, buf []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return d.dev.Write(buf)
+}
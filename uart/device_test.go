@@ -0,0 +1,30 @@
+package uart
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDeviceMissingPort(t *testing.T) {
+	if _, err := NewDevice(filepath.Join(t.TempDir(), "ttyMissing")); err == nil {
+		t.Error("NewDevice of a missing port succeeded")
+	}
+}
+
+// A done context must fail the transfer without touching the port, which is
+// nil here.
+func TestContextDone(t *testing.T) {
+	d := &Device{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := d.ReadContext(ctx, make([]byte, 64)); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadContext = %v, want context.Canceled", err)
+	}
+	if _, err := d.WriteContext(ctx, []byte{0x01}); !errors.Is(err, context.Canceled) {
+		t.Errorf("WriteContext = %v, want context.Canceled", err)
+	}
+}
@@ -204,6 +204,12 @@ func (d *Device) Init() error {
 
 // Read reads data from the USB device input endpoint with timeout
 func (d *Device) Read(b []byte) (int, error) {
+	return d.ReadContext(context.Background(), b)
+}
+
+// ReadContext reads data from the USB device input endpoint. The read ends at
+// the configured timeout or when ctx is done, whichever comes first.
+func (d *Device) ReadContext(ctx context.Context, b []byte) (int, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
@@ -215,11 +221,14 @@ func (d *Device) Read(b []byte) (int, error) {
 		return 0, errors.New("device not initialized - call Init() first")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), d.config.ReadTimeout)
+	readCtx, cancel := context.WithTimeout(ctx, d.config.ReadTimeout)
 	defer cancel()
 
-	n, err := d.epIn.ReadContext(ctx, b)
+	n, err := d.epIn.ReadContext(readCtx, b)
 	if err != nil {
+		if ctx.Err() != nil {
+			return n, fmt.Errorf("read cancelled: %w", ctx.Err())
+		}
 		if errors.Is(err, context.DeadlineExceeded) {
 			return n, fmt.Errorf("read timeout after %v: %w", d.config.ReadTimeout, err)
 		}
@@ -231,6 +240,12 @@ func (d *Device) Read(b []byte) (int, error) {
 
 // Write writes data to the USB device output endpoint with timeout
 func (d *Device) Write(b []byte) (int, error) {
+	return d.WriteContext(context.Background(), b)
+}
+
+// WriteContext writes data to the USB device output endpoint. The write ends
+// at the configured timeout or when ctx is done, whichever comes first.
+func (d *Device) WriteContext(ctx context.Context, b []byte) (int, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
@@ -246,11 +261,14 @@ func (d *Device) Write(b []byte) (int, error) {
 		return 0, nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), d.config.WriteTimeout)
+	writeCtx, cancel := context.WithTimeout(ctx, d.config.WriteTimeout)
 	defer cancel()
 
-	n, err := d.epOut.WriteContext(ctx, b)
+	n, err := d.epOut.WriteContext(writeCtx, b)
 	if err != nil {
+		if ctx.Err() != nil {
+			return n, fmt.Errorf("write cancelled: %w", ctx.Err())
+		}
 		if errors.Is(err, context.DeadlineExceeded) {
 			return n, fmt.Errorf("write timeout after %v: %w", d.config.WriteTimeout, err)
 		}
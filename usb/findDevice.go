@@ -14,50 +14,45 @@ const (
 	ProductId = 0xb71d
 )
 
-func FindDevice(serial string) (*Device, error) {
-	const (
-		maxRetries     = 10
-		retryDelay     = 200 * time.Millisecond
-		timeoutContext = 5 * time.Second
-	)
+const (
+	// DefaultFindTimeout bounds the device search when no deadline is given
+	DefaultFindTimeout = 5 * time.Second
+	// FindRetryDelay is the delay between two device searches
+	FindRetryDelay = 200 * time.Millisecond
+)
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeoutContext)
+// FindDevice finds a USB device by serial number, retrying for up to
+// DefaultFindTimeout while the device enumerates.
+func FindDevice(serial string) (*Device, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultFindTimeout)
 	defer cancel()
 
+	return FindDeviceContext(ctx, serial)
+}
+
+// FindDeviceContext finds a USB device by serial number, retrying every
+// FindRetryDelay until the device is found or ctx is done.
+func FindDeviceContext(ctx context.Context, serial string) (*Device, error) {
 	vendorID := gousb.ID(VendorId)
 	productID := gousb.ID(ProductId)
 
-	// First attempt: try immediately, subsequent attempts: wait for ticker
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if attempt == 1 {
-			// First attempt without delay
-			device, err := findMatchingDevice(serial, vendorID, productID)
-			if err != nil {
-				slog.Warn("Failed to find device", "error", err, "attempt", attempt)
-			}
-			if device != nil {
-				return device, nil
-			}
-			continue
+	// First attempt: try immediately, subsequent attempts: wait for the delay
+	for attempt := 1; ; attempt++ {
+		device, err := findMatchingDevice(serial, vendorID, productID)
+		if err != nil {
+			slog.Warn("Failed to find device", "error", err, "attempt", attempt)
+		}
+		if device != nil {
+			return device, nil
 		}
 
-		// Subsequent attempts with delay
 		select {
 		case <-ctx.Done():
-			return nil, fmt.Errorf("device search timed out after %v", timeoutContext)
-		case <-time.After(retryDelay):
-			device, err := findMatchingDevice(serial, vendorID, productID)
-			if err != nil {
-				slog.Warn("Failed to find device", "error", err, "attempt", attempt)
-			}
-			if device != nil {
-				return device, nil
-			}
+			return nil, fmt.Errorf("no devices found matching VID %04X, PID %04X, and serial %s after %d attempts: %w",
+				vendorID, productID, serial, attempt, ctx.Err())
+		case <-time.After(FindRetryDelay):
 		}
 	}
-
-	return nil, fmt.Errorf("no devices found matching VID %04X, PID %04X, and serial %s after %d attempts",
-		vendorID, productID, serial, maxRetries)
 }
 
 // findMatchingDevice encapsulates the device discovery and matching logic
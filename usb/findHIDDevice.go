@@ -12,45 +12,31 @@ import (
 
 // FindHIDDevice finds a HID device by serial number in /dev/hidraw_{serial} format
 func FindHIDDevice(serial string) (*HIDDevice, error) {
-	const (
-		maxRetries     = 10
-		retryDelay     = 200 * time.Millisecond
-		timeoutContext = 5 * time.Second
-	)
-
-	ctx, cancel := context.WithTimeout(context.Background(), timeoutContext)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultFindTimeout)
 	defer cancel()
 
+	return FindHIDDeviceContext(ctx, serial)
+}
+
+// FindHIDDeviceContext finds a HID device by serial number, retrying every
+// FindRetryDelay until the device is found or ctx is done.
+func FindHIDDeviceContext(ctx context.Context, serial string) (*HIDDevice, error) {
 	// First attempt: try immediately, subsequent attempts: wait for delay
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if attempt == 1 {
-			// First attempt without delay
-			device, err := findMatchingHIDDevice(serial)
-			if err != nil {
-				slog.Warn("Failed to find HID device", "error", err, "attempt", attempt, "serial", serial)
-			}
-			if device != nil {
-				return device, nil
-			}
-			continue
+	for attempt := 1; ; attempt++ {
+		device, err := findMatchingHIDDevice(serial)
+		if err != nil {
+			slog.Warn("Failed to find HID device", "error", err, "attempt", attempt, "serial", serial)
+		}
+		if device != nil {
+			return device, nil
 		}
 
-		// Subsequent attempts with delay
 		select {
 		case <-ctx.Done():
-			return nil, fmt.Errorf("HID device search timed out after %v", timeoutContext)
-		case <-time.After(retryDelay):
-			device, err := findMatchingHIDDevice(serial)
-			if err != nil {
-				slog.Warn("Failed to find HID device", "error", err, "attempt", attempt, "serial", serial)
-			}
-			if device != nil {
-				return device, nil
-			}
+			return nil, fmt.Errorf("no HID devices found matching serial %s after %d attempts: %w", serial, attempt, ctx.Err())
+		case <-time.After(FindRetryDelay):
 		}
 	}
-
-	return nil, fmt.Errorf("no HID devices found matching serial %s after %d attempts", serial, maxRetries)
 }
 
 // findMatchingHIDDevice encapsulates the HID device discovery and matching logic
@@ -1,6 +1,7 @@
 package usb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -123,6 +124,12 @@ func (d *HIDDevice) Init() error {
 
 // Read reads data from the HID device with timeout
 func (d *HIDDevice) Read(b []byte) (int, error) {
+	return d.ReadContext(context.Background(), b)
+}
+
+// ReadContext reads data from the HID device. The read ends at the configured
+// timeout or when ctx is done, whichever comes first.
+func (d *HIDDevice) ReadContext(ctx context.Context, b []byte) (int, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
@@ -134,14 +141,27 @@ func (d *HIDDevice) Read(b []byte) (int, error) {
 		return 0, errors.New("device not initialized - call Init() first")
 	}
 
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("read cancelled: %w", err)
+	}
+
 	// Set read deadline
-	if err := d.file.SetReadDeadline(time.Now().Add(d.config.ReadTimeout)); err != nil {
+	if err := d.file.SetReadDeadline(deadline(ctx, d.config.ReadTimeout)); err != nil {
 		return 0, fmt.Errorf("failed to set read deadline: %w", err)
 	}
 
+	// Unblock the read as soon as ctx is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		d.file.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
 	n, err := d.file.Read(b)
 	if err != nil {
-		if os.IsTimeout(err) {
+		if ctx.Err() != nil {
+			return n, fmt.Errorf("read cancelled: %w", ctx.Err())
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
 			return n, fmt.Errorf("read timeout after %v: %w", d.config.ReadTimeout, err)
 		}
 		return n, fmt.Errorf("read failed: %w", err)
@@ -152,6 +172,12 @@ func (d *HIDDevice) Read(b []byte) (int, error) {
 
 // Write writes data to the HID device with timeout
 func (d *HIDDevice) Write(b []byte) (int, error) {
+	return d.WriteContext(context.Background(), b)
+}
+
+// WriteContext writes data to the HID device. The write ends at the
+// configured timeout or when ctx is done, whichever comes first.
+func (d *HIDDevice) WriteContext(ctx context.Context, b []byte) (int, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
@@ -167,14 +193,26 @@ func (d *HIDDevice) Write(b []byte) (int, error) {
 		return 0, nil
 	}
 
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("write cancelled: %w", err)
+	}
+
 	// Set write deadline
-	if err := d.file.SetWriteDeadline(time.Now().Add(d.config.WriteTimeout)); err != nil {
+	if err := d.file.SetWriteDeadline(deadline(ctx, d.config.WriteTimeout)); err != nil {
 		return 0, fmt.Errorf("failed to set write deadline: %w", err)
 	}
 
+	stop := context.AfterFunc(ctx, func() {
+		d.file.SetWriteDeadline(time.Now())
+	})
+	defer stop()
+
 	n, err := d.file.Write(b)
 	if err != nil {
-		if os.IsTimeout(err) {
+		if ctx.Err() != nil {
+			return n, fmt.Errorf("write cancelled: %w", ctx.Err())
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
 			return n, fmt.Errorf("write timeout after %v: %w", d.config.WriteTimeout, err)
 		}
 		return n, fmt.Errorf("write failed: %w", err)
@@ -183,6 +221,15 @@ func (d *HIDDevice) Write(b []byte) (int, error) {
 	return n, nil
 }
 
+// deadline returns the earlier of the ctx deadline and now plus timeout
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	t := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(t) {
+		return d
+	}
+	return t
+}
+
 // Close closes the HID device file and marks the device as closed
 func (d *HIDDevice) Close() error {
 	d.mu.Lock()